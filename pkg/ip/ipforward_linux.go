@@ -18,7 +18,7 @@ import (
 	"bytes"
 	"io/ioutil"
 
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 )
 
 func EnableIP4Forward() error {
@@ -15,11 +15,15 @@
 package ip
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
@@ -160,6 +164,71 @@ func SetupVeth(contVethName string, mtu int, hostNS ns.NetNS) (net.Interface, ne
 	return ifaceFromNetlinkLink(hostVeth), ifaceFromNetlinkLink(contVeth), nil
 }
 
+// GetHostVethPeer returns the end of the veth ifName, in the network
+// namespace at netnsPath, that lives in the current namespace. Plugins
+// chained after a veth-based plugin use it to find the host veth, which
+// the previous result does not single out. It returns ErrLinkNotFound if
+// either end is gone.
+func GetHostVethPeer(netnsPath, ifName string) (netlink.Link, error) {
+	var peerIndex int
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return ErrLinkNotFound
+			}
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if _, ok := link.(*netlink.Veth); !ok {
+			return fmt.Errorf("interface %q is not a veth", ifName)
+		}
+		peerIndex = link.Attrs().ParentIndex
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil, ErrLinkNotFound
+		}
+		return nil, fmt.Errorf("failed to lookup veth peer of %q: %v", ifName, err)
+	}
+	return link, nil
+}
+
+// The ends of a container veth.
+const (
+	VethSideHost      = "host"
+	VethSideContainer = "container"
+)
+
+// WithVethSide runs f on one end of the veth ifName in the network
+// namespace at netnsPath: on ifName itself in that namespace, or on its
+// peer in the current one. It returns ErrLinkNotFound if the end is gone.
+func WithVethSide(side, netnsPath, ifName string, f func(netlink.Link) error) error {
+	if side != VethSideContainer {
+		link, err := GetHostVethPeer(netnsPath, ifName)
+		if err != nil {
+			return err
+		}
+		return f(link)
+	}
+
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return ErrLinkNotFound
+			}
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		return f(link)
+	})
+}
+
 // DelLinkByName removes an interface link.
 func DelLinkByName(ifName string) error {
 	iface, err := netlink.LinkByName(ifName)
@@ -232,3 +301,113 @@ func SetHWAddrByIP(ifName string, ip4 net.IP, ip6 net.IP) error {
 
 	return nil
 }
+
+// FindLink returns the link in the current namespace selected by name,
+// MAC address or kernel device path, in that order of precedence.
+func FindLink(devname, hwaddr, kernelpath string) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node links: %v", err)
+	}
+
+	if len(devname) > 0 {
+		return netlink.LinkByName(devname)
+	} else if len(hwaddr) > 0 {
+		hwAddr, err := net.ParseMAC(hwaddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAC address %q: %v", hwaddr, err)
+		}
+
+		for _, link := range links {
+			if bytes.Equal(link.Attrs().HardwareAddr, hwAddr) {
+				return link, nil
+			}
+		}
+	} else if len(kernelpath) > 0 {
+		if !filepath.IsAbs(kernelpath) || !strings.HasPrefix(kernelpath, "/sys/devices/") {
+			return nil, fmt.Errorf("kernel device path %q must be absolute and begin with /sys/devices/", kernelpath)
+		}
+		netDir := filepath.Join(kernelpath, "net")
+		files, err := ioutil.ReadDir(netDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find network devices at %q", netDir)
+		}
+
+		// Grab the first device from eg /sys/devices/pci0000:00/0000:00:19.0/net
+		for _, file := range files {
+			// Make sure it's really an interface
+			for _, l := range links {
+				if file.Name() == l.Attrs().Name {
+					return l, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("failed to find physical interface")
+}
+
+// MoveLinkIn moves the host link into the container namespace and renames
+// it to ifName there. The host name of the link is saved in its alias, so
+// that MoveLinkOut can restore it. It returns the link in the container.
+func MoveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netlink.Link, error) {
+	if err := netlink.LinkSetNsFd(hostDev, int(containerNs.Fd())); err != nil {
+		return nil, err
+	}
+
+	var contDev netlink.Link
+	if err := containerNs.Do(func(_ ns.NetNS) error {
+		var err error
+		contDev, err = netlink.LinkByName(hostDev.Attrs().Name)
+		if err != nil {
+			return fmt.Errorf("failed to find %q: %v", hostDev.Attrs().Name, err)
+		}
+		// Save host device name into the container device's alias property
+		if err := netlink.LinkSetAlias(contDev, hostDev.Attrs().Name); err != nil {
+			return fmt.Errorf("failed to set alias to %q: %v", hostDev.Attrs().Name, err)
+		}
+		// Rename container device to respect ifName
+		if err := netlink.LinkSetName(contDev, ifName); err != nil {
+			return fmt.Errorf("failed to rename device %q to %q: %v", hostDev.Attrs().Name, ifName, err)
+		}
+		// Retrieve link again to get up-to-date name and attributes
+		contDev, err = netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %q: %v", ifName, err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return contDev, nil
+}
+
+// MoveLinkOut returns the link ifName of the container namespace to the
+// current namespace, under the host name saved in its alias by MoveLinkIn.
+func MoveLinkOut(containerNs ns.NetNS, ifName string) error {
+	defaultNs, err := ns.GetCurrentNS()
+	if err != nil {
+		return err
+	}
+	defer defaultNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		dev, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %q: %v", ifName, err)
+		}
+		name := ifName
+		if alias := dev.Attrs().Alias; alias != "" && alias != ifName {
+			// Rename device to it's original name
+			if err := netlink.LinkSetName(dev, alias); err != nil {
+				return fmt.Errorf("failed to restore %q to original name %q: %v", ifName, alias, err)
+			}
+			name = alias
+		}
+		if err := netlink.LinkSetNsFd(dev, int(defaultNs.Fd())); err != nil {
+			return fmt.Errorf("failed to move %q to host netns: %v", name, err)
+		}
+		return nil
+	})
+}
@@ -195,6 +195,46 @@ var _ = Describe("Link", func() {
 
 	})
 
+	It("GetHostVethPeer must find the host endpoint", func() {
+		_ = hostNetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := ip.GetHostVethPeer(containerNetNS.Path(), containerVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(hostVethName))
+			Expect(link.Attrs().Index).To(Equal(hostVeth.Index))
+
+			_, err = ip.GetHostVethPeer(containerNetNS.Path(), "THIS_DONT_EXIST")
+			Expect(err).To(Equal(ip.ErrLinkNotFound))
+			return nil
+		})
+	})
+
+	It("WithVethSide must run on either endpoint", func() {
+		_ = hostNetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var name string
+			getName := func(link netlink.Link) error {
+				name = link.Attrs().Name
+				return nil
+			}
+			err := ip.WithVethSide(ip.VethSideHost, containerNetNS.Path(), containerVethName, getName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal(hostVethName))
+
+			err = ip.WithVethSide(ip.VethSideContainer, containerNetNS.Path(), containerVethName, getName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal(containerVethName))
+
+			for _, side := range []string{ip.VethSideHost, ip.VethSideContainer} {
+				err = ip.WithVethSide(side, containerNetNS.Path(), "THIS_DONT_EXIST", getName)
+				Expect(err).To(Equal(ip.ErrLinkNotFound))
+			}
+			return nil
+		})
+	})
+
 	It("DelLinkByName must delete the veth endpoints", func() {
 		_ = containerNetNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
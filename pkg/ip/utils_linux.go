@@ -0,0 +1,97 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// ValidateExpectedInterfaceIPs checks that every address in resultIPs is
+// still configured on ifName. Callers pass only the IPs that belong to ifName.
+func ValidateExpectedInterfaceIPs(ifName string, resultIPs []*current.IPConfig) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", ifName), "failed to find interface %q: %v", ifName, err)
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+	}
+
+	for _, ipc := range resultIPs {
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(ipc.Address.IP) && addr.Mask.String() == ipc.Address.Mask.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return utils.NewCheckError(fmt.Sprintf("address %q", ipc.Address.String()), "address %s not found on interface %q", ipc.Address.String(), ifName)
+		}
+	}
+
+	return nil
+}
+
+// ValidateExpectedRoute checks that a route to the destination of each of
+// resultRoutes exists, via the expected gateway when one is given.
+func ValidateExpectedRoute(resultRoutes []*types.Route) error {
+	for _, route := range resultRoutes {
+		family := netlink.FAMILY_V6
+		if route.Dst.IP.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+
+		filter := &netlink.Route{Dst: &route.Dst, Gw: route.GW}
+		filterMask := netlink.RT_FILTER_DST
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			// Default routes are reported with a nil destination
+			filter.Dst = nil
+		}
+		if route.GW != nil {
+			filterMask |= netlink.RT_FILTER_GW
+		}
+
+		found, err := netlink.RouteListFiltered(family, filter, filterMask)
+		if err != nil {
+			return fmt.Errorf("failed to list routes: %v", err)
+		}
+		if len(found) == 0 {
+			return utils.NewCheckError(fmt.Sprintf("route %q", route.Dst.String()), "route %s via %v not found", route.Dst.String(), route.GW)
+		}
+	}
+
+	return nil
+}
+
+// GetVethPeerIfindex returns the veth link named ifName and the interface
+// index of its peer, which may live in another network namespace.
+func GetVethPeerIfindex(ifName string) (netlink.Link, int, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, -1, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if _, ok := link.(*netlink.Veth); !ok {
+		return nil, -1, fmt.Errorf("interface %q is not a veth", ifName)
+	}
+	return link, link.Attrs().ParentIndex, nil
+}
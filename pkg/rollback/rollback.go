@@ -0,0 +1,75 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rollback provides an undo stack for plugins whose ADD sets up
+// several resources in turn. Each step that succeeds registers an action
+// that reverses it; if a later step fails, the actions run in reverse
+// order so that a failed ADD leaves nothing behind.
+package rollback
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type action struct {
+	desc string
+	fn   func() error
+}
+
+// Stack is a LIFO list of compensating actions. The zero value is an
+// empty stack ready to use.
+type Stack struct {
+	actions []action
+}
+
+// Push registers fn to undo the step described by desc.
+func (s *Stack) Push(desc string, fn func() error) {
+	s.actions = append(s.actions, action{desc, fn})
+}
+
+// Commit discards all registered actions; a later Rollback does nothing.
+// Call it once every step has succeeded.
+func (s *Stack) Commit() {
+	s.actions = nil
+}
+
+// Rollback runs the registered actions, most recent first, and empties the
+// stack. Every action is run even if an earlier one fails; the failures
+// are returned together.
+func (s *Stack) Rollback() error {
+	var errs []string
+	for i := len(s.actions) - 1; i >= 0; i-- {
+		a := s.actions[i]
+		if err := a.fn(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", a.desc, err))
+		}
+	}
+	s.actions = nil
+
+	if errs != nil {
+		return fmt.Errorf("rollback failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RollbackAndLog is Rollback for use in a defer. A failed undo cannot
+// change the result of the ADD, so it is logged to stderr, where the
+// runtime collects plugin output, instead of being dropped.
+func (s *Stack) RollbackAndLog() {
+	if err := s.Rollback(); err != nil {
+		log.Print(err)
+	}
+}
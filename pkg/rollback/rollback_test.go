@@ -0,0 +1,93 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rollback_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/rollback"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stack", func() {
+	var (
+		undo  rollback.Stack
+		order []string
+	)
+
+	record := func(name string) func() error {
+		return func() error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	BeforeEach(func() {
+		undo = rollback.Stack{}
+		order = nil
+	})
+
+	It("runs actions in reverse order", func() {
+		undo.Push("first", record("first"))
+		undo.Push("second", record("second"))
+		undo.Push("third", record("third"))
+
+		Expect(undo.Rollback()).To(Succeed())
+		Expect(order).To(Equal([]string{"third", "second", "first"}))
+
+		// The stack is emptied by Rollback
+		Expect(undo.Rollback()).To(Succeed())
+		Expect(order).To(HaveLen(3))
+	})
+
+	It("runs nothing after Commit", func() {
+		undo.Push("first", record("first"))
+		undo.Commit()
+
+		Expect(undo.Rollback()).To(Succeed())
+		Expect(order).To(BeEmpty())
+	})
+
+	It("runs every action and reports all failures", func() {
+		undo.Push("release IP", record("release IP"))
+		undo.Push("delete link", func() error {
+			return errors.New("link busy")
+		})
+		undo.Push("teardown masq", func() error {
+			return errors.New("no such chain")
+		})
+
+		err := undo.Rollback()
+		Expect(err).To(MatchError("rollback failed: teardown masq: no such chain; delete link: link busy"))
+		Expect(order).To(Equal([]string{"release IP"}))
+	})
+
+	It("logs the failures of a deferred rollback", func() {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		undo.Push("delete link", func() error {
+			return errors.New("link busy")
+		})
+		undo.RollbackAndLog()
+		Expect(buf.String()).To(ContainSubstring("rollback failed: delete link: link busy"))
+	})
+})
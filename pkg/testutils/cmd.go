@@ -22,8 +22,13 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 )
 
+// ContainerID is the container ID in the environment of the plugin, which
+// delegated plugins such as IPAM are called with.
+const ContainerID = "dummy"
+
 func envCleanup() {
 	os.Unsetenv("CNI_COMMAND")
+	os.Unsetenv("CNI_CONTAINERID")
 	os.Unsetenv("CNI_PATH")
 	os.Unsetenv("CNI_NETNS")
 	os.Unsetenv("CNI_IFNAME")
@@ -31,6 +36,7 @@ func envCleanup() {
 
 func CmdAddWithResult(cniNetns, cniIfname string, conf []byte, f func() error) (types.Result, []byte, error) {
 	os.Setenv("CNI_COMMAND", "ADD")
+	os.Setenv("CNI_CONTAINERID", ContainerID)
 	os.Setenv("CNI_PATH", os.Getenv("PATH"))
 	os.Setenv("CNI_NETNS", cniNetns)
 	os.Setenv("CNI_IFNAME", cniIfname)
@@ -74,8 +80,20 @@ func CmdAddWithResult(cniNetns, cniIfname string, conf []byte, f func() error) (
 	return result, out, nil
 }
 
+func CmdCheckWithResult(cniNetns, cniIfname string, f func() error) error {
+	os.Setenv("CNI_COMMAND", "CHECK")
+	os.Setenv("CNI_CONTAINERID", ContainerID)
+	os.Setenv("CNI_PATH", os.Getenv("PATH"))
+	os.Setenv("CNI_NETNS", cniNetns)
+	os.Setenv("CNI_IFNAME", cniIfname)
+	defer envCleanup()
+
+	return f()
+}
+
 func CmdDelWithResult(cniNetns, cniIfname string, f func() error) error {
 	os.Setenv("CNI_COMMAND", "DEL")
+	os.Setenv("CNI_CONTAINERID", ContainerID)
 	os.Setenv("CNI_PATH", os.Getenv("PATH"))
 	os.Setenv("CNI_NETNS", cniNetns)
 	os.Setenv("CNI_IFNAME", cniIfname)
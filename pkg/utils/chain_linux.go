@@ -0,0 +1,177 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	shellwords "github.com/mattn/go-shellwords"
+)
+
+// Chain is an iptables chain owned by a plugin, together with the rules
+// in other chains that jump to it.
+type Chain struct {
+	Table       string
+	Name        string
+	EntryChains []string // the chains to add the entry rule
+
+	EntryRules [][]string // the rules that "point" to this chain
+	Rules      [][]string // the rules this chain contains
+}
+
+// Setup idempotently creates the chain. It will not error if the chain exists.
+func (c *Chain) Setup(ipt *iptables.IPTables) error {
+	// create the chain
+	exists, err := ChainExists(ipt, c.Table, c.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := ipt.NewChain(c.Table, c.Name); err != nil {
+			return err
+		}
+	}
+
+	// Add the rules to the chain
+	for i := len(c.Rules) - 1; i >= 0; i-- {
+		if err := PrependUnique(ipt, c.Table, c.Name, c.Rules[i]); err != nil {
+			return err
+		}
+	}
+
+	// Add the entry rules to the entry chains
+	for _, entryChain := range c.EntryChains {
+		for i := len(c.EntryRules) - 1; i >= 0; i-- {
+			r := []string{}
+			r = append(r, c.EntryRules[i]...)
+			r = append(r, "-j", c.Name)
+			if err := PrependUnique(ipt, c.Table, entryChain, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Teardown idempotently deletes a chain. It will not error if the chain doesn't exist.
+// It will first delete all references to this chain in the EntryChains.
+func (c *Chain) Teardown(ipt *iptables.IPTables) error {
+	// flush the chain
+	// This will succeed *and create the chain* if it does not exist.
+	// If the chain doesn't exist, the next checks will fail.
+	if err := ipt.ClearChain(c.Table, c.Name); err != nil {
+		return err
+	}
+
+	for _, entryChain := range c.EntryChains {
+		entryChainRules, err := ipt.List(c.Table, entryChain)
+		if err != nil {
+			// Swallow error here - probably the chain doesn't exist.
+			// If we miss something the deletion will fail
+			continue
+		}
+
+		for _, entryChainRule := range entryChainRules[1:] {
+			if strings.HasSuffix(entryChainRule, "-j "+c.Name) {
+				chainParts, err := shellwords.Parse(entryChainRule)
+				if err != nil {
+					return fmt.Errorf("error parsing iptables rule: %s: %v", entryChainRule, err)
+				}
+				chainParts = chainParts[2:] // List results always include an -A CHAINNAME
+
+				if err := ipt.Delete(c.Table, entryChain, chainParts...); err != nil {
+					return fmt.Errorf("Failed to delete referring rule %s %s: %v", c.Table, entryChainRule, err)
+				}
+			}
+		}
+	}
+
+	if err := ipt.DeleteChain(c.Table, c.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Check verifies that the chain exists, that it contains all of its rules,
+// and that every entry chain still jumps to it.
+func (c *Chain) Check(ipt *iptables.IPTables) error {
+	resource := fmt.Sprintf("chain %q", c.Name)
+
+	exists, err := ChainExists(ipt, c.Table, c.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NewCheckError(resource, "chain %s not found in table %s", c.Name, c.Table)
+	}
+
+	for _, rule := range c.Rules {
+		exists, err := ipt.Exists(c.Table, c.Name, rule...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return NewCheckError(resource, "rule %q missing from chain %s", strings.Join(rule, " "), c.Name)
+		}
+	}
+
+	for _, entryChain := range c.EntryChains {
+		for _, entryRule := range c.EntryRules {
+			r := []string{}
+			r = append(r, entryRule...)
+			r = append(r, "-j", c.Name)
+			exists, err := ipt.Exists(c.Table, entryChain, r...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return NewCheckError(resource, "entry rule %q missing from chain %s", strings.Join(r, " "), entryChain)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PrependUnique will prepend a rule to a chain, if it does not already exist
+func PrependUnique(ipt *iptables.IPTables, table, chain string, rule []string) error {
+	exists, err := ipt.Exists(table, chain, rule...)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	return ipt.Insert(table, chain, 1, rule...)
+}
+
+// ChainExists reports whether the chain exists in the table.
+func ChainExists(ipt *iptables.IPTables, tableName, chainName string) (bool, error) {
+	chains, err := ipt.ListChains(tableName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ch := range chains {
+		if ch == chainName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
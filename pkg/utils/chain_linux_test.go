@@ -12,14 +12,16 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package utils_test
 
 import (
 	"fmt"
 	"math/rand"
 	"runtime"
 
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/coreos/go-iptables/iptables"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -29,7 +31,7 @@ const TABLE = "filter" // We'll monkey around here
 
 // TODO: run these tests in a new namespace
 var _ = Describe("chain tests", func() {
-	var testChain chain
+	var testChain utils.Chain
 	var ipt *iptables.IPTables
 	var cleanup func()
 
@@ -46,12 +48,12 @@ var _ = Describe("chain tests", func() {
 		tlChainName := fmt.Sprintf("cni-test-%d", rand.Intn(10000000))
 		chainName := fmt.Sprintf("cni-test-%d", rand.Intn(10000000))
 
-		testChain = chain{
-			table:       TABLE,
-			name:        chainName,
-			entryChains: []string{tlChainName},
-			entryRules:  [][]string{{"-d", "203.0.113.1"}},
-			rules: [][]string{
+		testChain = utils.Chain{
+			Table:       TABLE,
+			Name:        chainName,
+			EntryChains: []string{tlChainName},
+			EntryRules:  [][]string{{"-d", "203.0.113.1"}},
+			Rules: [][]string{
 				{"-m", "comment", "--comment", "test 1", "-j", "RETURN"},
 				{"-m", "comment", "--comment", "test 2", "-j", "RETURN"},
 			},
@@ -74,9 +76,9 @@ var _ = Describe("chain tests", func() {
 			if ipt == nil {
 				return
 			}
-			ipt.ClearChain(TABLE, testChain.name)
+			ipt.ClearChain(TABLE, testChain.Name)
 			ipt.ClearChain(TABLE, tlChainName)
-			ipt.DeleteChain(TABLE, testChain.name)
+			ipt.DeleteChain(TABLE, testChain.Name)
 			ipt.DeleteChain(TABLE, tlChainName)
 			currNs.Set()
 		}
@@ -86,7 +88,7 @@ var _ = Describe("chain tests", func() {
 	It("creates and destroys a chain", func() {
 		defer cleanup()
 
-		tlChainName := testChain.entryChains[0]
+		tlChainName := testChain.EntryChains[0]
 
 		// add an extra rule to the test chain to make sure it's not touched
 		err := ipt.Append(TABLE, tlChainName, "-m", "comment", "--comment",
@@ -94,7 +96,7 @@ var _ = Describe("chain tests", func() {
 		Expect(err).NotTo(HaveOccurred())
 
 		// Create the chain
-		err = testChain.setup(ipt)
+		err = testChain.Setup(ipt)
 		Expect(err).NotTo(HaveOccurred())
 
 		// Verify the chain exists
@@ -102,7 +104,7 @@ var _ = Describe("chain tests", func() {
 		chains, err := ipt.ListChains(TABLE)
 		Expect(err).NotTo(HaveOccurred())
 		for _, chain := range chains {
-			if chain == testChain.name {
+			if chain == testChain.Name {
 				ok = true
 				break
 			}
@@ -116,20 +118,20 @@ var _ = Describe("chain tests", func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(haveRules).To(Equal([]string{
 			"-N " + tlChainName,
-			"-A " + tlChainName + " -d 203.0.113.1/32 -j " + testChain.name,
+			"-A " + tlChainName + " -d 203.0.113.1/32 -j " + testChain.Name,
 			"-A " + tlChainName + ` -m comment --comment "canary value" -j ACCEPT`,
 		}))
 
 		// Check that the chain and rule was created
-		haveRules, err = ipt.List(TABLE, testChain.name)
+		haveRules, err = ipt.List(TABLE, testChain.Name)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(haveRules).To(Equal([]string{
-			"-N " + testChain.name,
-			"-A " + testChain.name + ` -m comment --comment "test 1" -j RETURN`,
-			"-A " + testChain.name + ` -m comment --comment "test 2" -j RETURN`,
+			"-N " + testChain.Name,
+			"-A " + testChain.Name + ` -m comment --comment "test 1" -j RETURN`,
+			"-A " + testChain.Name + ` -m comment --comment "test 2" -j RETURN`,
 		}))
 
-		err = testChain.teardown(ipt)
+		err = testChain.Teardown(ipt)
 		Expect(err).NotTo(HaveOccurred())
 
 		tlRules, err := ipt.List(TABLE, tlChainName)
@@ -142,7 +144,7 @@ var _ = Describe("chain tests", func() {
 		chains, err = ipt.ListChains(TABLE)
 		Expect(err).NotTo(HaveOccurred())
 		for _, chain := range chains {
-			if chain == testChain.name {
+			if chain == testChain.Name {
 				Fail("chain was not deleted")
 			}
 		}
@@ -151,16 +153,16 @@ var _ = Describe("chain tests", func() {
 	It("creates chains idempotently", func() {
 		defer cleanup()
 
-		err := testChain.setup(ipt)
+		err := testChain.Setup(ipt)
 		Expect(err).NotTo(HaveOccurred())
 
 		// Create it again!
-		err = testChain.setup(ipt)
+		err = testChain.Setup(ipt)
 		Expect(err).NotTo(HaveOccurred())
 
 		// Make sure there are only two rules
 		// (the first rule is an -N because go-iptables
-		rules, err := ipt.List(TABLE, testChain.name)
+		rules, err := ipt.List(TABLE, testChain.Name)
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(len(rules)).To(Equal(3))
@@ -170,26 +172,50 @@ var _ = Describe("chain tests", func() {
 	It("deletes chains idempotently", func() {
 		defer cleanup()
 
-		err := testChain.setup(ipt)
+		err := testChain.Setup(ipt)
 		Expect(err).NotTo(HaveOccurred())
 
-		err = testChain.teardown(ipt)
+		err = testChain.Teardown(ipt)
 		Expect(err).NotTo(HaveOccurred())
 
 		chains, err := ipt.ListChains(TABLE)
 		for _, chain := range chains {
-			if chain == testChain.name {
+			if chain == testChain.Name {
 				Fail("Chain was not deleted")
 			}
 		}
 
-		err = testChain.teardown(ipt)
+		err = testChain.Teardown(ipt)
 		Expect(err).NotTo(HaveOccurred())
 		chains, err = ipt.ListChains(TABLE)
 		for _, chain := range chains {
-			if chain == testChain.name {
+			if chain == testChain.Name {
 				Fail("Chain was not deleted")
 			}
 		}
 	})
+
+	It("checks chains", func() {
+		defer cleanup()
+
+		err := testChain.Setup(ipt)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testChain.Check(ipt)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Remove a rule behind the chain's back
+		err = ipt.Delete(TABLE, testChain.Name, testChain.Rules[1]...)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testChain.Check(ipt)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf("chain %q", testChain.Name)))
+
+		err = testChain.Teardown(ipt)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testChain.Check(ipt)
+		Expect(err).To(HaveOccurred())
+	})
 })
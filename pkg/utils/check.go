@@ -0,0 +1,37 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// ErrCheckFailed is the plugin-specific error code returned by CHECK when
+// something set up by ADD is missing or no longer matches its configuration.
+// Codes below 100 are reserved by the CNI spec.
+const ErrCheckFailed uint = 101
+
+// NewCheckError returns a CHECK failure for the named resource, e.g.
+// `interface "eth0"` or `chain "CNI-DN-1234"`. The resource is reported in
+// the error details so that runtimes can tell what drifted.
+func NewCheckError(resource string, format string, args ...interface{}) error {
+	return &types.Error{
+		Code:    ErrCheckFailed,
+		Msg:     fmt.Sprintf(format, args...),
+		Details: resource,
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// ContainerIPs returns the addresses of the previous result that belong to
+// the container interface ifName. Addresses of known non-sandbox
+// interfaces are skipped; addresses without an interface are kept.
+func ContainerIPs(result *current.Result, ifName string) []net.IP {
+	var ips []net.IP
+	for _, ip := range result.IPs {
+		// Skip known non-sandbox interfaces
+		if ip.Interface != nil {
+			intIdx := *ip.Interface
+			if intIdx >= 0 &&
+				intIdx < len(result.Interfaces) &&
+				(result.Interfaces[intIdx].Name != ifName ||
+					result.Interfaces[intIdx].Sandbox == "") {
+				continue
+			}
+		}
+		ips = append(ips, ip.Address.IP)
+	}
+	return ips
+}
+
+// HostCIDR returns the single-address CIDR of ip, for use as an iptables
+// address match.
+func HostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return (&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}).String()
+}
+
+// SplitByFamily groups the IPs by the iptables protocol they need.
+func SplitByFamily(ips []net.IP) map[iptables.Protocol][]net.IP {
+	families := map[iptables.Protocol][]net.IP{}
+	for _, ip := range ips {
+		proto := iptables.ProtocolIPv4
+		if ip.To4() == nil {
+			proto = iptables.ProtocolIPv6
+		}
+		families[proto] = append(families[proto], ip)
+	}
+	return families
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("container IPs", func() {
+	ipConfig := func(ip string, intf *int) *current.IPConfig {
+		addr := net.ParseIP(ip)
+		return &current.IPConfig{Interface: intf, Address: net.IPNet{IP: addr, Mask: net.CIDRMask(24, 8*len(addr))}}
+	}
+
+	It("returns the addresses of the container interface", func() {
+		result := &current.Result{
+			Interfaces: []*current.Interface{
+				{Name: "cni0"},
+				{Name: "eth0", Sandbox: "/var/run/netns/test"},
+				{Name: "eth1", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{
+				ipConfig("10.0.0.1", current.Int(0)),
+				ipConfig("10.0.0.2", current.Int(1)),
+				ipConfig("10.1.0.2", current.Int(2)),
+				ipConfig("2001:db8::2", nil),
+			},
+		}
+
+		Expect(ContainerIPs(result, "eth0")).To(Equal([]net.IP{
+			net.ParseIP("10.0.0.2"),
+			net.ParseIP("2001:db8::2"),
+		}))
+	})
+
+	It("formats a host CIDR", func() {
+		Expect(HostCIDR(net.ParseIP("10.0.0.2"))).To(Equal("10.0.0.2/32"))
+		Expect(HostCIDR(net.ParseIP("2001:db8::2"))).To(Equal("2001:db8::2/128"))
+	})
+
+	It("splits the addresses by family", func() {
+		families := SplitByFamily([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2"), net.ParseIP("10.0.0.3")})
+		Expect(families).To(Equal(map[iptables.Protocol][]net.IP{
+			iptables.ProtocolIPv4: {net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")},
+			iptables.ProtocolIPv6: {net.ParseIP("2001:db8::2")},
+		}))
+	})
+})
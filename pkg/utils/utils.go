@@ -29,8 +29,15 @@ const (
 // Ensures that the generated chain name is exactly
 // maxChainLength chars in length
 func FormatChainName(name string, id string) string {
+	return FormatChainNameWithPrefix(name, id, "")
+}
+
+// FormatChainNameWithPrefix generates a chain name like FormatChainName,
+// with prefix following "CNI-" so that chains created by different
+// plugins for the same container can be told apart.
+func FormatChainNameWithPrefix(name string, id string, prefix string) string {
 	chainBytes := sha512.Sum512([]byte(name + id))
-	chain := fmt.Sprintf("%s%x", chainPrefix, chainBytes)
+	chain := fmt.Sprintf("%s%s%x", chainPrefix, prefix, chainBytes)
 	return chain[:maxChainLength]
 }
 
@@ -48,4 +48,10 @@ var _ = Describe("Utils", func() {
 		Expect(chain1).To(Equal("CNI-374f33fe84ab0ed84dcdebe3"))
 		Expect(chain1).NotTo(Equal(chain2))
 	})
+
+	It("must insert the prefix", func() {
+		chain := FormatChainNameWithPrefix("test", "1234", "FW-")
+		Expect(len(chain)).To(Equal(maxChainLength))
+		Expect(chain).To(Equal("CNI-FW-2bbe0c48b91a7d1b8a675"))
+	})
 })
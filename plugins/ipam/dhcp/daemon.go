@@ -29,7 +29,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/coreos/go-systemd/activation"
 )
 
@@ -41,12 +41,14 @@ var errNoMoreTries = errors.New("no more tries")
 type DHCP struct {
 	mux             sync.Mutex
 	leases          map[string]*DHCPLease
+	servers         map[string]*DHCPServer
 	hostNetnsPrefix string
 }
 
 func newDHCP() *DHCP {
 	return &DHCP{
-		leases: make(map[string]*DHCPLease),
+		leases:  make(map[string]*DHCPLease),
+		servers: make(map[string]*DHCPServer),
 	}
 }
 
@@ -83,6 +85,36 @@ func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
 	return nil
 }
 
+// Serve starts a DHCP server on the container interface, or on the bridge
+// it is attached to, which hands out the address of the IPAM result. The
+// server runs until Release() is called.
+func (d *DHCP) Serve(sa *ServeArgs, reply *struct{}) error {
+	args := sa.Args
+	conf, err := loadServerConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.IPAM.Server == nil {
+		return fmt.Errorf("network %q is not in server mode", conf.Name)
+	}
+
+	// A server left over from a previous ADD would answer as well
+	if s := d.getServer(args.ContainerID, conf.Name); s != nil {
+		s.Stop()
+		d.clearServer(args.ContainerID, conf.Name)
+	}
+
+	clientID := args.ContainerID + "/" + conf.Name
+	hostNetns := d.hostNetnsPrefix + args.Netns
+	s, err := StartServer(clientID, hostNetns, args.IfName, conf, sa.Result)
+	if err != nil {
+		return err
+	}
+
+	d.setServer(args.ContainerID, conf.Name, s)
+	return nil
+}
+
 // Release stops maintenance of the lease acquired in Allocate()
 // and sends a release msg to the DHCP server.
 func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
@@ -95,7 +127,24 @@ func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
 		l.Stop()
 		d.clearLease(args.ContainerID, conf.Name)
 	}
+	if s := d.getServer(args.ContainerID, conf.Name); s != nil {
+		s.Stop()
+		d.clearServer(args.ContainerID, conf.Name)
+	}
+
+	return nil
+}
+
+// Check reports whether a lease is still being maintained, or a server
+// is still running, for the specified container.
+func (d *DHCP) Check(args *skel.CmdArgs, found *bool) error {
+	conf := types.NetConf{}
+	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("error parsing netconf: %v", err)
+	}
 
+	*found = d.getLease(args.ContainerID, conf.Name) != nil ||
+		d.getServer(args.ContainerID, conf.Name) != nil
 	return nil
 }
 
@@ -127,6 +176,27 @@ func (d *DHCP) clearLease(contID, netName string) {
 	delete(d.leases, contID+netName)
 }
 
+func (d *DHCP) getServer(contID, netName string) *DHCPServer {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return d.servers[contID+netName]
+}
+
+func (d *DHCP) setServer(contID, netName string, s *DHCPServer) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.servers[contID+netName] = s
+}
+
+func (d *DHCP) clearServer(contID, netName string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	delete(d.servers, contID+netName)
+}
+
 func getListener() (net.Listener, error) {
 	l, err := activation.Listeners(true)
 	if err != nil {
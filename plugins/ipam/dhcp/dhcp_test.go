@@ -15,15 +15,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 
@@ -97,6 +103,7 @@ const (
 	hostVethName string = "dhcp0"
 	contVethName string = "eth0"
 	pidfilePath  string = "/var/run/cni/dhcp-client.pid"
+	bridgeName   string = "br0"
 )
 
 var _ = BeforeSuite(func() {
@@ -317,3 +324,262 @@ var _ = Describe("DHCP Operations", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 })
+
+var _ = Describe("DHCP server mode", func() {
+	var hostNS, vmNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		vmNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		// The server runs on the "container" side, the client on the "VM"
+		// side. The container end of the veth stands in for a tap, and is
+		// attached to a bridge.
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}})
+			Expect(err).NotTo(HaveOccurred())
+			br, err := netlink.LinkByName(bridgeName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(br)).To(Succeed())
+
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: hostVethName},
+				PeerName:  contVethName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			host, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMaster(host, br.(*netlink.Bridge))).To(Succeed())
+			Expect(netlink.LinkSetUp(host)).To(Succeed())
+
+			cont, err := netlink.LinkByName(contVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(cont, int(vmNS.Fd()))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = vmNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(contVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(vmNS.Close()).To(Succeed())
+	})
+
+	It("hands out the IPAM address with its routes", func() {
+		conf, err := loadServerConf([]byte(`{
+	"name": "test",
+	"ipam": {
+		"type": "dhcp",
+		"server": {
+			"ipam": {"type": "host-local"},
+			"leaseTime": "5m"
+		}
+	}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		result := &current.Result{
+			IPs: []*current.IPConfig{{
+				Version: "4",
+				Address: net.IPNet{IP: net.IPv4(10, 1, 2, 3).To4(), Mask: net.CIDRMask(24, 32)},
+				Gateway: net.IPv4(10, 1, 2, 1),
+			}},
+			Routes: []*types.Route{{
+				Dst: net.IPNet{IP: net.IPv4(192, 168, 1, 0).To4(), Mask: net.CIDRMask(24, 32)},
+				GW:  net.IPv4(10, 1, 2, 254),
+			}},
+		}
+
+		s, err := StartServer("dummy/test", hostNS.Path(), hostVethName, conf, result)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Stop()
+
+		l, err := AcquireLease("dummy/test", vmNS.Path(), contVethName)
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Stop()
+
+		ipn, err := l.IPNet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipn.String()).To(Equal("10.1.2.3/24"))
+		Expect(l.Gateway().String()).To(Equal("10.1.2.1"))
+
+		var routes []string
+		for _, r := range l.Routes() {
+			routes = append(routes, r.Dst.String()+" via "+r.GW.String())
+		}
+		Expect(routes).To(ConsistOf("192.168.1.0/24 via 10.1.2.254", "0.0.0.0/0 via 10.1.2.1"))
+	})
+
+	It("serves the address of the IPAM plugin with ADD/CHECK/DEL", func() {
+		dataDir, err := ioutil.TempDir("", "dhcp_test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		// The IPAM plugin of the server mode is found in the PATH
+		cniPath := os.Getenv("CNI_PATH")
+		os.Setenv("CNI_PATH", os.Getenv("PATH"))
+		defer os.Setenv("CNI_PATH", cniPath)
+
+		os.MkdirAll(pidfilePath, 0755)
+		dhcpPluginPath, err := exec.LookPath("dhcp")
+		Expect(err).NotTo(HaveOccurred())
+		clientCmd := exec.Command(dhcpPluginPath, "daemon")
+		Expect(clientCmd.Start()).To(Succeed())
+		defer func() {
+			clientCmd.Process.Kill()
+			clientCmd.Wait()
+			os.Remove(socketPath)
+			os.Remove(pidfilePath)
+		}()
+		Eventually(func() bool {
+			_, err := os.Stat(socketPath)
+			return err == nil
+		}, time.Second*15, time.Second/4).Should(BeTrue())
+
+		conf := fmt.Sprintf(`{
+    "cniVersion": "0.4.0",
+    "name": "test",
+    "type": "tap",
+    "vmAddresses": true,
+    "ipam": {
+        "type": "dhcp",
+        "server": {
+            "ipam": {
+                "type": "host-local",
+                "subnet": "10.1.2.0/24",
+                "routes": [{"dst": "192.168.1.0/24", "gw": "10.1.2.254"}],
+                "dataDir": "%s"
+            },
+            "leaseTime": "5m"
+        }
+    }
+}`, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       hostNS.Path(),
+			IfName:      hostVethName,
+			StdinData:   []byte(conf),
+		}
+
+		r, raw, err := testutils.CmdAddWithResult(hostNS.Path(), hostVethName, []byte(conf), func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := current.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(1))
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.2/24"))
+
+		// The VM gets the address from the server on the bridge
+		l, err := AcquireLease("dummy/vm", vmNS.Path(), contVethName)
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Stop()
+		ipn, err := l.IPNet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipn.String()).To(Equal("10.1.2.2/24"))
+		Expect(l.Gateway().String()).To(Equal("10.1.2.1"))
+		var routes []string
+		for _, r := range l.Routes() {
+			routes = append(routes, r.Dst.String()+" via "+r.GW.String())
+		}
+		Expect(routes).To(ConsistOf("192.168.1.0/24 via 10.1.2.254", "0.0.0.0/0 via 10.1.2.1"))
+
+		checkConf := make(map[string]interface{})
+		Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+		checkConf["prevResult"] = json.RawMessage(raw)
+		checkArgs := *args
+		checkArgs.StdinData, err = json.Marshal(checkConf)
+		Expect(err).NotTo(HaveOccurred())
+		err = testutils.CmdCheckWithResult(hostNS.Path(), hostVethName, func() error {
+			return cmdCheck(&checkArgs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(hostNS.Path(), hostVethName, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// The server is gone, and so is the allocation
+		err = testutils.CmdCheckWithResult(hostNS.Path(), hostVethName, func() error {
+			return cmdCheck(&checkArgs)
+		})
+		Expect(err).To(HaveOccurred())
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, "test"))
+		Expect(err).NotTo(HaveOccurred())
+		for _, f := range files {
+			Expect(f.Name()).NotTo(Equal("10.1.2.2"))
+		}
+	})
+
+	It("releases the address of the IPAM plugin with DEL if the daemon is gone", func() {
+		dataDir, err := ioutil.TempDir("", "dhcp_test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		cniPath := os.Getenv("CNI_PATH")
+		os.Setenv("CNI_PATH", os.Getenv("PATH"))
+		defer os.Setenv("CNI_PATH", cniPath)
+		os.Remove(socketPath)
+
+		conf := fmt.Sprintf(`{
+    "cniVersion": "0.4.0",
+    "name": "test",
+    "type": "tap",
+    "vmAddresses": true,
+    "ipam": {
+        "type": "dhcp",
+        "server": {
+            "ipam": {
+                "type": "host-local",
+                "subnet": "10.1.2.0/24",
+                "dataDir": "%s"
+            }
+        }
+    }
+}`, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       hostNS.Path(),
+			IfName:      hostVethName,
+			StdinData:   []byte(conf),
+		}
+
+		// An address allocated by an ADD whose server is gone since
+		n, err := loadServerConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		ipamType, netconf, err := delegateNetConf([]byte(conf), n.IPAM.Server.IPAM)
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_CONTAINERID", args.ContainerID)
+		os.Setenv("CNI_NETNS", args.Netns)
+		os.Setenv("CNI_IFNAME", args.IfName)
+		_, err = invoke.DelegateAdd(context.TODO(), ipamType, netconf, nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = os.Stat(filepath.Join(dataDir, "test", "10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(hostNS.Path(), hostVethName, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).To(MatchError(ContainSubstring("error dialing DHCP daemon")))
+		_, err = os.Stat(filepath.Join(dataDir, "test", "10.1.2.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
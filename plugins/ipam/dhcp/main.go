@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -22,10 +23,12 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
 )
 
 const socketPath = "/run/cni/dhcp.sock"
@@ -40,11 +43,11 @@ func main() {
 		daemonFlags.Parse(os.Args[2:])
 
 		if err := runDaemon(pidfilePath, hostPrefix); err != nil {
-			log.Printf(err.Error())
+			log.Print(err.Error())
 			os.Exit(1)
 		}
 	} else {
-		skel.PluginMain(cmdAdd, cmdDel, version.All)
+		skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI dhcp plugin")
 	}
 }
 
@@ -56,6 +59,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	conf, err := loadServerConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.IPAM.Server != nil {
+		return cmdAddServer(args, conf.IPAM.Server, confVersion)
+	}
+
 	result := &current.Result{}
 	if err := rpcCall("DHCP.Allocate", args, result); err != nil {
 		return err
@@ -64,29 +75,117 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return types.PrintResult(result, confVersion)
 }
 
+// cmdAddServer allocates the address with the IPAM plugin of the server
+// mode, and has the daemon hand it out on the container interface.
+func cmdAddServer(args *skel.CmdArgs, sc *ServerConf, confVersion string) error {
+	ipamType, netconf, err := delegateNetConf(args.StdinData, sc.IPAM)
+	if err != nil {
+		return err
+	}
+
+	r, err := invoke.DelegateAdd(context.TODO(), ipamType, netconf, nil)
+	if err != nil {
+		return err
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		invoke.DelegateDel(context.TODO(), ipamType, netconf, nil)
+		return err
+	}
+
+	if err := absNetns(args); err != nil {
+		invoke.DelegateDel(context.TODO(), ipamType, netconf, nil)
+		return err
+	}
+	sa := &ServeArgs{Args: args, Result: result}
+	if err := daemonCall("DHCP.Serve", sa, &struct{}{}); err != nil {
+		invoke.DelegateDel(context.TODO(), ipamType, netconf, nil)
+		return err
+	}
+
+	return types.PrintResult(result, confVersion)
+}
+
 func cmdDel(args *skel.CmdArgs) error {
+	conf, err := loadServerConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
 	result := struct{}{}
-	if err := rpcCall("DHCP.Release", args, &result); err != nil {
+	if conf.IPAM.Server == nil {
+		if err := rpcCall("DHCP.Release", args, &result); err != nil {
+			return fmt.Errorf("error dialing DHCP daemon: %v", err)
+		}
+		return nil
+	}
+
+	// The address is released even if the daemon is gone, so that it
+	// does not leak; the first error is returned
+	ipamType, netconf, err := delegateNetConf(args.StdinData, conf.IPAM.Server.IPAM)
+	if err != nil {
+		return err
+	}
+	delErr := invoke.DelegateDel(context.TODO(), ipamType, netconf, nil)
+	if err := rpcCall("DHCP.Release", args, &result); err != nil && delErr == nil {
 		return fmt.Errorf("error dialing DHCP daemon: %v", err)
 	}
+	return delErr
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadServerConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	if err := rpcCall("DHCP.Check", args, &found); err != nil {
+		return err
+	}
+
+	if conf.IPAM.Server != nil {
+		if !found {
+			return utils.NewCheckError(fmt.Sprintf("server %q", args.ContainerID), "no DHCP server running for container %q", args.ContainerID)
+		}
+		ipamType, netconf, err := delegateNetConf(args.StdinData, conf.IPAM.Server.IPAM)
+		if err != nil {
+			return err
+		}
+		return invoke.DelegateCheck(context.TODO(), ipamType, netconf, nil)
+	}
+
+	if !found {
+		return utils.NewCheckError(fmt.Sprintf("lease %q", args.ContainerID), "no DHCP lease held for container %q", args.ContainerID)
+	}
 	return nil
 }
 
 func rpcCall(method string, args *skel.CmdArgs, result interface{}) error {
-	client, err := rpc.DialHTTP("unix", socketPath)
-	if err != nil {
-		return fmt.Errorf("error dialing DHCP daemon: %v", err)
+	if err := absNetns(args); err != nil {
+		return err
 	}
+	return daemonCall(method, args, result)
+}
 
-	// The daemon may be running under a different working dir
-	// so make sure the netns path is absolute.
+// absNetns makes the netns path of the arguments absolute, since the
+// daemon may be running under a different working dir.
+func absNetns(args *skel.CmdArgs) error {
 	netns, err := filepath.Abs(args.Netns)
 	if err != nil {
 		return fmt.Errorf("failed to make %q an absolute path: %v", args.Netns, err)
 	}
 	args.Netns = netns
+	return nil
+}
+
+func daemonCall(method string, params interface{}, result interface{}) error {
+	client, err := rpc.DialHTTP("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
 
-	err = client.Call(method, args, result)
+	err = client.Call(method, params, result)
 	if err != nil {
 		return fmt.Errorf("error calling %v: %v", method, err)
 	}
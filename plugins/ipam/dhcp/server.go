@@ -0,0 +1,408 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/d2g/dhcp4"
+	"github.com/d2g/dhcp4server"
+	"github.com/d2g/dhcp4server/leasepool"
+	"github.com/d2g/dhcp4server/leasepool/memorypool"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const defaultServerLeaseTime = time.Hour
+
+// ServerConf configures the server mode, under "server" in the ipam
+// section of the network configuration. The address is allocated by the
+// IPAM plugin configured in it, and handed out by the daemon.
+type ServerConf struct {
+	IPAM      map[string]interface{} `json:"ipam"`
+	ServerIP  net.IP                 `json:"serverIP,omitempty"`
+	LeaseTime string                 `json:"leaseTime,omitempty"`
+}
+
+type serverNetConf struct {
+	types.NetConf
+	IPAM struct {
+		Server *ServerConf `json:"server,omitempty"`
+	} `json:"ipam"`
+}
+
+// loadServerConf parses the network configuration. The server conf is nil
+// unless the plugin is in server mode.
+func loadServerConf(bytes []byte) (*serverNetConf, error) {
+	conf := &serverNetConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("error parsing netconf: %v", err)
+	}
+
+	sc := conf.IPAM.Server
+	if sc == nil {
+		return conf, nil
+	}
+	if t, _ := sc.IPAM["type"].(string); t == "" {
+		return nil, fmt.Errorf("server mode requires an ipam plugin to allocate addresses")
+	}
+	if sc.ServerIP != nil && sc.ServerIP.To4() == nil {
+		return nil, fmt.Errorf("serverIP %s is not an IPv4 address", sc.ServerIP)
+	}
+	if sc.LeaseTime != "" {
+		if d, err := time.ParseDuration(sc.LeaseTime); err != nil || d < time.Minute {
+			return nil, fmt.Errorf("invalid leaseTime %q", sc.LeaseTime)
+		}
+	}
+	return conf, nil
+}
+
+// delegateNetConf returns the type of the IPAM plugin of the server mode,
+// and the network configuration to call it with.
+func delegateNetConf(bytes []byte, ipam map[string]interface{}) (string, []byte, error) {
+	netconf := map[string]interface{}{}
+	if err := json.Unmarshal(bytes, &netconf); err != nil {
+		return "", nil, fmt.Errorf("error parsing netconf: %v", err)
+	}
+	netconf["ipam"] = ipam
+
+	data, err := json.Marshal(netconf)
+	if err != nil {
+		return "", nil, fmt.Errorf("error serializing delegate netconf: %v", err)
+	}
+	return ipam["type"].(string), data, nil
+}
+
+// ServeArgs are the arguments of DHCP.Serve: the container, and the result
+// of the IPAM plugin to hand out on its interface.
+type ServeArgs struct {
+	Args   *skel.CmdArgs
+	Result *current.Result
+}
+
+// DHCPServer answers the DHCP requests on a container interface, such as
+// a bridge or tap that a VM is attached to, with the address the IPAM
+// plugin allocated for the container. The lease pool holds that address
+// only, so the first client gets it.
+type DHCPServer struct {
+	clientID string
+	server   *dhcp4server.Server
+	options  []dhcp4.Option
+	conn     net.PacketConn
+	stopping uint32
+	wg       sync.WaitGroup
+}
+
+// StartServer starts answering requests on the interface in the
+// background. The server can be stopped by calling DHCPServer.Stop().
+func StartServer(clientID, netns, ifName string, conf *serverNetConf, result *current.Result) (*DHCPServer, error) {
+	var ipc *current.IPConfig
+	for _, c := range result.IPs {
+		if c.Address.IP.To4() != nil {
+			ipc = c
+			break
+		}
+	}
+	if ipc == nil {
+		return nil, fmt.Errorf("the IPAM result has no IPv4 address to hand out")
+	}
+
+	sc := conf.IPAM.Server
+	serverIP := sc.ServerIP
+	if serverIP == nil {
+		serverIP = ipc.Gateway
+	}
+	if serverIP == nil {
+		return nil, fmt.Errorf("serverIP must be specified if the IPAM result has no gateway")
+	}
+	leaseTime := defaultServerLeaseTime
+	if sc.LeaseTime != "" {
+		leaseTime, _ = time.ParseDuration(sc.LeaseTime)
+	}
+
+	pool := &memorypool.MemoryPool{}
+	if err := pool.AddLease(leasepool.Lease{IP: ipc.Address.IP.To4()}); err != nil {
+		return nil, err
+	}
+	server, err := dhcp4server.New(serverIP.To4(), pool, dhcp4server.LeaseDuration(leaseTime))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DHCP server: %v", err)
+	}
+
+	// The IPAM result may leave DNS to the network configuration
+	dns := result.DNS
+	if len(dns.Nameservers) == 0 && dns.Domain == "" {
+		dns = conf.DNS
+	}
+
+	conn, serverIface, err := listenServer(netns, ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %v", ifName, err)
+	}
+
+	s := &DHCPServer{
+		clientID: clientID,
+		server:   server,
+		options:  serverOptions(ipc, result.Routes, dns),
+		conn:     conn,
+	}
+	log.Printf("%v: serving %v on %q", clientID, ipc.Address.IP, serverIface)
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// listenServer opens the server socket in the container namespace. It is
+// bound to the interface, so that only the requests on it are answered
+// and the broadcast replies leave through it. A tap attached to a bridge
+// hands the frames of the VM to the bridge, so the socket is bound to the
+// bridge instead, whose name is returned.
+func listenServer(netns, ifName string) (net.PacketConn, string, error) {
+	var conn net.PacketConn
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if master := link.Attrs().MasterIndex; master != 0 {
+			br, err := netlink.LinkByIndex(master)
+			if err != nil {
+				return fmt.Errorf("failed to lookup master of %q: %v", ifName, err)
+			}
+			ifName = br.Attrs().Name
+		}
+
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), "dhcp-server")
+		defer f.Close()
+
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return err
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+			return err
+		}
+		if err := syscall.BindToDevice(fd, ifName); err != nil {
+			return err
+		}
+		if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: 67}); err != nil {
+			return err
+		}
+
+		conn, err = net.FilePacketConn(f)
+		return err
+	})
+	return conn, ifName, err
+}
+
+// Stop closes the server socket and waits for the server to finish.
+func (s *DHCPServer) Stop() {
+	if atomic.CompareAndSwapUint32(&s.stopping, 0, 1) {
+		s.conn.Close()
+	}
+	s.wg.Wait()
+}
+
+func (s *DHCPServer) serve() {
+	defer s.wg.Done()
+
+	bcast := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadUint32(&s.stopping) == 0 {
+				log.Printf("%v: error reading DHCP request: %v", s.clientID, err)
+			}
+			return
+		}
+
+		req := dhcp4.Packet(append([]byte(nil), buf[:n]...))
+		if n < 240 || req.OpCode() != dhcp4.BootRequest || len(req.ParseOptions()[dhcp4.OptionDHCPMessageType]) != 1 {
+			continue
+		}
+
+		// Free the lease if it expired, so that another client can get it
+		if err := s.server.GC(); err != nil {
+			log.Printf("%v: error expiring lease: %v", s.clientID, err)
+		}
+
+		reply, err := s.reply(normalizeRequest(req))
+		if err != nil {
+			log.Printf("%v: error serving DHCP request: %v", s.clientID, err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err := s.conn.WriteTo(reply, bcast); err != nil {
+			log.Printf("%v: error sending DHCP reply: %v", s.clientID, err)
+		}
+	}
+}
+
+// normalizeRequest adds the requested IP address option to requests that
+// renew a lease. Such requests carry the address in ciaddr instead, but
+// the server NAKs a request without the option.
+func normalizeRequest(req dhcp4.Packet) dhcp4.Packet {
+	opts := req.ParseOptions()
+	if dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) != dhcp4.Request ||
+		opts[dhcp4.OptionRequestedIPAddress] != nil ||
+		req.CIAddr().Equal(net.IPv4zero) {
+		return req
+	}
+
+	opts[dhcp4.OptionRequestedIPAddress] = req.CIAddr().To4()
+	p := headerOf(req)
+	for _, code := range optionOrder(opts) {
+		p.AddOption(code, opts[code])
+	}
+	return p
+}
+
+// headerOf returns a packet with the header of p and no options. The
+// options parsed from p refer to its buffer, so they are added to a new
+// packet rather than to p itself.
+func headerOf(p dhcp4.Packet) dhcp4.Packet {
+	h := make(dhcp4.Packet, 241)
+	copy(h, p[:240])
+	h[240] = byte(dhcp4.End)
+	return h
+}
+
+// optionOrder returns the codes of the options in the order they are
+// sent: the message type first, then by code.
+func optionOrder(opts dhcp4.Options) []dhcp4.OptionCode {
+	var codes []dhcp4.OptionCode
+	for code := range opts {
+		if code != dhcp4.OptionDHCPMessageType {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	if _, ok := opts[dhcp4.OptionDHCPMessageType]; ok {
+		codes = append([]dhcp4.OptionCode{dhcp4.OptionDHCPMessageType}, codes...)
+	}
+	return codes
+}
+
+// reply returns the reply of the server to the request, if any. The
+// server decides on the reply and the lease, but only sends the mask,
+// router and DNS options, so they are replaced with ours.
+func (s *DHCPServer) reply(req dhcp4.Packet) (dhcp4.Packet, error) {
+	res, err := s.server.ServeDHCP(req)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+
+	opts := res.ParseOptions()
+	out := headerOf(res)
+	out.AddOption(dhcp4.OptionDHCPMessageType, opts[dhcp4.OptionDHCPMessageType])
+	out.AddOption(dhcp4.OptionServerIdentifier, opts[dhcp4.OptionServerIdentifier])
+	if dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) != dhcp4.NAK {
+		out.AddOption(dhcp4.OptionIPAddressLeaseTime, opts[dhcp4.OptionIPAddressLeaseTime])
+		for _, o := range s.options {
+			out.AddOption(o.Code, o.Value)
+		}
+	}
+	out.PadToMinSize()
+	return out, nil
+}
+
+// serverOptions returns the options sent with the address: the subnet
+// mask, router, DNS and classless routes.
+func serverOptions(ipc *current.IPConfig, routes []*types.Route, dns types.DNS) []dhcp4.Option {
+	mask := ipc.Address.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	opts := []dhcp4.Option{{Code: dhcp4.OptionSubnetMask, Value: []byte(mask)}}
+
+	gw := ipc.Gateway.To4()
+	if gw != nil {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionRouter, Value: []byte(gw)})
+	}
+
+	var nameservers []net.IP
+	for _, s := range dns.Nameservers {
+		if ip := net.ParseIP(s).To4(); ip != nil {
+			nameservers = append(nameservers, ip)
+		}
+	}
+	if len(nameservers) > 0 {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionDomainNameServer, Value: dhcp4.JoinIPs(nameservers)})
+	}
+	if dns.Domain != "" {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionDomainName, Value: []byte(dns.Domain)})
+	}
+
+	if len(routes) > 0 {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionClasslessRouteFormat, Value: classlessRoutes(routes, gw)})
+	}
+	return opts
+}
+
+// classlessRoutes encodes the IPv4 routes as in RFC 3442. Routes without a
+// gateway go through the router. Clients that support the option ignore
+// the router option, so the default route is added if it is missing.
+func classlessRoutes(routes []*types.Route, gw net.IP) []byte {
+	var b []byte
+	hasDefault := false
+	for _, r := range routes {
+		dst := r.Dst.IP.To4()
+		if dst == nil {
+			continue
+		}
+		ones, _ := r.Dst.Mask.Size()
+		if ones == 0 {
+			hasDefault = true
+		}
+
+		routeGW := r.GW.To4()
+		if routeGW == nil {
+			routeGW = gw
+		}
+		if routeGW == nil {
+			routeGW = net.IPv4zero.To4()
+		}
+
+		// Only the significant octets of the destination are sent
+		b = append(b, byte(ones))
+		b = append(b, dst[:(ones+7)/8]...)
+		b = append(b, routeGW...)
+	}
+	if !hasDefault && gw != nil {
+		b = append(b, 0)
+		b = append(b, gw...)
+	}
+	return b
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/d2g/dhcp4"
+	"github.com/d2g/dhcp4server"
+	"github.com/d2g/dhcp4server/leasepool"
+	"github.com/d2g/dhcp4server/leasepool/memorypool"
+)
+
+func TestClasslessRoutes(t *testing.T) {
+	routes := []*types.Route{
+		&types.Route{
+			Dst: net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+			GW:  net.IPv4(10, 1, 2, 3),
+		},
+		&types.Route{
+			Dst: net.IPNet{IP: net.IPv4(192, 168, 1, 0), Mask: net.CIDRMask(24, 32)},
+			GW:  net.IPv4(192, 168, 2, 3),
+		},
+	}
+
+	// Without a router, the routes are encoded as given
+	opts := make(dhcp4.Options)
+	opts[dhcp4.OptionClasslessRouteFormat] = classlessRoutes(routes, nil)
+	validateRoutes(t, parseCIDRRoutes(opts))
+
+	// With one, the default route is added
+	b := classlessRoutes(routes, net.IPv4(10, 1, 2, 1).To4())
+	expected := []byte{8, 10, 10, 1, 2, 3, 24, 192, 168, 1, 192, 168, 2, 3, 0, 10, 1, 2, 1}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("classless routes mismatch: expected %v, got %v", expected, b)
+	}
+}
+
+func TestNormalizeRequest(t *testing.T) {
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	xid := []byte{1, 2, 3, 4}
+
+	// A renewal carries the address in ciaddr only
+	options := []dhcp4.Option{
+		{Code: dhcp4.OptionHostName, Value: []byte("vm1")},
+		{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 121}},
+		{Code: dhcp4.OptionClientIdentifier, Value: []byte{1, 2, 0, 0, 0, 0, 1}},
+	}
+	req := dhcp4.RequestPacket(dhcp4.Request, mac, net.IPv4(10, 1, 2, 3), xid, false, options)
+	orig := append(dhcp4.Packet(nil), req...)
+	norm := normalizeRequest(req)
+	if !bytes.Equal(req, orig) {
+		t.Errorf("request was modified")
+	}
+	if !bytes.Equal(norm[:240], req[:240]) {
+		t.Errorf("header mismatch")
+	}
+
+	expected := map[dhcp4.OptionCode][]byte{
+		dhcp4.OptionDHCPMessageType:      {byte(dhcp4.Request)},
+		dhcp4.OptionRequestedIPAddress:   {10, 1, 2, 3},
+		dhcp4.OptionHostName:             []byte("vm1"),
+		dhcp4.OptionParameterRequestList: {1, 3, 6, 121},
+		dhcp4.OptionClientIdentifier:     {1, 2, 0, 0, 0, 0, 1},
+	}
+	opts := norm.ParseOptions()
+	if len(opts) != len(expected) {
+		t.Errorf("options mismatch: expected %d options, got %v", len(expected), opts)
+	}
+	for code, value := range expected {
+		if !bytes.Equal(opts[code], value) {
+			t.Errorf("option %v mismatch: expected %v, got %v", code, value, opts[code])
+		}
+	}
+
+	// The options are in a fixed order: the message type, then by code
+	var codes []dhcp4.OptionCode
+	for b := norm.Options(); len(b) >= 2 && dhcp4.OptionCode(b[0]) != dhcp4.End; b = b[2+int(b[1]):] {
+		codes = append(codes, dhcp4.OptionCode(b[0]))
+	}
+	expectedCodes := []dhcp4.OptionCode{
+		dhcp4.OptionDHCPMessageType,
+		dhcp4.OptionHostName,
+		dhcp4.OptionRequestedIPAddress,
+		dhcp4.OptionParameterRequestList,
+		dhcp4.OptionClientIdentifier,
+	}
+	if fmt.Sprint(codes) != fmt.Sprint(expectedCodes) {
+		t.Errorf("option order mismatch: expected %v, got %v", expectedCodes, codes)
+	}
+
+	// A discover is left alone
+	req = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, xid, true, options)
+	if norm := normalizeRequest(req); !bytes.Equal(norm, req) {
+		t.Errorf("discover was modified")
+	}
+}
+
+func TestServerReply(t *testing.T) {
+	ipc := &current.IPConfig{
+		Version: "4",
+		Address: net.IPNet{IP: net.IPv4(10, 1, 2, 3).To4(), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(10, 1, 2, 1),
+	}
+	routes := []*types.Route{
+		&types.Route{Dst: net.IPNet{IP: net.IPv4(192, 168, 1, 0), Mask: net.CIDRMask(24, 32)}},
+	}
+	dns := types.DNS{Nameservers: []string{"10.1.2.53", "2001:db8::53"}, Domain: "example.com"}
+
+	pool := &memorypool.MemoryPool{}
+	if err := pool.AddLease(leasepool.Lease{IP: ipc.Address.IP}); err != nil {
+		t.Fatal(err)
+	}
+	server, err := dhcp4server.New(ipc.Gateway.To4(), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &DHCPServer{server: server, options: serverOptions(ipc, routes, dns)}
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	reply, err := s.reply(dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 4}, true, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.YIAddr().Equal(net.IPv4(10, 1, 2, 3)) {
+		t.Errorf("offered address mismatch: expected 10.1.2.3, got %v", reply.YIAddr())
+	}
+
+	opts := reply.ParseOptions()
+	expected := map[dhcp4.OptionCode][]byte{
+		dhcp4.OptionDHCPMessageType:      {byte(dhcp4.Offer)},
+		dhcp4.OptionServerIdentifier:     {10, 1, 2, 1},
+		dhcp4.OptionSubnetMask:           {255, 255, 255, 0},
+		dhcp4.OptionRouter:               {10, 1, 2, 1},
+		dhcp4.OptionDomainNameServer:     {10, 1, 2, 53},
+		dhcp4.OptionDomainName:           []byte("example.com"),
+		dhcp4.OptionClasslessRouteFormat: {24, 192, 168, 1, 10, 1, 2, 1, 0, 10, 1, 2, 1},
+	}
+	for code, value := range expected {
+		if !bytes.Equal(opts[code], value) {
+			t.Errorf("option %v mismatch: expected %v, got %v", code, value, opts[code])
+		}
+	}
+	if len(opts[dhcp4.OptionIPAddressLeaseTime]) != 4 {
+		t.Errorf("missing lease time in offer")
+	}
+}
+
+func TestLoadServerConf(t *testing.T) {
+	conf, err := loadServerConf([]byte(`{"name": "test", "ipam": {"type": "dhcp"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.IPAM.Server != nil {
+		t.Errorf("unexpected server mode")
+	}
+
+	_, err = loadServerConf([]byte(`{"name": "test", "ipam": {"type": "dhcp", "server": {"ipam": {}}}}`))
+	if err == nil || err.Error() != "server mode requires an ipam plugin to allocate addresses" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = loadServerConf([]byte(`{"name": "test", "ipam": {"type": "dhcp", "server": {"ipam": {"type": "host-local"}, "leaseTime": "10s"}}}`))
+	if err == nil || err.Error() != `invalid leaseTime "10s"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, netconf, err := delegateNetConf([]byte(`{"name": "test", "ipam": {"type": "dhcp"}}`), map[string]interface{}{"type": "host-local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(netconf) != `{"ipam":{"type":"host-local"},"name":"test"}` {
+		t.Errorf("delegate netconf mismatch: got %s", netconf)
+	}
+}
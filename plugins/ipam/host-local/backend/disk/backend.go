@@ -118,6 +118,35 @@ func (s *Store) ReleaseByID(id string) error {
 	return err
 }
 
+// GetByID returns the IPs which have been allocated to the specific ID
+func (s *Store) GetByID(id string) []net.IP {
+	var ips []net.IP
+
+	match := strings.TrimSpace(id)
+	// walk through all ips in this network to get the ones which belong to a specific ID
+	_ = filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		if strings.TrimSpace(string(data)) == match {
+			name := info.Name()
+			if runtime.GOOS == "windows" {
+				name = strings.Replace(name, "_", ":", -1)
+			}
+			if ip := net.ParseIP(name); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return nil
+	})
+
+	return ips
+}
+
 func GetEscapedPath(dataDir string, fname string) string {
 	if runtime.GOOS == "windows" {
 		fname = strings.Replace(fname, ":", "_", -1)
@@ -25,7 +25,7 @@ import (
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/020"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/plugins/pkg/testutils"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
@@ -293,6 +293,72 @@ var _ = Describe("host-local Operations", func() {
 		Expect(err).To(HaveOccurred())
 	})
 
+	It("verifies reservations with CHECK", func() {
+		const ifname string = "eth0"
+		const nspath string = "/some/where"
+
+		tmpDir, err := getTmpDir()
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "0.4.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{ "subnet": "10.1.2.0/24" }],
+					[{ "subnet": "2001:db8:1::0/64" }]
+				]
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+
+		// Allocate the IPs
+		r, _, err := testutils.CmdAddWithResult(nspath, ifname, []byte(conf), func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := current.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(2))
+
+		err = testutils.CmdCheckWithResult(nspath, ifname, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Drop the v6 reservation behind the plugin's back
+		ipFilePath := filepath.Join(tmpDir, "mynet", result.IPs[1].Address.IP.String())
+		Expect(os.Remove(ipFilePath)).To(Succeed())
+
+		err = testutils.CmdCheckWithResult(nspath, ifname, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Details).To(Equal("range 1"))
+
+		// Release the IP
+		err = testutils.CmdDelWithResult(nspath, ifname, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdCheckWithResult(nspath, ifname, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
 	It("does not output an error message upon initial subnet creation", func() {
 		const ifname string = "eth0"
 		const nspath string = "/some/where"
@@ -19,17 +19,55 @@ import (
 	"net"
 	"strings"
 
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI host-local IPAM plugin")
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	// Look to see if there is at least one IP address allocated to the container
+	// in the data dir, irrespective of what that address actually is
+	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	containerIPs := store.GetByID(args.ContainerID)
+	store.Unlock()
+
+	for idx, rangeset := range ipamConf.Ranges {
+		found := false
+		for _, ip := range containerIPs {
+			if rangeset.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return utils.NewCheckError(fmt.Sprintf("range %d", idx),
+				"host-local: no IP reserved in range %d for container %q", idx, args.ContainerID)
+		}
+	}
+
+	return nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -102,7 +140,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		for _, ip := range requestedIPs {
 			errstr = errstr + " " + ip.String()
 		}
-		return fmt.Errorf(errstr)
+		return fmt.Errorf("%s", errstr)
 	}
 
 	result.Routes = ipamConf.Routes
@@ -134,7 +172,7 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	if errors != nil {
-		return fmt.Errorf(strings.Join(errors, ";"))
+		return fmt.Errorf("%s", strings.Join(errors, ";"))
 	}
 	return nil
 }
@@ -0,0 +1,192 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// The top-level network config - IPAM plugins are passed the full configuration
+// of the calling plugin, not just the IPAM section.
+type Net struct {
+	Name          string      `json:"name"`
+	CNIVersion    string      `json:"cniVersion"`
+	IPAM          *IPAMConfig `json:"ipam"`
+	RuntimeConfig struct {    // The capability arg
+		IPs []string `json:"ips,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+	Args *struct {
+		A *IPAMArgs `json:"cni"`
+	} `json:"args"`
+}
+
+// IPAMConfig holds the addresses, routes and DNS settings returned
+// verbatim by the plugin.
+type IPAMConfig struct {
+	Name      string
+	Type      string         `json:"type"`
+	Routes    []*types.Route `json:"routes"`
+	Addresses []Address      `json:"addresses,omitempty"`
+	DNS       types.DNS      `json:"dns"`
+}
+
+// IPAMEnvArgs are the arguments accepted in CNI_ARGS. IP may hold a
+// comma-separated list of addresses in CIDR notation.
+type IPAMEnvArgs struct {
+	types.CommonArgs
+	IP      types.UnmarshallableString `json:"ip,omitempty"`
+	GATEWAY types.UnmarshallableString `json:"gateway,omitempty"`
+}
+
+type IPAMArgs struct {
+	IPs []string `json:"ips"`
+}
+
+type Address struct {
+	AddressStr string `json:"address"`
+	Gateway    net.IP `json:"gateway,omitempty"`
+	Address    net.IPNet
+	Version    string
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI static IPAM plugin")
+}
+
+// LoadIPAMConfig parses the network config and merges in any addresses
+// requested through CNI_ARGS, the args config or the ips capability.
+func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
+	n := Net{}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return nil, "", err
+	}
+
+	if n.IPAM == nil {
+		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
+	}
+
+	// Parse custom IPs from env args, the top-level args config and
+	// the runtime config
+	if envArgs != "" {
+		e := IPAMEnvArgs{}
+		if err := types.LoadArgs(envArgs, &e); err != nil {
+			return nil, "", err
+		}
+
+		if e.IP != "" {
+			var gw net.IP
+			if e.GATEWAY != "" {
+				gw = net.ParseIP(string(e.GATEWAY))
+				if gw == nil {
+					return nil, "", fmt.Errorf("invalid gateway address: %s", e.GATEWAY)
+				}
+			}
+			for _, s := range strings.Split(string(e.IP), ",") {
+				n.IPAM.Addresses = append(n.IPAM.Addresses, Address{AddressStr: s, Gateway: gw})
+			}
+		}
+	}
+
+	if n.Args != nil && n.Args.A != nil {
+		for _, s := range n.Args.A.IPs {
+			n.IPAM.Addresses = append(n.IPAM.Addresses, Address{AddressStr: s})
+		}
+	}
+
+	for _, s := range n.RuntimeConfig.IPs {
+		n.IPAM.Addresses = append(n.IPAM.Addresses, Address{AddressStr: s})
+	}
+
+	if len(n.IPAM.Addresses) == 0 {
+		return nil, "", fmt.Errorf("no IP addresses specified")
+	}
+
+	// Validate all addresses
+	numV4 := 0
+	numV6 := 0
+	for i := range n.IPAM.Addresses {
+		addr := &n.IPAM.Addresses[i]
+		ip, ipnet, err := net.ParseCIDR(strings.TrimSpace(addr.AddressStr))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid CIDR %s: %s", addr.AddressStr, err)
+		}
+		addr.Address = net.IPNet{IP: ip, Mask: ipnet.Mask}
+
+		if ip.To4() != nil {
+			addr.Version = "4"
+			numV4++
+		} else {
+			addr.Version = "6"
+			numV6++
+		}
+
+		if addr.Gateway != nil && (addr.Gateway.To4() != nil) != (addr.Version == "4") {
+			return nil, "", fmt.Errorf("gateway %s is not in the same family as %s", addr.Gateway, addr.AddressStr)
+		}
+	}
+
+	// CNI spec 0.2.0 and below supported only one v4 and v6 address
+	if numV4 > 1 || numV6 > 1 {
+		if ok, _ := version.GreaterThanOrEqualTo(n.CNIVersion, "0.3.0"); !ok {
+			return nil, "", fmt.Errorf("CNI version %v does not support more than 1 address per family", n.CNIVersion)
+		}
+	}
+
+	// Copy net name into IPAM so not to drag Net struct around
+	n.IPAM.Name = n.Name
+
+	return n.IPAM, n.CNIVersion, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	ipamConf, confVersion, err := LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	result := &current.Result{}
+	result.DNS = ipamConf.DNS
+	result.Routes = ipamConf.Routes
+	for _, v := range ipamConf.Addresses {
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Version: v.Version,
+			Address: v.Address,
+			Gateway: v.Gateway,
+		})
+	}
+
+	return types.PrintResult(result, confVersion)
+}
+
+// cmdCheck only validates the configuration; the plugin keeps no state
+// that could have drifted since ADD.
+func cmdCheck(args *skel.CmdArgs) error {
+	_, _, err := LoadIPAMConfig(args.StdinData, args.Args)
+	return err
+}
+
+// cmdDel has nothing to release, as no addresses are allocated.
+func cmdDel(args *skel.CmdArgs) error {
+	_, _, err := LoadIPAMConfig(args.StdinData, args.Args)
+	return err
+}
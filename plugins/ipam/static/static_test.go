@@ -0,0 +1,212 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("static Operations", func() {
+	const ifname string = "eth0"
+	const nspath string = "/some/where"
+
+	It("returns the configured addresses, routes and DNS with ADD/DEL", func() {
+		conf := `{
+	"cniVersion": "0.3.1",
+	"name": "mynet",
+	"type": "ipvlan",
+	"master": "foo0",
+	"ipam": {
+		"type": "static",
+		"addresses": [
+			{ "address": "10.10.0.1/24", "gateway": "10.10.0.254" },
+			{ "address": "3ffe:ffff:0:01ff::1/64", "gateway": "3ffe:ffff:0::1" }
+		],
+		"routes": [
+			{ "dst": "0.0.0.0/0" },
+			{ "dst": "192.168.0.0/16", "gw": "10.10.5.1" },
+			{ "dst": "3ffe:ffff:0:01ff::1/64" }
+		],
+		"dns": {
+			"nameservers": ["8.8.8.8"],
+			"domain": "example.com",
+			"search": ["example.com"]
+		}
+	}
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+
+		r, raw, err := testutils.CmdAddWithResult(nspath, ifname, []byte(conf), func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+
+		result, err := current.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Gomega is cranky about slices with different caps
+		Expect(*result.IPs[0]).To(Equal(
+			current.IPConfig{
+				Version: "4",
+				Address: mustCIDR("10.10.0.1/24"),
+				Gateway: net.ParseIP("10.10.0.254"),
+			}))
+		Expect(*result.IPs[1]).To(Equal(
+			current.IPConfig{
+				Version: "6",
+				Address: mustCIDR("3ffe:ffff:0:01ff::1/64"),
+				Gateway: net.ParseIP("3ffe:ffff:0::1"),
+			}))
+		Expect(len(result.IPs)).To(Equal(2))
+
+		Expect(result.Routes).To(Equal([]*types.Route{
+			{Dst: mustCIDR("0.0.0.0/0")},
+			{Dst: mustCIDR("192.168.0.0/16"), GW: net.ParseIP("10.10.5.1")},
+			{Dst: mustCIDR("3ffe:ffff:0:01ff::1/64")},
+		}))
+		Expect(result.DNS).To(Equal(types.DNS{
+			Nameservers: []string{"8.8.8.8"},
+			Domain:      "example.com",
+			Search:      []string{"example.com"},
+		}))
+
+		err = testutils.CmdCheckWithResult(nspath, ifname, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(nspath, ifname, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("appends addresses from CNI_ARGS, args and runtimeConfig", func() {
+		conf := `{
+	"cniVersion": "0.3.1",
+	"name": "mynet",
+	"type": "bridge",
+	"ipam": {
+		"type": "static",
+		"addresses": [ { "address": "10.10.0.1/24" } ]
+	},
+	"args": {
+		"cni": { "ips": ["10.10.1.1/24"] }
+	},
+	"runtimeConfig": {
+		"ips": ["10.10.2.1/24"]
+	}
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+			Args:        "IP=10.10.3.1/24,10.10.4.1/24;GATEWAY=10.10.3.254",
+		}
+
+		r, _, err := testutils.CmdAddWithResult(nspath, ifname, []byte(conf), func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := current.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(result.IPs)).To(Equal(5))
+
+		var addrs []string
+		for _, ip := range result.IPs {
+			addrs = append(addrs, ip.Address.String())
+		}
+		Expect(addrs).To(Equal([]string{
+			"10.10.0.1/24", "10.10.3.1/24", "10.10.4.1/24", "10.10.1.1/24", "10.10.2.1/24",
+		}))
+		Expect(result.IPs[0].Gateway).To(BeNil())
+		Expect(result.IPs[1].Gateway).To(Equal(net.ParseIP("10.10.3.254")))
+		Expect(result.IPs[2].Gateway).To(Equal(net.ParseIP("10.10.3.254")))
+		Expect(result.IPs[3].Gateway).To(BeNil())
+	})
+
+	It("fails when no addresses are given", func() {
+		conf := `{
+	"cniVersion": "0.3.1",
+	"name": "mynet",
+	"type": "bridge",
+	"ipam": {
+		"type": "static"
+	}
+}`
+
+		_, _, err := LoadIPAMConfig([]byte(conf), "")
+		Expect(err).To(MatchError("no IP addresses specified"))
+	})
+
+	It("fails for an invalid address", func() {
+		conf := `{
+	"cniVersion": "0.3.1",
+	"name": "mynet",
+	"type": "bridge",
+	"ipam": {
+		"type": "static",
+		"addresses": [ { "address": "10.10.0.1" } ]
+	}
+}`
+
+		_, _, err := LoadIPAMConfig([]byte(conf), "")
+		Expect(err).To(MatchError(HavePrefix("invalid CIDR 10.10.0.1")))
+	})
+
+	It("fails for more than one address per family with 0.2.0", func() {
+		conf := `{
+	"cniVersion": "0.2.0",
+	"name": "mynet",
+	"type": "bridge",
+	"ipam": {
+		"type": "static",
+		"addresses": [ { "address": "10.10.0.1/24" }, { "address": "10.10.1.1/24" } ]
+	}
+}`
+
+		_, _, err := LoadIPAMConfig([]byte(conf), "")
+		Expect(err).To(MatchError("CNI version 0.2.0 does not support more than 1 address per family"))
+	})
+})
+
+func mustCIDR(s string) net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	n.IP = ip
+	if err != nil {
+		Fail(err.Error())
+	}
+
+	return *n
+}
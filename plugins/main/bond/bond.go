@@ -0,0 +1,541 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultMiimon  = 100
+	defaultDataDir = "/var/lib/cni/bond"
+)
+
+// LinkSelector selects a host link the same way host-device does.
+type LinkSelector struct {
+	Device     string `json:"device"`     // Device-Name, something like eth0 or can0 etc.
+	HWAddr     string `json:"hwaddr"`     // MAC Address of target network interface
+	KernelPath string `json:"kernelpath"` // Kernelpath of the device
+}
+
+type NetConf struct {
+	types.NetConf
+	Links   []LinkSelector `json:"links"`
+	Mode    string         `json:"mode"`
+	Miimon  *int           `json:"miimon,omitempty"`
+	Primary string         `json:"primary,omitempty"` // Host name of the primary slave
+	MTU     int            `json:"mtu"`
+	DataDir string         `json:"dataDir,omitempty"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{
+		DataDir: defaultDataDir,
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	if len(n.Links) == 0 {
+		return nil, "", fmt.Errorf(`"links" must list at least one host link`)
+	}
+	for i, l := range n.Links {
+		if l.Device == "" && l.HWAddr == "" && l.KernelPath == "" {
+			return nil, "", fmt.Errorf(`link %d: specify either "device", "hwaddr" or "kernelpath"`, i)
+		}
+	}
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, "", err
+	}
+	if n.Miimon == nil {
+		miimon := defaultMiimon
+		n.Miimon = &miimon
+	} else if *n.Miimon < 0 {
+		return nil, "", fmt.Errorf("invalid miimon %d", *n.Miimon)
+	}
+	if n.Primary != "" && n.Mode != "" && n.Mode != "active-backup" {
+		return nil, "", fmt.Errorf(`"primary" is only supported in mode active-backup`)
+	}
+	return n, n.CNIVersion, nil
+}
+
+func modeFromString(s string) (netlink.BondMode, error) {
+	switch s {
+	case "", "active-backup":
+		return netlink.BOND_MODE_ACTIVE_BACKUP, nil
+	case "802.3ad":
+		return netlink.BOND_MODE_802_3AD, nil
+	case "balance-xor":
+		return netlink.BOND_MODE_BALANCE_XOR, nil
+	default:
+		return 0, fmt.Errorf("unknown bond mode: %q", s)
+	}
+}
+
+// findHostLinks returns the selected host links, each once.
+func findHostLinks(selectors []LinkSelector) ([]netlink.Link, error) {
+	var links []netlink.Link
+	seen := map[int]bool{}
+	for _, s := range selectors {
+		link, err := ip.FindLink(s.Device, s.HWAddr, s.KernelPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find host device: %v", err)
+		}
+		if seen[link.Attrs().Index] {
+			return nil, fmt.Errorf("host device %q is selected more than once", link.Attrs().Name)
+		}
+		seen[link.Attrs().Index] = true
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// slaveName returns the name in the container of the i-th link of the
+// bond ifName. The links are renamed, as their host names may clash with
+// the other interfaces of the container.
+func slaveName(ifName string, i int) string {
+	suffix := fmt.Sprintf("s%d", i)
+	if max := unix.IFNAMSIZ - 1 - len(suffix); len(ifName) > max {
+		ifName = ifName[:max]
+	}
+	return ifName + suffix
+}
+
+// createBond creates the bond in the current namespace and enslaves the
+// links to it. primary is the name of the primary link in the container.
+func createBond(conf *NetConf, ifName string, slaves []string, primary string) (*netlink.Bond, error) {
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{
+		Name: ifName,
+		MTU:  conf.MTU,
+	})
+	bond.Mode = mode
+	bond.Miimon = *conf.Miimon
+	if primary != "" {
+		link, err := netlink.LinkByName(primary)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find primary %q: %v", primary, err)
+		}
+		bond.Primary = link.Attrs().Index
+	}
+
+	if err := netlink.LinkAdd(bond); err != nil {
+		return nil, fmt.Errorf("failed to create bond %q: %v", ifName, err)
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refetch bond %q: %v", ifName, err)
+	}
+
+	for _, name := range slaves {
+		slave, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find %q: %v", name, err)
+		}
+		if err := netlink.LinkSetMasterByIndex(slave, link.Attrs().Index); err != nil {
+			return nil, fmt.Errorf("failed to enslave %q to %q: %v", name, ifName, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", ifName, err)
+	}
+
+	return link.(*netlink.Bond), nil
+}
+
+// bondSlaves returns the links enslaved to the bond.
+func bondSlaves(bond netlink.Link) ([]netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	var slaves []netlink.Link
+	for _, l := range links {
+		if l.Attrs().MasterIndex == bond.Attrs().Index {
+			slaves = append(slaves, l)
+		}
+	}
+	return slaves, nil
+}
+
+// setLinkUp sets the link of the current namespace up.
+func setLinkUp(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	containerNs, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer containerNs.Close()
+
+	hostDevs, err := findHostLinks(n.Links)
+	if err != nil {
+		return err
+	}
+
+	if n.Primary != "" {
+		isSlave := false
+		for _, hostDev := range hostDevs {
+			if hostDev.Attrs().Name == n.Primary {
+				isSlave = true
+				break
+			}
+		}
+		if !isSlave {
+			return fmt.Errorf("primary %q is not one of the selected links", n.Primary)
+		}
+	}
+
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	// Remember which links are up, so that DEL can bring them up again.
+	// Only down links can be enslaved.
+	st := &state{}
+	for _, hostDev := range hostDevs {
+		if hostDev.Attrs().Flags&net.FlagUp != 0 {
+			st.Up = append(st.Up, hostDev.Attrs().Name)
+		}
+	}
+	if err := saveState(n.DataDir, n.Name, args.ContainerID, args.IfName, st); err != nil {
+		return fmt.Errorf("failed to save state of bond %q: %v", args.IfName, err)
+	}
+	undo.Push("remove state", func() error {
+		return removeState(n.DataDir, n.Name, args.ContainerID, args.IfName)
+	})
+
+	var slaves []string
+	primary := ""
+	for i, hostDev := range hostDevs {
+		hostName := hostDev.Attrs().Name
+		name := slaveName(args.IfName, i)
+		if err := netlink.LinkSetDown(hostDev); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", hostName, err)
+		}
+		if st.wasUp(hostName) {
+			undo.Push("set link up", func() error {
+				return setLinkUp(hostName)
+			})
+		}
+		if _, err := ip.MoveLinkIn(hostDev, containerNs, name); err != nil {
+			return fmt.Errorf("failed to move link %v", err)
+		}
+		undo.Push("move link out", func() error {
+			return ip.MoveLinkOut(containerNs, name)
+		})
+		slaves = append(slaves, name)
+		if hostName == n.Primary {
+			primary = name
+		}
+	}
+
+	result := &current.Result{}
+	err = containerNs.Do(func(_ ns.NetNS) error {
+		bond, err := createBond(n, args.IfName, slaves, primary)
+		if err != nil {
+			// Deleting the bond releases the links
+			_ = ip.DelLinkByName(args.IfName)
+			return err
+		}
+
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name:    bond.Attrs().Name,
+			Mac:     bond.Attrs().HardwareAddr.String(),
+			Sandbox: containerNs.Path(),
+		})
+		for _, name := range slaves {
+			slave, err := netlink.LinkByName(name)
+			if err != nil {
+				return fmt.Errorf("failed to find %q: %v", name, err)
+			}
+			result.Interfaces = append(result.Interfaces, &current.Interface{
+				Name:    slave.Attrs().Name,
+				Mac:     slave.Attrs().HardwareAddr.String(),
+				Sandbox: containerNs.Path(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	undo.Push("delete bond", func() error {
+		return containerNs.Do(func(_ ns.NetNS) error {
+			return ip.DelLinkByName(args.IfName)
+		})
+	})
+
+	// run the IPAM plugin and get back the config to apply
+	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	undo.Push("release IPAM allocation", func() error {
+		return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	})
+
+	// Convert whatever the IPAM result was into the current Result type
+	ipamResult, err := current.NewResultFromResult(r)
+	if err != nil {
+		return err
+	}
+
+	if len(ipamResult.IPs) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+
+	for _, ipc := range ipamResult.IPs {
+		// All addresses apply to the bond
+		ipc.Interface = current.Int(0)
+	}
+	result.IPs = ipamResult.IPs
+	result.Routes = ipamResult.Routes
+
+	err = containerNs.Do(func(_ ns.NetNS) error {
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+
+		contBond, err := net.InterfaceByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to look up %q: %v", args.IfName, err)
+		}
+
+		for _, ipc := range result.IPs {
+			if ipc.Version == "4" {
+				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contBond)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	result.DNS = n.DNS
+
+	undo.Commit()
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return removeState(n.DataDir, n.Name, args.ContainerID, args.IfName)
+	}
+
+	containerNs, err := ns.GetNS(args.Netns)
+	if err != nil {
+		// The links return to the host by themselves when the
+		// namespace is destroyed
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return removeState(n.DataDir, n.Name, args.ContainerID, args.IfName)
+		}
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer containerNs.Close()
+
+	st, err := loadState(n.DataDir, n.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// Dissolve the bond and find the links still in the container. Delete
+	// can be called multiple times, so missing links are not an error.
+	var slaves []netlink.Link
+	err = containerNs.Do(func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		for i := range n.Links {
+			slave, err := netlink.LinkByName(slaveName(args.IfName, i))
+			if err != nil {
+				if _, ok := err.(netlink.LinkNotFoundError); ok {
+					continue
+				}
+				return fmt.Errorf("failed to find %q: %v", slaveName(args.IfName, i), err)
+			}
+			slaves = append(slaves, slave)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Return each link to the host, in the state it was before ADD
+	for _, slave := range slaves {
+		if err := ip.MoveLinkOut(containerNs, slave.Attrs().Name); err != nil {
+			return err
+		}
+		if st.wasUp(slave.Attrs().Alias) {
+			if err := setLinkUp(slave.Attrs().Alias); err != nil {
+				return err
+			}
+		}
+	}
+	return removeState(n.DataDir, n.Name, args.ContainerID, args.IfName)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	mode, err := modeFromString(n.Mode)
+	if err != nil {
+		return err
+	}
+
+	containerNs, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer containerNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		resource := fmt.Sprintf("interface %q", args.IfName)
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(resource, "failed to find interface %q: %v", args.IfName, err)
+		}
+		bond, ok := link.(*netlink.Bond)
+		if !ok {
+			return utils.NewCheckError(resource, "interface %q is not a bond", args.IfName)
+		}
+		if bond.Mode != mode {
+			return utils.NewCheckError(resource, "bond %q is in mode %s, expected %s", args.IfName, bond.Mode, mode)
+		}
+
+		slaves, err := bondSlaves(bond)
+		if err != nil {
+			return err
+		}
+		if len(slaves) != len(n.Links) {
+			return utils.NewCheckError(resource, "bond %q has %d slaves, expected %d", args.IfName, len(slaves), len(n.Links))
+		}
+		// The alias holds the name the device had on the host
+		for _, l := range n.Links {
+			if l.Device == "" {
+				continue
+			}
+			found := false
+			for _, slave := range slaves {
+				if slave.Attrs().Alias == l.Device {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return utils.NewCheckError(resource, "host device %q is not enslaved to bond %q", l.Device, args.IfName)
+			}
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI bond plugin")
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bond configuration", func() {
+	It("defaults to active-backup with miimon 100", func() {
+		n, _, err := loadConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "bonded",
+	"type": "bond",
+	"links": [ {"device": "eth1"}, {"hwaddr": "0a:58:0a:01:02:03"} ]
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n.Miimon).To(Equal(100))
+		mode, err := modeFromString(n.Mode)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mode).To(Equal(netlink.BOND_MODE_ACTIVE_BACKUP))
+	})
+
+	It("rejects a link without a selector", func() {
+		_, _, err := loadConf([]byte(`{"name": "bonded", "type": "bond", "links": [ {"device": "eth1"}, {} ]}`))
+		Expect(err).To(MatchError(`link 1: specify either "device", "hwaddr" or "kernelpath"`))
+	})
+
+	It("rejects an unsupported mode", func() {
+		_, _, err := loadConf([]byte(`{"name": "bonded", "type": "bond", "mode": "balance-rr", "links": [ {"device": "eth1"} ]}`))
+		Expect(err).To(MatchError(`unknown bond mode: "balance-rr"`))
+	})
+
+	It("rejects a primary outside of active-backup", func() {
+		_, _, err := loadConf([]byte(`{"name": "bonded", "type": "bond", "mode": "802.3ad", "primary": "eth1", "links": [ {"device": "eth1"} ]}`))
+		Expect(err).To(MatchError(`"primary" is only supported in mode active-backup`))
+	})
+})
+
+var _ = Describe("bond plugin", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+	const IFNAME string = "bond0"
+	slaves := []string{"dummy-bond0", "dummy-bond1"}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "bond_test")
+		Expect(err).NotTo(HaveOccurred())
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, name := range slaves {
+				err := netlink.LinkAdd(&netlink.Dummy{
+					LinkAttrs: netlink.LinkAttrs{
+						Name: name,
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			// Only the first link is up on the host
+			link, err := netlink.LinkByName(slaves[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	It("bonds the host links with ADD and returns them with DEL", func() {
+		conf := fmt.Sprintf(`{
+	"cniVersion": "0.4.0",
+	"name": "bonded",
+	"type": "bond",
+	"mode": "active-backup",
+	"primary": %q,
+	"links": [ {"device": %q}, {"device": %q} ],
+	"dataDir": %q,
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24",
+		"dataDir": %q
+	}
+}`, slaves[1], slaves[0], slaves[1], dataDir, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(3))
+			Expect(result.Interfaces[0].Name).To(Equal(IFNAME))
+			Expect(result.Interfaces[1].Name).To(Equal("bond0s0"))
+			Expect(result.Interfaces[2].Name).To(Equal("bond0s1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(BeAssignableToTypeOf(&netlink.Bond{}))
+			Expect(link.(*netlink.Bond).Mode).To(Equal(netlink.BOND_MODE_ACTIVE_BACKUP))
+
+			// The links are renamed after the bond, and keep their host
+			// names in the alias
+			for i, name := range slaves {
+				slave, err := netlink.LinkByName(slaveName(IFNAME, i))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(slave.Attrs().MasterIndex).To(Equal(link.Attrs().Index))
+				Expect(slave.Attrs().Alias).To(Equal(name))
+				if i == 1 {
+					Expect(link.(*netlink.Bond).Primary).To(Equal(slave.Attrs().Index))
+				}
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Each link is back under its host name, and up only if it
+			// was up before ADD
+			for i, name := range slaves {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags&net.FlagUp != 0).To(Equal(i == 0))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("bond link names", func() {
+	It("names the links after the bond, within the interface name limit", func() {
+		Expect(slaveName("bond0", 0)).To(Equal("bond0s0"))
+		Expect(slaveName("bond0", 12)).To(Equal("bond0s12"))
+		Expect(slaveName("a-very-long-ifc", 1)).To(Equal("a-very-long-is1"))
+	})
+})
@@ -0,0 +1,78 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// state is what the plugin keeps about a bond between ADD and DEL.
+type state struct {
+	// Up are the host names of the links that were up before they were
+	// enslaved
+	Up []string `json:"up,omitempty"`
+}
+
+func (s *state) wasUp(hostName string) bool {
+	for _, name := range s.Up {
+		if name == hostName {
+			return true
+		}
+	}
+	return false
+}
+
+func statePath(dataDir, network, containerID, ifName string) string {
+	return filepath.Join(dataDir, network, containerID+"-"+ifName)
+}
+
+// loadState returns the state of the bond, or an empty state if there is
+// none.
+func loadState(dataDir, network, containerID, ifName string) (*state, error) {
+	s := &state{}
+	data, err := ioutil.ReadFile(statePath(dataDir, network, containerID, ifName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state of bond %q of container %q: %v", ifName, containerID, err)
+	}
+	return s, nil
+}
+
+func saveState(dataDir, network, containerID, ifName string, s *state) error {
+	if err := os.MkdirAll(filepath.Join(dataDir, network), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(dataDir, network, containerID, ifName), data, 0600)
+}
+
+func removeState(dataDir, network, containerID, ifName string) error {
+	if err := os.Remove(statePath(dataDir, network, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -26,11 +26,12 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
 	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
@@ -48,6 +49,13 @@ type NetConf struct {
 	MTU          int    `json:"mtu"`
 	HairpinMode  bool   `json:"hairpinMode"`
 	PromiscMode  bool   `json:"promiscMode"`
+	MacSpoofChk  bool   `json:"macspoofchk"`
+	IPSpoofChk   bool   `json:"ipspoofchk"`
+
+	StormControl *StormControl `json:"stormControl,omitempty"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
 }
 
 type gwInfo struct {
@@ -70,6 +78,31 @@ func loadNetConf(bytes []byte) (*NetConf, string, error) {
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if n.StormControl != nil {
+		if err := n.StormControl.validate(); err != nil {
+			return nil, "", fmt.Errorf("invalid stormControl: %v", err)
+		}
+	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
 	return n, n.CNIVersion, nil
 }
 
@@ -243,7 +276,7 @@ func ensureBridge(brName string, mtu int, promiscMode bool) (*netlink.Bridge, er
 	return br, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool) (*current.Interface, *current.Interface, error) {
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool, undo *rollback.Stack) (*current.Interface, *current.Interface, error) {
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
 
@@ -253,6 +286,11 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 		if err != nil {
 			return err
 		}
+		undo.Push("delete link", func() error {
+			return ns.WithNetNSPath(netns.Path(), func(_ ns.NetNS) error {
+				return ip.DelLinkByName(ifName)
+			})
+		})
 		contIface.Name = containerVeth.Name
 		contIface.Mac = containerVeth.HardwareAddr.String()
 		contIface.Sandbox = netns.Path()
@@ -347,7 +385,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode)
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode, &undo)
 	if err != nil {
 		return err
 	}
@@ -357,6 +399,9 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
+	undo.Push("release IPAM allocation", func() error {
+		return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	})
 
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
@@ -377,6 +422,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	// Configure the container hardware address and IP address(es)
+	var linkLocal []net.IP
 	if err := netns.Do(func(_ ns.NetNS) error {
 		contVeth, err := net.InterfaceByName(args.IfName)
 		if err != nil {
@@ -406,11 +452,36 @@ func cmdAdd(args *skel.CmdArgs) error {
 				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
 			}
 		}
+
+		if n.IPSpoofChk {
+			linkLocal, err = linkLocalAddrs(args.IfName)
+			return err
+		}
 		return nil
 	}); err != nil {
 		return err
 	}
 
+	if n.MacSpoofChk || n.IPSpoofChk {
+		sc := newSpoofCheck(n, args.ContainerID, hostInterface.Name, containerInterface.Mac, result.IPs, linkLocal)
+		if err := sc.setup(); err != nil {
+			return err
+		}
+		undo.Push("teardown spoof check", func() error {
+			return teardownSpoofCheck(sc.chain)
+		})
+	}
+
+	if n.StormControl != nil {
+		stc := newStormControl(n, args.ContainerID, hostInterface.Name)
+		undo.Push("teardown storm control", func() error {
+			return teardownStormControl(stc.chain)
+		})
+		if err := stc.setup(); err != nil {
+			return err
+		}
+	}
+
 	if n.IsGW {
 		var firstV4Addr net.IP
 		// Set the IP address(es) on the bridge and enable forwarding
@@ -438,9 +509,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
 		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(ip.Network(&ipc.Address), chain, comment); err != nil {
+			ipn := ip.Network(&ipc.Address)
+			if err = ip.SetupIPMasq(ipn, chain, comment); err != nil {
 				return err
 			}
+			undo.Push("teardown ip masquerade", func() error {
+				return ip.TeardownIPMasq(ipn, chain, comment)
+			})
 		}
 	}
 
@@ -454,6 +529,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.DNS = n.DNS
 
+	undo.Commit()
 	return types.PrintResult(result, cniVersion)
 }
 
@@ -467,6 +543,18 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if n.MacSpoofChk || n.IPSpoofChk {
+		if err := teardownSpoofCheck(spoofCheckChain(n.Name, args.ContainerID)); err != nil {
+			return err
+		}
+	}
+
+	if n.StormControl != nil {
+		if err := teardownStormControl(stormControlChain(n.Name, args.ContainerID)); err != nil {
+			return err
+		}
+	}
+
 	if args.Netns == "" {
 		return nil
 	}
@@ -501,6 +589,101 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	br, err := bridgeByName(n.BrName)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("bridge %q", n.BrName), "%v", err)
+	}
+
+	// Find the container interface and the IPs that were assigned to it
+	contIdx := -1
+	for i, iface := range result.Interfaces {
+		if iface.Name == args.IfName && iface.Sandbox != "" {
+			contIdx = i
+			break
+		}
+	}
+	if contIdx < 0 {
+		return fmt.Errorf("prevResult has no interface %q in the container", args.IfName)
+	}
+	contIface := result.Interfaces[contIdx]
+	var contIPs []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == contIdx {
+			contIPs = append(contIPs, ipc)
+		}
+	}
+
+	var peerIndex int
+	var linkLocal []net.IP
+	if err := netns.Do(func(_ ns.NetNS) error {
+		link, peer, err := ip.GetVethPeerIfindex(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "%v", err)
+		}
+		if contIface.Mac != "" && link.Attrs().HardwareAddr.String() != contIface.Mac {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "interface %q has MAC %s, expected %s", args.IfName, link.Attrs().HardwareAddr, contIface.Mac)
+		}
+		peerIndex = peer
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, contIPs); err != nil {
+			return err
+		}
+		if n.IPSpoofChk {
+			if linkLocal, err = linkLocalAddrs(args.IfName); err != nil {
+				return err
+			}
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	}); err != nil {
+		return err
+	}
+
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("veth peer of %q", args.IfName), "failed to find host veth of %q: %v", args.IfName, err)
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", hostVeth.Attrs().Name), "host veth %q is not attached to bridge %q", hostVeth.Attrs().Name, n.BrName)
+	}
+
+	if n.MacSpoofChk || n.IPSpoofChk {
+		sc := newSpoofCheck(n, args.ContainerID, hostVeth.Attrs().Name, contIface.Mac, contIPs, linkLocal)
+		if err := sc.check(); err != nil {
+			return err
+		}
+	}
+
+	if n.StormControl != nil {
+		stc := newStormControl(n, args.ContainerID, hostVeth.Attrs().Name)
+		if err := stc.check(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI bridge plugin")
 }
@@ -15,15 +15,21 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/020"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
 	"github.com/containernetworking/plugins/pkg/testutils"
 
 	"github.com/vishvananda/netlink"
@@ -230,6 +236,7 @@ type testerV03x struct {
 	targetNS ns.NetNS
 	args     *skel.CmdArgs
 	vethName string
+	result   []byte
 }
 
 func (tester *testerV03x) setNS(testNS ns.NetNS, targetNS ns.NetNS) {
@@ -251,6 +258,7 @@ func (tester *testerV03x) cmdAddTest(tc testCase) {
 		})
 		Expect(err).NotTo(HaveOccurred())
 		Expect(strings.Index(string(raw), "\"interfaces\":")).Should(BeNumerically(">", 0))
+		tester.result = raw
 
 		result, err = current.GetResult(r)
 		Expect(err).NotTo(HaveOccurred())
@@ -370,6 +378,53 @@ func (tester *testerV03x) cmdAddTest(tc testCase) {
 	Expect(err).NotTo(HaveOccurred())
 }
 
+func (tester *testerV03x) cmdCheckTest(tc testCase) {
+	// CHECK is given the result of ADD
+	var conf map[string]interface{}
+	Expect(json.Unmarshal(tester.args.StdinData, &conf)).To(Succeed())
+	conf["prevResult"] = json.RawMessage(tester.result)
+	checkConf, err := json.Marshal(conf)
+	Expect(err).NotTo(HaveOccurred())
+	args := *tester.args
+	args.StdinData = checkConf
+
+	prevResult := &current.Result{}
+	Expect(json.Unmarshal(tester.result, prevResult)).To(Succeed())
+
+	err = tester.testNS.Do(func(ns.NetNS) error {
+		defer GinkgoRecover()
+
+		err := testutils.CmdCheckWithResult(tester.targetNS.Path(), IFNAME, func() error {
+			return cmdCheck(&args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	// Remove a container address behind the plugin's back
+	err = tester.targetNS.Do(func(ns.NetNS) error {
+		defer GinkgoRecover()
+
+		link, err := netlink.LinkByName(IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netlink.AddrDel(link, &netlink.Addr{IPNet: &prevResult.IPs[0].Address})).To(Succeed())
+		return nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	err = tester.testNS.Do(func(ns.NetNS) error {
+		defer GinkgoRecover()
+
+		err := testutils.CmdCheckWithResult(tester.targetNS.Path(), IFNAME, func() error {
+			return cmdCheck(&args)
+		})
+		Expect(err).To(HaveOccurred())
+		return nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+}
+
 func (tester *testerV03x) cmdDelTest(tc testCase) {
 	err := tester.testNS.Do(func(ns.NetNS) error {
 		defer GinkgoRecover()
@@ -421,7 +476,6 @@ func (tester *testerV01xOr02x) cmdAddTest(tc testCase) {
 	tester.args = tc.createCmdArgs(tester.targetNS)
 
 	// Execute cmdADD on the plugin
-	var result *types020.Result
 	err := tester.testNS.Do(func(ns.NetNS) error {
 		defer GinkgoRecover()
 
@@ -432,7 +486,7 @@ func (tester *testerV01xOr02x) cmdAddTest(tc testCase) {
 		Expect(strings.Index(string(raw), "\"ip\":")).Should(BeNumerically(">", 0))
 
 		// We expect a version 0.1.0 result
-		result, err = types020.GetResult(r)
+		_, err = types020.GetResult(r)
 		Expect(err).NotTo(HaveOccurred())
 
 		// Make sure bridge link exists
@@ -693,6 +747,314 @@ var _ = Describe("bridge Operations", func() {
 		}
 	})
 
+	It("configures, checks and deconfigures a bridge and veth with ADD/CHECK/DEL for 0.4.0 config", func() {
+		testCases := []testCase{
+			{
+				// IPv4 only
+				subnet:     "10.1.2.0/24",
+				expGWCIDRs: []string{"10.1.2.1/24"},
+			},
+			{
+				// IPv6 only
+				subnet:     "2001:db8::0/64",
+				expGWCIDRs: []string{"2001:db8::1/64"},
+			},
+			{
+				// Dual-Stack
+				ranges: []rangeInfo{
+					{subnet: "192.168.0.0/24"},
+					{subnet: "fd00::0/64"},
+				},
+				expGWCIDRs: []string{
+					"192.168.0.1/24",
+					"fd00::1/64",
+				},
+			},
+		}
+		for _, tc := range testCases {
+			tc.cniVersion = "0.4.0"
+
+			tester := &testerV03x{}
+			targetNS, err := ns.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			tester.setNS(originalNS, targetNS)
+
+			tester.cmdAddTest(tc)
+			tester.cmdCheckTest(tc)
+			tester.cmdDelTest(tc)
+
+			Expect(targetNS.Close()).To(Succeed())
+			delBridgeAddrs(originalNS)
+		}
+	})
+
+	It("filters the container's traffic with macspoofchk and ipspoofchk with ADD/CHECK/DEL", func() {
+		conf := fmt.Sprintf(`{
+    "cniVersion": "0.4.0",
+    "name": "testConfig",
+    "type": "bridge",
+    "bridge": "%s",
+    "macspoofchk": true,
+    "ipspoofchk": true,
+    "ipam": {
+        "type": "host-local",
+        "ranges": [[{"subnet": "10.1.2.0/24"}], [{"subnet": "2001:db8::0/64"}]]
+    }
+}`, BRNAME)
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		chain := spoofCheckChain("testConfig", "dummy")
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, raw, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(3))
+			Expect(result.IPs).To(HaveLen(2))
+
+			mac, err := net.ParseMAC(result.Interfaces[2].Mac)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The chain matches the host veth and allows only the MAC,
+			// the addresses and the link-local address of the container
+			out, err := exec.Command("nft", "list", "chain", "bridge", spoofCheckTable, chain).CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(out))
+			for _, s := range []string{
+				fmt.Sprintf("%q", result.Interfaces[1].Name),
+				result.Interfaces[2].Mac,
+				result.IPs[0].Address.IP.String(),
+				result.IPs[1].Address.IP.String(),
+				eui64LinkLocal(mac).String(),
+			} {
+				Expect(string(out)).To(ContainSubstring(s))
+			}
+			Expect(string(out)).NotTo(ContainSubstring("fe80::/10"))
+
+			checkConf := make(map[string]interface{})
+			Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+			checkConf["prevResult"] = json.RawMessage(raw)
+			checkArgs := *args
+			checkArgs.StdinData, err = json.Marshal(checkConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+				return cmdCheck(&checkArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithResult(targetNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			out, err = exec.Command("nft", "list", "chain", "bridge", spoofCheckTable, chain).CombinedOutput()
+			Expect(err).To(HaveOccurred(), string(out))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("limits the container's flooded traffic with stormControl with ADD/CHECK/DEL", func() {
+		conf := fmt.Sprintf(`{
+    "cniVersion": "0.4.0",
+    "name": "testConfig",
+    "type": "bridge",
+    "bridge": "%s",
+    "stormControl": {
+        "broadcast": 100,
+        "multicast": 1000,
+        "unknownUnicast": 50,
+        "blockedGroups": ["224.0.0.251"]
+    },
+    "ipam": {
+        "type": "host-local",
+        "subnet": "10.1.2.0/24"
+    }
+}`, BRNAME)
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		chain := stormControlChain("testConfig", "dummy")
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, raw, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(3))
+
+			// The chain matches the host veth and has the limits
+			out, err := exec.Command("nft", "list", "chain", "bridge", stormControlTable, chain).CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(out))
+			for _, s := range []string{
+				fmt.Sprintf("%q", result.Interfaces[1].Name),
+				"224.0.0.251",
+				"over 100/second",
+				"over 1000/second",
+				"over 50/second",
+				"@" + knownSet,
+			} {
+				Expect(string(out)).To(ContainSubstring(s))
+			}
+
+			// The bridge address is known from the start
+			out, err = exec.Command("nft", "list", "set", "bridge", stormControlTable, knownSet).CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(out))
+			Expect(string(out)).To(ContainSubstring(result.Interfaces[0].Mac))
+
+			checkConf := make(map[string]interface{})
+			Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+			checkConf["prevResult"] = json.RawMessage(raw)
+			checkArgs := *args
+			checkArgs.StdinData, err = json.Marshal(checkConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+				return cmdCheck(&checkArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithResult(targetNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			out, err = exec.Command("nft", "list", "chain", "bridge", stormControlTable, chain).CombinedOutput()
+			Expect(err).To(HaveOccurred(), string(out))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("releases the IPAM allocation and deletes the link when ADD fails", func() {
+		dataDir, err := ioutil.TempDir("", "bridge_test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		// The route's gateway is not on-link, so configuring the container
+		// interface fails after the veth and the address were set up
+		conf := fmt.Sprintf(`{
+    "cniVersion": "0.3.1",
+    "name": "mynet",
+    "type": "bridge",
+    "bridge": "%s",
+    "ipam": {
+        "type": "host-local",
+        "subnet": "10.1.2.0/24",
+        "routes": [{"dst": "10.9.0.0/16", "gw": "10.99.99.1"}],
+        "dataDir": "%s"
+    }
+}`, BRNAME, dataDir)
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+
+			// The host end of the veth went with the container end
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, l := range links {
+				_, isVeth := l.(*netlink.Veth)
+				Expect(isVeth).To(BeFalse())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Only host-local's bookkeeping of the last reserved address is left
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, "mynet"))
+		Expect(err).NotTo(HaveOccurred())
+		for _, f := range files {
+			Expect(f.Name()).NotTo(Equal("10.1.2.2"))
+		}
+	})
+
+	It("deletes the veth when it cannot be attached to the bridge", func() {
+		targetNS, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// The bridge does not exist, so enslaving the host veth fails
+			br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME, Index: 9999}}
+
+			var undo rollback.Stack
+			_, _, err := setupVeth(targetNS, br, IFNAME, 1500, false, &undo)
+			Expect(err).To(HaveOccurred())
+			Expect(undo.Rollback()).To(Succeed())
+
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, l := range links {
+				_, isVeth := l.(*netlink.Veth)
+				Expect(isVeth).To(BeFalse())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	It("deconfigures an unconfigured bridge with DEL", func() {
 		tc := testCase{
 			cniVersion: "0.3.0",
@@ -0,0 +1,225 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// spoofCheckTable is the nftables table, in the bridge family, that holds
+// the anti-spoofing chains of all containers.
+const spoofCheckTable = "cni_spoofcheck"
+
+// spoofCheck filters the frames a container sends into the bridge through
+// its host veth. Each container gets a base chain of its own on the bridge
+// prerouting hook, so teardown only has to delete that chain.
+type spoofCheck struct {
+	chain string
+	iface string
+	// mac is the only source MAC allowed, if not empty
+	mac string
+	// ips are the only source addresses allowed, if checkIPs is set
+	ips []net.IP
+	// linkLocal are the IPv6 link-local addresses of the container
+	// interface, which are allowed too, if checkIPs is set
+	linkLocal []net.IP
+	checkIPs  bool
+}
+
+// spoofCheckChain returns the name of the chain of the container.
+func spoofCheckChain(name, containerID string) string {
+	return utils.FormatChainNameWithPrefix(name, containerID, "SPF-")
+}
+
+// newSpoofCheck returns the spoof check of the container, filtering on
+// the checks enabled in the configuration. linkLocal are the link-local
+// addresses of the container interface, see linkLocalAddrs.
+func newSpoofCheck(n *NetConf, containerID, hostIface, mac string, ipcs []*current.IPConfig, linkLocal []net.IP) *spoofCheck {
+	sc := &spoofCheck{
+		chain:    spoofCheckChain(n.Name, containerID),
+		iface:    hostIface,
+		checkIPs: n.IPSpoofChk,
+	}
+	if n.MacSpoofChk {
+		sc.mac = mac
+	}
+	if n.IPSpoofChk {
+		for _, ipc := range ipcs {
+			sc.ips = append(sc.ips, ipc.Address.IP)
+		}
+		sc.linkLocal = linkLocal
+	}
+	return sc
+}
+
+// linkLocalAddrs returns the IPv6 link-local addresses the container may
+// send from on ifName: the EUI-64 address the kernel derives from the MAC,
+// and any other link-local address configured on the interface, such as
+// a stable-privacy one. It must be called in the container namespace.
+func linkLocalAddrs(ifName string) ([]net.IP, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of %q: %v", ifName, err)
+	}
+
+	lls := []net.IP{eui64LinkLocal(link.Attrs().HardwareAddr)}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() && !addr.IP.Equal(lls[0]) {
+			lls = append(lls, addr.IP)
+		}
+	}
+	return lls, nil
+}
+
+// eui64LinkLocal returns the link-local address with the modified EUI-64
+// interface identifier of the 48-bit mac (RFC 4291, appendix A).
+func eui64LinkLocal(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:11], mac[0:3])
+	ip[8] ^= 0x02
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:16], mac[3:6])
+	return ip
+}
+
+// rules returns the rules of the chain in nft syntax.
+func (sc *spoofCheck) rules() []string {
+	var rules []string
+	match := fmt.Sprintf("iifname %q", sc.iface)
+
+	if sc.mac != "" {
+		rules = append(rules,
+			fmt.Sprintf("%s ether saddr != %s drop", match, sc.mac),
+			fmt.Sprintf("%s ether type arp arp saddr ether != %s drop", match, sc.mac),
+		)
+	}
+
+	if sc.checkIPs {
+		// The unspecified address is the source of DHCP requests and
+		// DAD probes. Only the container's own link-local addresses are
+		// allowed, so that it cannot impersonate the link-local address
+		// of another container, e.g. to send router advertisements.
+		v4 := []string{"0.0.0.0"}
+		v6 := []string{"::"}
+		for _, ip := range sc.linkLocal {
+			v6 = append(v6, ip.String())
+		}
+		for _, ip := range sc.ips {
+			if ip.To4() != nil {
+				v4 = append(v4, ip.String())
+			} else {
+				v6 = append(v6, ip.String())
+			}
+		}
+		rules = append(rules,
+			fmt.Sprintf("%s ether type ip ip saddr != { %s } drop", match, strings.Join(v4, ", ")),
+			fmt.Sprintf("%s ether type arp arp saddr ip != { %s } drop", match, strings.Join(v4, ", ")),
+			fmt.Sprintf("%s ether type ip6 ip6 saddr != { %s } drop", match, strings.Join(v6, ", ")),
+		)
+	}
+
+	return rules
+}
+
+// setup installs the chain, replacing the rules if it already exists.
+func (sc *spoofCheck) setup() error {
+	script := []string{
+		fmt.Sprintf("add table bridge %s", spoofCheckTable),
+		fmt.Sprintf("add chain bridge %s %q { type filter hook prerouting priority -300 ; policy accept ; }", spoofCheckTable, sc.chain),
+		fmt.Sprintf("flush chain bridge %s %q", spoofCheckTable, sc.chain),
+	}
+	for _, rule := range sc.rules() {
+		script = append(script, fmt.Sprintf("add rule bridge %s %q %s", spoofCheckTable, sc.chain, rule))
+	}
+
+	if err := runNft(script); err != nil {
+		return fmt.Errorf("failed to set up spoof check chain %q: %v", sc.chain, err)
+	}
+	return nil
+}
+
+// teardownSpoofCheck deletes the chain, if it exists.
+func teardownSpoofCheck(chain string) error {
+	if err := deleteNftChain(spoofCheckTable, chain); err != nil {
+		return fmt.Errorf("failed to delete spoof check chain %q: %v", chain, err)
+	}
+	return nil
+}
+
+// check verifies that the chain exists and filters on the expected
+// interface, MAC and addresses.
+func (sc *spoofCheck) check() error {
+	resource := fmt.Sprintf("chain %q", sc.chain)
+
+	out, err := exec.Command("nft", "list", "chain", "bridge", spoofCheckTable, sc.chain).CombinedOutput()
+	if err != nil {
+		return utils.NewCheckError(resource, "failed to list spoof check chain %q: %v: %s", sc.chain, err, strings.TrimSpace(string(out)))
+	}
+
+	expected := []string{fmt.Sprintf("%q", sc.iface)}
+	if sc.mac != "" {
+		expected = append(expected, sc.mac)
+	}
+	for _, ip := range sc.ips {
+		expected = append(expected, ip.String())
+	}
+	for _, ip := range sc.linkLocal {
+		expected = append(expected, ip.String())
+	}
+	for _, s := range expected {
+		if !strings.Contains(string(out), s) {
+			return utils.NewCheckError(resource, "spoof check chain %q does not match %s", sc.chain, s)
+		}
+	}
+	return nil
+}
+
+// deleteNftChain deletes a chain of a bridge family table, if it exists.
+func deleteNftChain(table, chain string) error {
+	// Create the table and chain first so that deleting them cannot fail
+	// when they are already gone; the script is applied atomically.
+	return runNft([]string{
+		fmt.Sprintf("add table bridge %s", table),
+		fmt.Sprintf("add chain bridge %s %q", table, chain),
+		fmt.Sprintf("flush chain bridge %s %q", table, chain),
+		fmt.Sprintf("delete chain bridge %s %q", table, chain),
+	})
+}
+
+// runNft applies the commands as one nft transaction.
+func runNft(script []string) error {
+	cmd := exec.Command("nft", "-f", "/dev/stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(script, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
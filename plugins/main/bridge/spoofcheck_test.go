@@ -0,0 +1,66 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bridge spoof check", func() {
+	ipcs := []*current.IPConfig{
+		{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.1.2.3").To4(), Mask: net.CIDRMask(24, 32)}},
+		{Version: "6", Address: net.IPNet{IP: net.ParseIP("2001:db8::3"), Mask: net.CIDRMask(64, 128)}},
+	}
+
+	It("filters the source MAC with macspoofchk", func() {
+		n := &NetConf{NetConf: types.NetConf{Name: "testConfig"}, MacSpoofChk: true}
+		sc := newSpoofCheck(n, "dummy", "veth1234", "0a:58:0a:01:02:03", ipcs, nil)
+
+		Expect(sc.chain).To(Equal(spoofCheckChain("testConfig", "dummy")))
+		Expect(sc.rules()).To(Equal([]string{
+			`iifname "veth1234" ether saddr != 0a:58:0a:01:02:03 drop`,
+			`iifname "veth1234" ether type arp arp saddr ether != 0a:58:0a:01:02:03 drop`,
+		}))
+	})
+
+	It("filters the source addresses with ipspoofchk", func() {
+		n := &NetConf{NetConf: types.NetConf{Name: "testConfig"}, IPSpoofChk: true}
+		linkLocal := []net.IP{net.ParseIP("fe80::858:aff:fe01:203")}
+		sc := newSpoofCheck(n, "dummy", "veth1234", "0a:58:0a:01:02:03", ipcs, linkLocal)
+
+		Expect(sc.rules()).To(Equal([]string{
+			`iifname "veth1234" ether type ip ip saddr != { 0.0.0.0, 10.1.2.3 } drop`,
+			`iifname "veth1234" ether type arp arp saddr ip != { 0.0.0.0, 10.1.2.3 } drop`,
+			`iifname "veth1234" ether type ip6 ip6 saddr != { ::, fe80::858:aff:fe01:203, 2001:db8::3 } drop`,
+		}))
+	})
+
+	It("derives the EUI-64 link-local address from the MAC", func() {
+		mac, err := net.ParseMAC("0a:58:0a:01:02:03")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eui64LinkLocal(mac).String()).To(Equal("fe80::858:aff:fe01:203"))
+	})
+
+	It("uses a chain per container", func() {
+		Expect(spoofCheckChain("testConfig", "dummy")).To(HavePrefix("CNI-SPF-"))
+		Expect(spoofCheckChain("testConfig", "dummy")).NotTo(Equal(spoofCheckChain("testConfig", "dummy2")))
+	})
+})
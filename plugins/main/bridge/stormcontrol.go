@@ -0,0 +1,237 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// stormControlTable is the nftables table, in the bridge family, that
+// holds the storm control chains of all containers.
+const stormControlTable = "cni_stormcontrol"
+
+// knownSet is the set of the table with the MAC addresses that sent
+// frames through a bridge lately, which the bridge knows the ports of. It
+// is keyed by the bridge name, so that each bridge only knows its own
+// addresses. The learn chains of each bridge fill it in with the ageing
+// time of the bridges, after the container chains so that dropped frames
+// are not learned.
+const (
+	knownSet         = "known-by-bridge"
+	knownTimeout     = "5m"
+	learnChain       = "learn-"
+	learnOutputChain = "learn-output-"
+)
+
+// StormControl limits the flooded traffic a container sends into the
+// bridge. The rates are in packets per second; zero means no limit.
+type StormControl struct {
+	Broadcast      uint     `json:"broadcast,omitempty"`
+	Multicast      uint     `json:"multicast,omitempty"`
+	UnknownUnicast uint     `json:"unknownUnicast,omitempty"`
+	BlockedGroups  []string `json:"blockedGroups,omitempty"`
+}
+
+// validate checks that the blocked groups are multicast IP or MAC
+// addresses.
+func (s *StormControl) validate() error {
+	for _, group := range s.BlockedGroups {
+		if ip := net.ParseIP(group); ip != nil {
+			if !ip.IsMulticast() {
+				return fmt.Errorf("blocked group %s is not a multicast address", group)
+			}
+			continue
+		}
+		mac, err := net.ParseMAC(group)
+		if err != nil {
+			return fmt.Errorf("invalid blocked group %q", group)
+		}
+		if mac[0]&0x01 == 0 {
+			return fmt.Errorf("blocked group %s is not a multicast address", group)
+		}
+	}
+	return nil
+}
+
+// stormControl filters the frames a container sends into the bridge
+// through its host veth. Like the spoof check, each container gets a base
+// chain of its own on the bridge prerouting hook. It runs after the spoof
+// check, so that dropped frames do not count against the limits.
+type stormControl struct {
+	chain  string
+	iface  string
+	bridge string
+	conf   *StormControl
+}
+
+// stormControlChain returns the name of the chain of the container.
+func stormControlChain(name, containerID string) string {
+	return utils.FormatChainNameWithPrefix(name, containerID, "STM-")
+}
+
+func newStormControl(n *NetConf, containerID, hostIface string) *stormControl {
+	return &stormControl{
+		chain:  stormControlChain(n.Name, containerID),
+		iface:  hostIface,
+		bridge: n.BrName,
+		conf:   n.StormControl,
+	}
+}
+
+// rules returns the rules of the chain in nft syntax. Blocked groups are
+// dropped before the rate limits are applied.
+func (sc *stormControl) rules() []string {
+	var rules []string
+	match := fmt.Sprintf("iifname %q", sc.iface)
+
+	for _, group := range sc.conf.BlockedGroups {
+		ip := net.ParseIP(group)
+		switch {
+		case ip == nil:
+			mac, _ := net.ParseMAC(group)
+			rules = append(rules, fmt.Sprintf("%s ether daddr %s drop", match, mac))
+		case ip.To4() != nil:
+			rules = append(rules, fmt.Sprintf("%s ether type ip ip daddr %s drop", match, ip))
+		default:
+			rules = append(rules, fmt.Sprintf("%s ether type ip6 ip6 daddr %s drop", match, ip))
+		}
+	}
+
+	// Allow bursts of one second worth of packets. Unicast frames to
+	// another host are unknown unless their destination is in the set.
+	for _, limit := range []struct {
+		match string
+		rate  uint
+	}{
+		{"meta pkttype broadcast", sc.conf.Broadcast},
+		{"meta pkttype multicast", sc.conf.Multicast},
+		{fmt.Sprintf("meta pkttype otherhost meta ibrname . ether daddr != @%s", knownSet), sc.conf.UnknownUnicast},
+	} {
+		if limit.rate > 0 {
+			rules = append(rules, fmt.Sprintf("%s %s limit rate over %d/second burst %d packets drop",
+				match, limit.match, limit.rate, limit.rate))
+		}
+	}
+
+	return rules
+}
+
+// learnScript returns the nft commands that set up the set of known
+// addresses and the chains of the bridge that fill it in. The frames the
+// host sends through the bridge are learned on output, and the current
+// address of the bridge is added for good, as the bridge may not have sent
+// anything yet. The chains only match the frames of the bridge, so other
+// bridges on the host are left alone.
+func learnScript(bridge string, bridgeMAC net.HardwareAddr) []string {
+	script := []string{
+		fmt.Sprintf("add set bridge %s %s { type ifname . ether_addr ; flags dynamic,timeout ; }", stormControlTable, knownSet),
+		fmt.Sprintf("add element bridge %s %s { %q . %s }", stormControlTable, knownSet, bridge, bridgeMAC),
+	}
+	for _, chain := range []struct{ name, hook, key string }{
+		{learnChain + bridge, "prerouting", "ibrname"},
+		{learnOutputChain + bridge, "output", "obrname"},
+	} {
+		script = append(script,
+			fmt.Sprintf("add chain bridge %s %q { type filter hook %s priority -100 ; policy accept ; }", stormControlTable, chain.name, chain.hook),
+			fmt.Sprintf("flush chain bridge %s %q", stormControlTable, chain.name),
+			fmt.Sprintf("add rule bridge %s %q meta %s %q update @%s { meta %s . ether saddr timeout %s }",
+				stormControlTable, chain.name, chain.key, bridge, knownSet, chain.key, knownTimeout),
+		)
+	}
+	return script
+}
+
+// setup installs the chain, replacing the rules if it already exists. The
+// chain and, for the unknown unicast limit, the set of known addresses
+// are set up at once.
+func (sc *stormControl) setup() error {
+	rules := sc.rules()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	script := []string{fmt.Sprintf("add table bridge %s", stormControlTable)}
+	if sc.conf.UnknownUnicast > 0 {
+		br, err := netlink.LinkByName(sc.bridge)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", sc.bridge, err)
+		}
+		script = append(script, learnScript(sc.bridge, br.Attrs().HardwareAddr)...)
+	}
+	script = append(script,
+		fmt.Sprintf("add chain bridge %s %q { type filter hook prerouting priority -200 ; policy accept ; }", stormControlTable, sc.chain),
+		fmt.Sprintf("flush chain bridge %s %q", stormControlTable, sc.chain),
+	)
+	for _, rule := range rules {
+		script = append(script, fmt.Sprintf("add rule bridge %s %q %s", stormControlTable, sc.chain, rule))
+	}
+
+	if err := runNft(script); err != nil {
+		return fmt.Errorf("failed to set up storm control chain %q: %v", sc.chain, err)
+	}
+	return nil
+}
+
+// teardownStormControl deletes the chain, if it exists. The set of known
+// addresses and the learn chains are shared, and stay with the table.
+func teardownStormControl(chain string) error {
+	if err := deleteNftChain(stormControlTable, chain); err != nil {
+		return fmt.Errorf("failed to delete storm control chain %q: %v", chain, err)
+	}
+	return nil
+}
+
+// check verifies the chain.
+func (sc *stormControl) check() error {
+	if len(sc.rules()) == 0 {
+		return nil
+	}
+
+	resource := fmt.Sprintf("chain %q", sc.chain)
+	out, err := exec.Command("nft", "list", "chain", "bridge", stormControlTable, sc.chain).CombinedOutput()
+	if err != nil {
+		return utils.NewCheckError(resource, "failed to list storm control chain %q: %v: %s", sc.chain, err, strings.TrimSpace(string(out)))
+	}
+
+	expected := []string{fmt.Sprintf("%q", sc.iface)}
+	for _, group := range sc.conf.BlockedGroups {
+		if ip := net.ParseIP(group); ip != nil {
+			expected = append(expected, ip.String())
+		} else {
+			mac, _ := net.ParseMAC(group)
+			expected = append(expected, mac.String())
+		}
+	}
+	for _, rate := range []uint{sc.conf.Broadcast, sc.conf.Multicast, sc.conf.UnknownUnicast} {
+		if rate > 0 {
+			expected = append(expected, fmt.Sprintf("over %d/second", rate))
+		}
+	}
+	if sc.conf.UnknownUnicast > 0 {
+		expected = append(expected, "@"+knownSet)
+	}
+	for _, s := range expected {
+		if !strings.Contains(string(out), s) {
+			return utils.NewCheckError(resource, "storm control chain %q does not match %s", sc.chain, s)
+		}
+	}
+	return nil
+}
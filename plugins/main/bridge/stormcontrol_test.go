@@ -0,0 +1,96 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bridge storm control", func() {
+	It("limits broadcast and multicast and drops the blocked groups", func() {
+		n, _, err := loadNetConf([]byte(`{
+	"name": "testConfig",
+	"type": "bridge",
+	"stormControl": {
+		"broadcast": 100,
+		"multicast": 1000,
+		"blockedGroups": ["224.0.0.251", "FF02::FB", "01-00-5E-00-00-FC"]
+	}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		sc := newStormControl(n, "dummy", "veth1234")
+		Expect(sc.chain).To(Equal(stormControlChain("testConfig", "dummy")))
+		Expect(sc.rules()).To(Equal([]string{
+			`iifname "veth1234" ether type ip ip daddr 224.0.0.251 drop`,
+			`iifname "veth1234" ether type ip6 ip6 daddr ff02::fb drop`,
+			`iifname "veth1234" ether daddr 01:00:5e:00:00:fc drop`,
+			`iifname "veth1234" meta pkttype broadcast limit rate over 100/second burst 100 packets drop`,
+			`iifname "veth1234" meta pkttype multicast limit rate over 1000/second burst 1000 packets drop`,
+		}))
+	})
+
+	It("limits unicast to the destinations missing from the known set", func() {
+		n := &NetConf{NetConf: types.NetConf{Name: "testConfig"}, StormControl: &StormControl{UnknownUnicast: 50}}
+		Expect(newStormControl(n, "dummy", "veth1234").rules()).To(Equal([]string{
+			`iifname "veth1234" meta pkttype otherhost meta ibrname . ether daddr != @known-by-bridge limit rate over 50/second burst 50 packets drop`,
+		}))
+	})
+
+	It("needs no rules without limits or blocked groups", func() {
+		n := &NetConf{NetConf: types.NetConf{Name: "testConfig"}, StormControl: &StormControl{}}
+		Expect(newStormControl(n, "dummy", "veth1234").rules()).To(BeEmpty())
+	})
+
+	It("learns the senders and the bridge address of the bridge only", func() {
+		mac, err := net.ParseMAC("0a:58:0a:01:02:01")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(learnScript("cni0", mac)).To(Equal([]string{
+			"add set bridge cni_stormcontrol known-by-bridge { type ifname . ether_addr ; flags dynamic,timeout ; }",
+			`add element bridge cni_stormcontrol known-by-bridge { "cni0" . 0a:58:0a:01:02:01 }`,
+			`add chain bridge cni_stormcontrol "learn-cni0" { type filter hook prerouting priority -100 ; policy accept ; }`,
+			`flush chain bridge cni_stormcontrol "learn-cni0"`,
+			`add rule bridge cni_stormcontrol "learn-cni0" meta ibrname "cni0" update @known-by-bridge { meta ibrname . ether saddr timeout 5m }`,
+			`add chain bridge cni_stormcontrol "learn-output-cni0" { type filter hook output priority -100 ; policy accept ; }`,
+			`flush chain bridge cni_stormcontrol "learn-output-cni0"`,
+			`add rule bridge cni_stormcontrol "learn-output-cni0" meta obrname "cni0" update @known-by-bridge { meta obrname . ether saddr timeout 5m }`,
+		}))
+	})
+
+	It("rejects blocked groups that are not multicast", func() {
+		for group, msg := range map[string]string{
+			"10.0.0.1":          "invalid stormControl: blocked group 10.0.0.1 is not a multicast address",
+			"0a:58:0a:01:02:03": "invalid stormControl: blocked group 0a:58:0a:01:02:03 is not a multicast address",
+			"mdns":              `invalid stormControl: invalid blocked group "mdns"`,
+		} {
+			_, _, err := loadNetConf([]byte(`{
+	"name": "testConfig",
+	"type": "bridge",
+	"stormControl": {"blockedGroups": ["` + group + `"]}
+}`))
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("uses a chain per container", func() {
+		Expect(stormControlChain("testConfig", "dummy")).To(HavePrefix("CNI-STM-"))
+		Expect(stormControlChain("testConfig", "dummy")).NotTo(Equal(spoofCheckChain("testConfig", "dummy")))
+	})
+})
@@ -18,17 +18,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"path/filepath"
 	"runtime"
-	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/vishvananda/netlink"
 )
 
@@ -68,12 +67,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer containerNs.Close()
 
-	hostDev, err := getLink(cfg.Device, cfg.HWAddr, cfg.KernelPath)
+	hostDev, err := ip.FindLink(cfg.Device, cfg.HWAddr, cfg.KernelPath)
 	if err != nil {
 		return fmt.Errorf("failed to find host device: %v", err)
 	}
 
-	contDev, err := moveLinkIn(hostDev, containerNs, args.IfName)
+	contDev, err := ip.MoveLinkIn(hostDev, containerNs, args.IfName)
 	if err != nil {
 		return fmt.Errorf("failed to move link %v", err)
 	}
@@ -91,64 +90,41 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 	defer containerNs.Close()
 
-	if err := moveLinkOut(containerNs, args.IfName); err != nil {
+	if err := ip.MoveLinkOut(containerNs, args.IfName); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netlink.Link, error) {
-	if err := netlink.LinkSetNsFd(hostDev, int(containerNs.Fd())); err != nil {
-		return nil, err
-	}
-
-	var contDev netlink.Link
-	if err := containerNs.Do(func(_ ns.NetNS) error {
-		var err error
-		contDev, err = netlink.LinkByName(hostDev.Attrs().Name)
-		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", hostDev.Attrs().Name, err)
-		}
-		// Save host device name into the container device's alias property
-		if err := netlink.LinkSetAlias(contDev, hostDev.Attrs().Name); err != nil {
-			return fmt.Errorf("failed to set alias to %q: %v", hostDev.Attrs().Name, err)
-		}
-		// Rename container device to respect args.IfName
-		if err := netlink.LinkSetName(contDev, ifName); err != nil {
-			return fmt.Errorf("failed to rename device %q to %q: %v", hostDev.Attrs().Name, ifName, err)
-		}
-		// Retrieve link again to get up-to-date name and attributes
-		contDev, err = netlink.LinkByName(ifName)
-		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", ifName, err)
-		}
-		return nil
-	}); err != nil {
-		return nil, err
-	}
-
-	return contDev, nil
-}
-
-func moveLinkOut(containerNs ns.NetNS, ifName string) error {
-	defaultNs, err := ns.GetCurrentNS()
+func cmdCheck(args *skel.CmdArgs) error {
+	cfg, err := loadConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	defer defaultNs.Close()
+	containerNs, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer containerNs.Close()
 
 	return containerNs.Do(func(_ ns.NetNS) error {
-		dev, err := netlink.LinkByName(ifName)
+		dev, err := netlink.LinkByName(args.IfName)
 		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", ifName, err)
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "failed to find %q: %v", args.IfName, err)
 		}
-		// Rename device to it's original name
-		if err := netlink.LinkSetName(dev, dev.Attrs().Alias); err != nil {
-			return fmt.Errorf("failed to restore %q to original name %q: %v", ifName, dev.Attrs().Alias, err)
+		// The alias holds the name the device had on the host
+		if cfg.Device != "" && dev.Attrs().Alias != cfg.Device {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "interface %q is not host device %q", args.IfName, cfg.Device)
 		}
-		if err := netlink.LinkSetNsFd(dev, int(defaultNs.Fd())); err != nil {
-			return fmt.Errorf("failed to move %q to host netns: %v", dev.Attrs().Alias, err)
+		if cfg.HWAddr != "" {
+			hwAddr, err := net.ParseMAC(cfg.HWAddr)
+			if err != nil {
+				return fmt.Errorf("failed to parse MAC address %q: %v", cfg.HWAddr, err)
+			}
+			if !bytes.Equal(dev.Attrs().HardwareAddr, hwAddr) {
+				return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "interface %q has MAC %s, expected %s", args.IfName, dev.Attrs().HardwareAddr, hwAddr)
+			}
 		}
 		return nil
 	})
@@ -168,49 +144,6 @@ func printLink(dev netlink.Link, cniVersion string, containerNs ns.NetNS) error
 	return types.PrintResult(&result, cniVersion)
 }
 
-func getLink(devname, hwaddr, kernelpath string) (netlink.Link, error) {
-	links, err := netlink.LinkList()
-	if err != nil {
-		return nil, fmt.Errorf("failed to list node links: %v", err)
-	}
-
-	if len(devname) > 0 {
-		return netlink.LinkByName(devname)
-	} else if len(hwaddr) > 0 {
-		hwAddr, err := net.ParseMAC(hwaddr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse MAC address %q: %v", hwaddr, err)
-		}
-
-		for _, link := range links {
-			if bytes.Equal(link.Attrs().HardwareAddr, hwAddr) {
-				return link, nil
-			}
-		}
-	} else if len(kernelpath) > 0 {
-		if !filepath.IsAbs(kernelpath) || !strings.HasPrefix(kernelpath, "/sys/devices/") {
-			return nil, fmt.Errorf("kernel device path %q must be absolute and begin with /sys/devices/", kernelpath)
-		}
-		netDir := filepath.Join(kernelpath, "net")
-		files, err := ioutil.ReadDir(netDir)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find network devices at %q", netDir)
-		}
-
-		// Grab the first device from eg /sys/devices/pci0000:00/0000:00:19.0/net
-		for _, file := range files {
-			// Make sure it's really an interface
-			for _, l := range links {
-				if file.Name() == l.Attrs().Name {
-					return l, nil
-				}
-			}
-		}
-	}
-
-	return nil, fmt.Errorf("failed to find physical interface")
-}
-
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI host-device plugin")
 }
@@ -22,11 +22,13 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/vishvananda/netlink"
 )
 
@@ -50,13 +52,17 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func loadConf(bytes []byte) (*NetConf, string, error) {
+func loadConf(bytes []byte, cmdCheck bool) (*NetConf, string, error) {
 	n := &NetConf{}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
 	// Parse previous result
 	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
 		resultBytes, err := json.Marshal(n.RawPrevResult)
 		if err != nil {
 			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
@@ -71,7 +77,9 @@ func loadConf(bytes []byte) (*NetConf, string, error) {
 			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
 		}
 	}
-	if n.Master == "" {
+	// On CHECK, prevResult is this plugin's own result and cannot be
+	// used to pick the master
+	if n.Master == "" && !cmdCheck {
 		if n.PrevResult == nil {
 			return nil, "", fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 		}
@@ -156,7 +164,7 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	n, cniVersion, err := loadConf(args.StdinData)
+	n, cniVersion, err := loadConf(args.StdinData, false)
 	if err != nil {
 		return err
 	}
@@ -167,10 +175,19 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
 	ipvlanInterface, err := createIpvlan(n, args.IfName, netns)
 	if err != nil {
 		return err
 	}
+	undo.Push("delete link", func() error {
+		return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return ip.DelLinkByName(args.IfName)
+		})
+	})
 
 	var result *current.Result
 	// Configure iface from PrevResult if we have IPs and an IPAM
@@ -183,6 +200,10 @@ func cmdAdd(args *skel.CmdArgs) error {
 		if err != nil {
 			return err
 		}
+		undo.Push("release IPAM allocation", func() error {
+			return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		})
+
 		// Convert whatever the IPAM result was into the current Result type
 		result, err = current.NewResultFromResult(r)
 		if err != nil {
@@ -209,11 +230,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.DNS = n.DNS
 
+	undo.Commit()
 	return types.PrintResult(result, cniVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	n, _, err := loadConf(args.StdinData)
+	n, _, err := loadConf(args.StdinData, false)
 	if err != nil {
 		return err
 	}
@@ -244,6 +266,69 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData, true)
+	if err != nil {
+		return err
+	}
+
+	// On chained invocation, IPAM block can be empty
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	mode, err := modeFromString(n.Mode)
+	if err != nil {
+		return err
+	}
+
+	// A chained ipvlan takes its master from the previous plugin, which
+	// is not known here
+	masterIndex := -1
+	if n.Master != "" {
+		m, err := netlink.LinkByName(n.Master)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", n.Master), "failed to lookup master %q: %v", n.Master, err)
+		}
+		masterIndex = m.Attrs().Index
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "failed to find interface %q: %v", args.IfName, err)
+		}
+		ipv, ok := link.(*netlink.IPVlan)
+		if !ok {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "interface %q is not an ipvlan", args.IfName)
+		}
+		if masterIndex >= 0 && ipv.ParentIndex != masterIndex {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "ipvlan %q is not on master %q", args.IfName, n.Master)
+		}
+		if ipv.Mode != mode {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "ipvlan %q is not in mode %q", args.IfName, n.Mode)
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI ipvlan plugin")
 }
@@ -23,11 +23,13 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
@@ -42,6 +44,9 @@ type NetConf struct {
 	Master string `json:"master"`
 	Mode   string `json:"mode"`
 	MTU    int    `json:"mtu"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
 }
 
 func init() {
@@ -56,6 +61,26 @@ func loadConf(bytes []byte) (*NetConf, string, error) {
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
 	if n.Master == "" {
 		return nil, "", fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
@@ -156,32 +181,28 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
 	macvlanInterface, err := createMacvlan(n, args.IfName, netns)
 	if err != nil {
 		return err
 	}
-
-	// Delete link if err to avoid link leak in this ns
-	defer func() {
-		if err != nil {
-			netns.Do(func(_ ns.NetNS) error {
-				return ip.DelLinkByName(args.IfName)
-			})
-		}
-	}()
+	undo.Push("delete link", func() error {
+		return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return ip.DelLinkByName(args.IfName)
+		})
+	})
 
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
 	if err != nil {
 		return err
 	}
-
-	// Invoke ipam del if err to avoid ip leak
-	defer func() {
-		if err != nil {
-			ipam.ExecDel(n.IPAM.Type, args.StdinData)
-		}
-	}()
+	undo.Push("release IPAM allocation", func() error {
+		return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	})
 
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
@@ -222,6 +243,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.DNS = n.DNS
 
+	undo.Commit()
 	return types.PrintResult(result, cniVersion)
 }
 
@@ -254,6 +276,60 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	mode, err := modeFromString(n.Mode)
+	if err != nil {
+		return err
+	}
+
+	m, err := netlink.LinkByName(n.Master)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", n.Master), "failed to lookup master %q: %v", n.Master, err)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "failed to find interface %q: %v", args.IfName, err)
+		}
+		mv, ok := link.(*netlink.Macvlan)
+		if !ok {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "interface %q is not a macvlan", args.IfName)
+		}
+		if mv.ParentIndex != m.Attrs().Index {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "macvlan %q is not on master %q", args.IfName, n.Master)
+		}
+		if mv.Mode != mode {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "macvlan %q is not in mode %q", args.IfName, n.Mode)
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI macvlan plugin")
 }
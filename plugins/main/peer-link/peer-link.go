@@ -0,0 +1,530 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "main" plugin that links a container directly to another
+// network namespace with a veth pair, for sidecars that need a private
+// link the host cannot see. The peer is either a netns path, or a
+// container attached to the same network before, whose netns the plugin
+// recorded then.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+const defaultDataDir = "/var/lib/cni/peer-link"
+
+// Peer is the other end of the link. At most one of Netns and
+// ContainerID is set.
+type Peer struct {
+	Netns       string `json:"peerNetns,omitempty"`
+	ContainerID string `json:"peerContainerID,omitempty"`
+	IfName      string `json:"peerIfName,omitempty"`
+}
+
+type NetConf struct {
+	types.NetConf
+	Peer
+	MTU     int    `json:"mtu,omitempty"`
+	DataDir string `json:"dataDir,omitempty"`
+
+	RuntimeConfig struct {
+		Peer *Peer `json:"peerLink,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{
+		DataDir: defaultDataDir,
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	// The runtime config, if any, overrides the peer of the static one
+	if n.RuntimeConfig.Peer != nil {
+		n.Peer = *n.RuntimeConfig.Peer
+	}
+	if n.Peer.Netns != "" && n.Peer.ContainerID != "" {
+		return nil, "", fmt.Errorf("only one of peerNetns and peerContainerID may be specified")
+	}
+	if n.IPAM.Type == "" {
+		return nil, "", fmt.Errorf("ipam must be specified")
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+// peerIPAMID is the container ID the address of the peer end is allocated
+// under, so that it does not collide with the address of the container
+// end, even if both ends have the same name.
+func peerIPAMID(containerID string) string {
+	return containerID + "-peer"
+}
+
+// ipamArgs are the arguments of the IPAM plugin for one end of the link.
+// The rest of the environment, CNI_ARGS and CNI_PATH included, is inherited
+// from this invocation.
+type ipamArgs struct {
+	command     string
+	containerID string
+	netns       string
+	ifName      string
+}
+
+func (a *ipamArgs) AsEnv() []string {
+	return (&invoke.Args{
+		Command:       a.command,
+		ContainerID:   a.containerID,
+		NetNS:         a.netns,
+		IfName:        a.ifName,
+		PluginArgsStr: os.Getenv("CNI_ARGS"),
+		Path:          os.Getenv("CNI_PATH"),
+	}).AsEnv()
+}
+
+func execIPAM(n *NetConf, stdin []byte, args *ipamArgs) (*current.Result, error) {
+	pluginPath, err := invoke.FindInPath(n.IPAM.Type, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		return nil, err
+	}
+	if args.command != "ADD" {
+		return nil, invoke.ExecPluginWithoutResult(context.TODO(), pluginPath, stdin, args, nil)
+	}
+
+	r, err := invoke.ExecPluginWithResult(context.TODO(), pluginPath, stdin, args, nil)
+	if err != nil {
+		return nil, err
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.IPs) == 0 {
+		return nil, errors.New("IPAM plugin returned missing IP config")
+	}
+	return result, nil
+}
+
+// setupLink creates a veth pair between the two namespaces and returns
+// both ends.
+func setupLink(netns, peerNS ns.NetNS, ifName, peerIfName string, mtu int) (*current.Interface, *current.Interface, error) {
+	contIface := &current.Interface{Sandbox: netns.Path()}
+	peerIface := &current.Interface{Name: peerIfName, Sandbox: peerNS.Path()}
+
+	// Fail before creating the pair if the peer end cannot be renamed
+	if err := peerNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(peerIfName); err == nil {
+			return fmt.Errorf("interface %q already exists in %q", peerIfName, peerNS.Path())
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	var tmpName string
+	if err := netns.Do(func(_ ns.NetNS) error {
+		peerVeth, contVeth, err := ip.SetupVeth(ifName, mtu, peerNS)
+		if err != nil {
+			return err
+		}
+		contIface.Name = contVeth.Name
+		contIface.Mac = contVeth.HardwareAddr.String()
+		tmpName = peerVeth.Name
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	if err := peerNS.Do(func(_ ns.NetNS) error {
+		peerVeth, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+		}
+		// A link must be down to be renamed
+		if err := netlink.LinkSetDown(peerVeth); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", tmpName, err)
+		}
+		if err := netlink.LinkSetName(peerVeth, peerIfName); err != nil {
+			return fmt.Errorf("failed to rename %q to %q: %v", tmpName, peerIfName, err)
+		}
+		if err := netlink.LinkSetUp(peerVeth); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", peerIfName, err)
+		}
+		peerIface.Mac = peerVeth.Attrs().HardwareAddr.String()
+		return nil
+	}); err != nil {
+		_ = netns.Do(func(_ ns.NetNS) error {
+			return ip.DelLinkByName(ifName)
+		})
+		return nil, nil, err
+	}
+
+	return contIface, peerIface, nil
+}
+
+// configureEnd sets the addresses and routes from IPAM on one end of the
+// link.
+func configureEnd(netns ns.NetNS, iface *current.Interface, result *current.Result) error {
+	result.Interfaces = []*current.Interface{iface}
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(0)
+	}
+	return netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIface(iface.Name, result)
+	})
+}
+
+// deleteLink deletes the veth pair. Deleting either end deletes the pair,
+// and the pair goes away with either namespace, so it is only an error if
+// an end exists and cannot be deleted.
+func deleteLink(l *link) error {
+	for _, end := range []struct{ netns, ifName string }{
+		{l.Netns, l.IfName},
+		{l.PeerNetns, l.PeerIfName},
+	} {
+		err := ns.WithNetNSPath(end.netns, func(_ ns.NetNS) error {
+			return ip.DelLinkByName(end.ifName)
+		})
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(ns.NSPathNotExistErr); !ok && err != ip.ErrLinkNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownLink deletes the veth pair and releases the addresses of both
+// ends.
+func teardownLink(n *NetConf, stdin []byte, l *link) error {
+	if err := deleteLink(l); err != nil {
+		return err
+	}
+	if _, err := execIPAM(n, stdin, &ipamArgs{"DEL", l.ContainerID, l.Netns, l.IfName}); err != nil {
+		return err
+	}
+	_, err := execIPAM(n, stdin, &ipamArgs{"DEL", peerIPAMID(l.ContainerID), l.PeerNetns, l.PeerIfName})
+	return err
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockNetwork(n.DataDir, n.Name)
+	if err != nil {
+		return fmt.Errorf("failed to lock network %q: %v", n.Name, err)
+	}
+	defer lock.Close()
+
+	ep := &endpoint{Netns: args.Netns, IfName: args.IfName}
+	if n.Peer.Netns == "" && n.Peer.ContainerID == "" {
+		// There is nothing to link to yet; the link is created when a
+		// container names this one as its peer
+		if err := saveEndpoint(n.DataDir, n.Name, args.ContainerID, ep); err != nil {
+			return fmt.Errorf("failed to save endpoint: %v", err)
+		}
+		return types.PrintResult(&current.Result{CNIVersion: cniVersion, DNS: n.DNS}, cniVersion)
+	}
+
+	l := &link{
+		ContainerID:     args.ContainerID,
+		Netns:           args.Netns,
+		IfName:          args.IfName,
+		PeerContainerID: n.Peer.ContainerID,
+		PeerNetns:       n.Peer.Netns,
+		PeerIfName:      n.Peer.IfName,
+	}
+	if l.PeerIfName == "" {
+		l.PeerIfName = args.IfName
+	}
+
+	var peerEp *endpoint
+	if l.PeerContainerID != "" {
+		peerEp, err = loadEndpoint(n.DataDir, n.Name, l.PeerContainerID)
+		if err != nil {
+			return err
+		}
+		if peerEp == nil {
+			return fmt.Errorf("container %q is not attached to network %q", l.PeerContainerID, n.Name)
+		}
+		if peerEp.Link != nil {
+			return fmt.Errorf("container %q is already linked", l.PeerContainerID)
+		}
+		l.PeerNetns = peerEp.Netns
+	}
+	if l.PeerNetns == args.Netns {
+		return fmt.Errorf("the peer must be in another network namespace")
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	peerNS, err := ns.GetNS(l.PeerNetns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", l.PeerNetns, err)
+	}
+	defer peerNS.Close()
+
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	contIface, peerIface, err := setupLink(netns, peerNS, args.IfName, l.PeerIfName, n.MTU)
+	if err != nil {
+		return err
+	}
+	undo.Push("delete link", func() error {
+		return deleteLink(l)
+	})
+
+	contResult, err := execIPAM(n, args.StdinData, &ipamArgs{"ADD", l.ContainerID, l.Netns, l.IfName})
+	if err != nil {
+		return err
+	}
+	undo.Push("release IPAM allocation", func() error {
+		_, err := execIPAM(n, args.StdinData, &ipamArgs{"DEL", l.ContainerID, l.Netns, l.IfName})
+		return err
+	})
+
+	peerResult, err := execIPAM(n, args.StdinData, &ipamArgs{"ADD", peerIPAMID(l.ContainerID), l.PeerNetns, l.PeerIfName})
+	if err != nil {
+		return err
+	}
+	undo.Push("release peer IPAM allocation", func() error {
+		_, err := execIPAM(n, args.StdinData, &ipamArgs{"DEL", peerIPAMID(l.ContainerID), l.PeerNetns, l.PeerIfName})
+		return err
+	})
+
+	if err := configureEnd(netns, contIface, contResult); err != nil {
+		return err
+	}
+	if err := configureEnd(peerNS, peerIface, peerResult); err != nil {
+		return err
+	}
+
+	ep.Link = l
+	if err := saveEndpoint(n.DataDir, n.Name, args.ContainerID, ep); err != nil {
+		return fmt.Errorf("failed to save endpoint: %v", err)
+	}
+	undo.Push("remove endpoint", func() error {
+		return removeEndpoint(n.DataDir, n.Name, args.ContainerID)
+	})
+	if peerEp != nil {
+		peerEp.Link = l
+		if err := saveEndpoint(n.DataDir, n.Name, l.PeerContainerID, peerEp); err != nil {
+			return fmt.Errorf("failed to save endpoint: %v", err)
+		}
+	}
+
+	// The container end comes first; the addresses of the peer end are
+	// reported too, on the second interface
+	result := contResult
+	result.Interfaces = []*current.Interface{contIface, peerIface}
+	for _, ipc := range peerResult.IPs {
+		ipc.Interface = current.Int(1)
+		result.IPs = append(result.IPs, ipc)
+	}
+	result.DNS = n.DNS
+
+	undo.Commit()
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockNetwork(n.DataDir, n.Name)
+	if err != nil {
+		return fmt.Errorf("failed to lock network %q: %v", n.Name, err)
+	}
+	defer lock.Close()
+
+	ep, err := loadEndpoint(n.DataDir, n.Name, args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if ep == nil {
+		// Never added, or already deleted
+		return nil
+	}
+
+	if l := ep.Link; l != nil {
+		if err := teardownLink(n, args.StdinData, l); err != nil {
+			return err
+		}
+
+		// Forget the link at the other end, which stays attached and can
+		// be linked again
+		other := l.PeerContainerID
+		if other == args.ContainerID {
+			other = l.ContainerID
+		}
+		if other != "" {
+			otherEp, err := loadEndpoint(n.DataDir, n.Name, other)
+			if err != nil {
+				return err
+			}
+			if otherEp != nil {
+				otherEp.Link = nil
+				if err := saveEndpoint(n.DataDir, n.Name, other, otherEp); err != nil {
+					return fmt.Errorf("failed to save endpoint: %v", err)
+				}
+			}
+		}
+	}
+
+	return removeEndpoint(n.DataDir, n.Name, args.ContainerID)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockNetwork(n.DataDir, n.Name)
+	if err != nil {
+		return fmt.Errorf("failed to lock network %q: %v", n.Name, err)
+	}
+	defer lock.Close()
+
+	ep, err := loadEndpoint(n.DataDir, n.Name, args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if ep == nil {
+		return fmt.Errorf("container %q is not attached to network %q", args.ContainerID, n.Name)
+	}
+	l := ep.Link
+	if l == nil {
+		// A registered container has no interfaces
+		if n.PrevResult != nil && len(n.PrevResult.Interfaces) > 0 {
+			return utils.NewCheckError(fmt.Sprintf("container %q", args.ContainerID), "container %q is not linked", args.ContainerID)
+		}
+		return nil
+	}
+
+	if _, err := execIPAM(n, args.StdinData, &ipamArgs{"CHECK", l.ContainerID, l.Netns, l.IfName}); err != nil {
+		return err
+	}
+	if _, err := execIPAM(n, args.StdinData, &ipamArgs{"CHECK", peerIPAMID(l.ContainerID), l.PeerNetns, l.PeerIfName}); err != nil {
+		return err
+	}
+
+	var peerIndex int
+	if err := ns.WithNetNSPath(l.Netns, func(_ ns.NetNS) error {
+		_, peer, err := ip.GetVethPeerIfindex(l.IfName)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", l.IfName), "%v", err)
+		}
+		peerIndex = peer
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := ns.WithNetNSPath(l.PeerNetns, func(_ ns.NetNS) error {
+		peerVeth, err := netlink.LinkByName(l.PeerIfName)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", l.PeerIfName), "failed to find peer end %q: %v", l.PeerIfName, err)
+		}
+		if peerVeth.Attrs().Index != peerIndex {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", l.PeerIfName), "%q is not the peer of %q", l.PeerIfName, l.IfName)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Only the ADD that created the link has addresses in its result
+	if n.PrevResult != nil {
+		for i, iface := range n.PrevResult.Interfaces {
+			var ipcs []*current.IPConfig
+			for _, ipc := range n.PrevResult.IPs {
+				if ipc.Interface != nil && *ipc.Interface == i {
+					ipcs = append(ipcs, ipc)
+				}
+			}
+			if err := ns.WithNetNSPath(iface.Sandbox, func(_ ns.NetNS) error {
+				return ip.ValidateExpectedInterfaceIPs(iface.Name, ipcs)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI peer-link plugin")
+}
@@ -0,0 +1,324 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("peer-link configuration", func() {
+	It("uses the peer of the runtime config", func() {
+		n, _, err := loadConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "sidecar",
+	"type": "peer-link",
+	"peerNetns": "/var/run/netns/static",
+	"ipam": {"type": "host-local"},
+	"runtimeConfig": {
+		"peerLink": {"peerContainerID": "app", "peerIfName": "link0"}
+	}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Peer).To(Equal(Peer{ContainerID: "app", IfName: "link0"}))
+		Expect(n.DataDir).To(Equal(defaultDataDir))
+	})
+
+	It("rejects both a peer netns and a peer container", func() {
+		_, _, err := loadConf([]byte(`{
+	"name": "sidecar",
+	"type": "peer-link",
+	"peerNetns": "/var/run/netns/app",
+	"peerContainerID": "app",
+	"ipam": {"type": "host-local"}
+}`))
+		Expect(err).To(MatchError("only one of peerNetns and peerContainerID may be specified"))
+	})
+
+	It("requires ipam", func() {
+		_, _, err := loadConf([]byte(`{"name": "sidecar", "type": "peer-link"}`))
+		Expect(err).To(MatchError("ipam must be specified"))
+	})
+
+	It("replaces the arguments of this invocation for IPAM", func() {
+		os.Setenv("CNI_IFNAME", "eth0")
+		defer os.Unsetenv("CNI_IFNAME")
+
+		env := (&ipamArgs{"DEL", "dummy-peer", "/var/run/netns/app", "eth1"}).AsEnv()
+		var ifNames []string
+		for _, kv := range env {
+			if strings.HasPrefix(kv, "CNI_IFNAME=") {
+				ifNames = append(ifNames, kv)
+			}
+		}
+		Expect(ifNames).To(Equal([]string{"CNI_IFNAME=eth1"}))
+		Expect(env).To(ContainElement("CNI_CONTAINERID=dummy-peer"))
+		Expect(env).To(ContainElement("CNI_COMMAND=DEL"))
+	})
+})
+
+var _ = Describe("peer-link state", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "peer-link")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("saves, loads and removes endpoints", func() {
+		ep := &endpoint{
+			Netns:  "/var/run/netns/app",
+			IfName: "eth1",
+			Link: &link{
+				ContainerID:     "sidecar",
+				Netns:           "/var/run/netns/sidecar",
+				IfName:          "eth1",
+				PeerContainerID: "app",
+				PeerNetns:       "/var/run/netns/app",
+				PeerIfName:      "eth1",
+			},
+		}
+		Expect(saveEndpoint(dataDir, "test", "app", ep)).To(Succeed())
+
+		loaded, err := loadEndpoint(dataDir, "test", "app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(Equal(ep))
+
+		Expect(removeEndpoint(dataDir, "test", "app")).To(Succeed())
+		loaded, err = loadEndpoint(dataDir, "test", "app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(BeNil())
+
+		// Removing is idempotent
+		Expect(removeEndpoint(dataDir, "test", "app")).To(Succeed())
+	})
+})
+
+var _ = Describe("peer-link plugin", func() {
+	var originalNS, appNS, sidecarNS ns.NetNS
+	var dataDir string
+	const IFNAME string = "eth1"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		appNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		sidecarNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		dataDir, err = ioutil.TempDir("", "peer-link")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(appNS.Close()).To(Succeed())
+		Expect(sidecarNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	netConf := func(peer string) []byte {
+		return []byte(fmt.Sprintf(`{
+	"cniVersion": "0.4.0",
+	"name": "sidecar",
+	"type": "peer-link",
+	"dataDir": "%s/state",
+	%s
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24",
+		"dataDir": "%s/ipam"
+	}
+}`, dataDir, peer, dataDir))
+	}
+
+	It("registers a container without a peer", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "app",
+			Netns:       appNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   netConf(""),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(appNS.Path(), IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(BeEmpty())
+
+			ep, err := loadEndpoint(dataDir+"/state", "sidecar", "app")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ep).To(Equal(&endpoint{Netns: appNS.Path(), IfName: IFNAME}))
+
+			checkArgs := *args
+			checkArgs.StdinData = netConf(`"prevResult": {"cniVersion": "0.4.0"},`)
+			err = testutils.CmdCheckWithResult(appNS.Path(), IFNAME, func() error {
+				return cmdCheck(&checkArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// A result with interfaces needs a link
+			checkArgs.StdinData = netConf(`"prevResult": {"cniVersion": "0.4.0", "interfaces": [{"name": "eth0", "sandbox": "` + appNS.Path() + `"}]},`)
+			err = testutils.CmdCheckWithResult(appNS.Path(), IFNAME, func() error {
+				return cmdCheck(&checkArgs)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(`container "app"`))
+
+			err = testutils.CmdDelWithResult(appNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			ep, err = loadEndpoint(dataDir+"/state", "sidecar", "app")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ep).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("refuses a peer container that is not attached", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "sidecar",
+			Netns:       sidecarNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   netConf(`"peerContainerID": "app",`),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(sidecarNS.Path(), IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(`container "app" is not attached to network "sidecar"`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("links two containers with ADD and deletes the link with the DEL of either", func() {
+		appArgs := &skel.CmdArgs{
+			ContainerID: "app",
+			Netns:       appNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   netConf(""),
+		}
+		sidecarArgs := &skel.CmdArgs{
+			ContainerID: "sidecar",
+			Netns:       sidecarNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   netConf(`"peerContainerID": "app",`),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(appNS.Path(), IFNAME, appArgs.StdinData, func() error {
+				return cmdAdd(appArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			r, _, err := testutils.CmdAddWithResult(sidecarNS.Path(), IFNAME, sidecarArgs.StdinData, func() error {
+				return cmdAdd(sidecarArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.Interfaces[0].Sandbox).To(Equal(sidecarNS.Path()))
+			Expect(result.Interfaces[1].Sandbox).To(Equal(appNS.Path()))
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(*result.IPs[1].Interface).To(Equal(1))
+
+			err = testutils.CmdCheckWithResult(sidecarNS.Path(), IFNAME, func() error {
+				return cmdCheck(sidecarArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, netns := range []ns.NetNS{appNS, sidecarNS} {
+			err = netns.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Type()).To(Equal("veth"))
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		// The DEL of the registered side deletes the link too
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithResult(appNS.Path(), IFNAME, func() error {
+				return cmdDel(appArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ep, err := loadEndpoint(dataDir+"/state", "sidecar", "sidecar")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ep.Link).To(BeNil())
+
+			err = testutils.CmdDelWithResult(sidecarNS.Path(), IFNAME, func() error {
+				return cmdDel(sidecarArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sidecarNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
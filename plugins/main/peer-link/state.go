@@ -0,0 +1,102 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// endpoint is what the plugin keeps about a container on the network.
+type endpoint struct {
+	Netns  string `json:"netns"`
+	IfName string `json:"ifName"`
+	Link   *link  `json:"link,omitempty"`
+}
+
+// link is a veth pair, created by the ADD of the container that names the
+// peer. It is recorded with both containers, so that the DEL of either one
+// deletes it.
+type link struct {
+	ContainerID     string `json:"containerID"`
+	Netns           string `json:"netns"`
+	IfName          string `json:"ifName"`
+	PeerContainerID string `json:"peerContainerID,omitempty"`
+	PeerNetns       string `json:"peerNetns"`
+	PeerIfName      string `json:"peerIfName"`
+}
+
+// lockNetwork takes the lock of the state of the network. An ADD may update
+// the endpoint of its peer, so the endpoints of a network are read and
+// written under one lock.
+func lockNetwork(dataDir, network string) (*filemutex.FileMutex, error) {
+	dir := filepath.Join(dataDir, network)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := filemutex.New(filepath.Join(dir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Lock(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+func endpointPath(dataDir, network, containerID string) string {
+	return filepath.Join(dataDir, network, containerID)
+}
+
+// loadEndpoint returns the endpoint of the container, or nil if the
+// container is not attached to the network.
+func loadEndpoint(dataDir, network, containerID string) (*endpoint, error) {
+	data, err := ioutil.ReadFile(endpointPath(dataDir, network, containerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ep := &endpoint{}
+	if err := json.Unmarshal(data, ep); err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint of container %q: %v", containerID, err)
+	}
+	return ep, nil
+}
+
+func saveEndpoint(dataDir, network, containerID string, ep *endpoint) error {
+	if err := os.MkdirAll(filepath.Join(dataDir, network), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(endpointPath(dataDir, network, containerID), data, 0600)
+}
+
+func removeEndpoint(dataDir, network, containerID string) error {
+	if err := os.Remove(endpointPath(dataDir, network, containerID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -24,11 +24,12 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
 	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
@@ -45,9 +46,40 @@ type NetConf struct {
 	types.NetConf
 	IPMasq bool `json:"ipMasq"`
 	MTU    int  `json:"mtu"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
 }
 
-func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Result) (*current.Interface, *current.Interface, error) {
+func loadConf(bytes []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Parse previous result, which is passed in on CHECK
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*conf.RawPrevResult)["cniVersion"]; !ok {
+			(*conf.RawPrevResult)["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+	return conf, nil
+}
+
+func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Result, undo *rollback.Stack) (*current.Interface, *current.Interface, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24, GW=192.168.3.1.
 	// What we want is really a point-to-point link but veth does not support IFF_POINTOPONT.
 	// Next best thing would be to let it ARP but set interface to 192.168.3.5/32 and
@@ -67,6 +99,11 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 		if err != nil {
 			return err
 		}
+		undo.Push("delete link", func() error {
+			return ns.WithNetNSPath(netns.Path(), func(_ ns.NetNS) error {
+				return ip.DelLinkByName(ifName)
+			})
+		})
 		hostInterface.Name = hostVeth.Name
 		hostInterface.Mac = hostVeth.HardwareAddr.String()
 		containerInterface.Name = contVeth0.Name
@@ -187,16 +224,24 @@ func setupHostVeth(vethName string, result *current.Result) error {
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	conf := NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
 	if err != nil {
 		return err
 	}
+	undo.Push("release IPAM allocation", func() error {
+		return ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+	})
+
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
 	if err != nil {
@@ -217,7 +262,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupContainerVeth(netns, args.IfName, conf.MTU, result)
+	hostInterface, containerInterface, err := setupContainerVeth(netns, args.IfName, conf.MTU, result, &undo)
 	if err != nil {
 		return err
 	}
@@ -230,22 +275,27 @@ func cmdAdd(args *skel.CmdArgs) error {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
+			ipn := &ipc.Address
+			if err = ip.SetupIPMasq(ipn, chain, comment); err != nil {
 				return err
 			}
+			undo.Push("teardown ip masquerade", func() error {
+				return ip.TeardownIPMasq(ipn, chain, comment)
+			})
 		}
 	}
 
 	result.DNS = conf.DNS
 	result.Interfaces = []*current.Interface{hostInterface, containerInterface}
 
+	undo.Commit()
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	conf := NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
 	if err := ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
@@ -260,7 +310,7 @@ func cmdDel(args *skel.CmdArgs) error {
 	// so don't return an error if the device is already removed.
 	// If the device isn't there then don't try to clean up IP masq either.
 	var ipnets []*net.IPNet
-	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		var err error
 		ipnets, err = ip.DelLinkByNameAddr(args.IfName)
 		if err != nil && err == ip.ErrLinkNotFound {
@@ -284,6 +334,63 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecCheck(conf.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := conf.PrevResult
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	var peerIndex int
+	if err := netns.Do(func(_ ns.NetNS) error {
+		_, peer, err := ip.GetVethPeerIfindex(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "%v", err)
+		}
+		peerIndex = peer
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	}); err != nil {
+		return err
+	}
+
+	// The host veth carries each gateway address and a host route back
+	// to the container address
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("veth peer of %q", args.IfName), "failed to find host veth of %q: %v", args.IfName, err)
+	}
+	gwIPs := make([]*current.IPConfig, 0, len(result.IPs))
+	for _, ipc := range result.IPs {
+		maskLen := 128
+		if ipc.Address.IP.To4() != nil {
+			maskLen = 32
+		}
+		gwIPs = append(gwIPs, &current.IPConfig{
+			Version: ipc.Version,
+			Address: net.IPNet{IP: ipc.Gateway, Mask: net.CIDRMask(maskLen, maskLen)},
+		})
+	}
+	return ip.ValidateExpectedInterfaceIPs(hostVeth.Attrs().Name, gwIPs)
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI ptp plugin")
 }
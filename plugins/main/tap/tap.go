@@ -0,0 +1,439 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+)
+
+// iffMultiQueue is IFF_MULTI_QUEUE from linux/if_tun.h, which the syscall
+// package does not define.
+const iffMultiQueue = 0x0100
+
+type NetConf struct {
+	types.NetConf
+	MTU        int    `json:"mtu"`
+	MultiQueue bool   `json:"multiQueue"`
+	Owner      *int   `json:"owner,omitempty"`
+	Group      *int   `json:"group,omitempty"`
+	Bridge     string `json:"bridge,omitempty"`
+	// The addresses are handed out to the VM behind the tap, e.g. by the
+	// dhcp plugin in server mode, rather than set in the container
+	VMAddresses bool `json:"vmAddresses,omitempty"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+}
+
+// ifReq is struct ifreq as used by the tun ioctls.
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	pad   [40 - syscall.IFNAMSIZ - 2]byte
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+	if n.Owner != nil && *n.Owner < 0 {
+		return nil, "", fmt.Errorf("invalid owner %d", *n.Owner)
+	}
+	if n.Group != nil && *n.Group < 0 {
+		return nil, "", fmt.Errorf("invalid group %d", *n.Group)
+	}
+	return n, n.CNIVersion, nil
+}
+
+func tunIoctl(fd uintptr, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// createTap creates a persistent tap device in the current namespace. The
+// vendored netlink cannot set the owner, group or multi-queue flag, so the
+// tun ioctls are issued directly.
+func createTap(conf *NetConf, ifName string) error {
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open /dev/net/tun: %v", err)
+	}
+	defer file.Close()
+
+	var req ifReq
+	copy(req.Name[:syscall.IFNAMSIZ-1], ifName)
+	req.Flags = syscall.IFF_TAP | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR
+	if conf.MultiQueue {
+		req.Flags |= iffMultiQueue
+	} else {
+		req.Flags |= syscall.IFF_ONE_QUEUE
+	}
+
+	fd := file.Fd()
+	if err := tunIoctl(fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		return fmt.Errorf("failed to create tap %q: %v", ifName, err)
+	}
+	if conf.Owner != nil {
+		if err := tunIoctl(fd, syscall.TUNSETOWNER, uintptr(*conf.Owner)); err != nil {
+			return fmt.Errorf("failed to set owner of %q: %v", ifName, err)
+		}
+	}
+	if conf.Group != nil {
+		if err := tunIoctl(fd, syscall.TUNSETGROUP, uintptr(*conf.Group)); err != nil {
+			return fmt.Errorf("failed to set group of %q: %v", ifName, err)
+		}
+	}
+	if err := tunIoctl(fd, syscall.TUNSETPERSIST, 1); err != nil {
+		return fmt.Errorf("failed to make %q persistent: %v", ifName, err)
+	}
+	return nil
+}
+
+// ensureBridge returns the named bridge in the current namespace, creating
+// it if needed.
+func ensureBridge(brName string, mtu int) (netlink.Link, error) {
+	br, err := netlink.LinkByName(brName)
+	if err == nil {
+		if _, ok := br.(*netlink.Bridge); !ok {
+			return nil, fmt.Errorf("%q already exists but is not a bridge", brName)
+		}
+		return br, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, fmt.Errorf("failed to lookup %q: %v", brName, err)
+	}
+
+	br = &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: brName,
+			MTU:  mtu,
+		},
+	}
+	if err := netlink.LinkAdd(br); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", brName, err)
+	}
+
+	// Re-fetch the link to read all attributes
+	br, err = netlink.LinkByName(brName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", brName, err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", brName, err)
+	}
+	return br, nil
+}
+
+// setupTap creates the tap, and the bridge if one is configured, in the
+// container namespace and returns their result interfaces. The tap is
+// deleted again if a later step fails.
+func setupTap(conf *NetConf, ifName string, netns ns.NetNS) ([]*current.Interface, error) {
+	var ifaces []*current.Interface
+
+	err := netns.Do(func(_ ns.NetNS) (err error) {
+		// TUNSETIFF attaches to an existing tap of the same name, which
+		// is not ours to configure or delete
+		if _, err := netlink.LinkByName(ifName); err == nil {
+			return fmt.Errorf("interface %q already exists", ifName)
+		}
+		if err := createTap(conf, ifName); err != nil {
+			return err
+		}
+
+		// The tap exists from here on. A failed create leaves nothing
+		// behind, as the tap is only persistent once it is complete.
+		defer func() {
+			if err != nil {
+				_ = ip.DelLinkByName(ifName)
+			}
+		}()
+
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch tap %q: %v", ifName, err)
+		}
+		if conf.MTU != 0 {
+			if err := netlink.LinkSetMTU(link, conf.MTU); err != nil {
+				return fmt.Errorf("failed to set MTU of %q: %v", ifName, err)
+			}
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+		ifaces = append(ifaces, &current.Interface{
+			Name:    ifName,
+			Mac:     link.Attrs().HardwareAddr.String(),
+			Sandbox: netns.Path(),
+		})
+
+		if conf.Bridge != "" {
+			br, err := ensureBridge(conf.Bridge, conf.MTU)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetMasterByIndex(link, br.Attrs().Index); err != nil {
+				return fmt.Errorf("failed to connect %q to bridge %q: %v", ifName, conf.Bridge, err)
+			}
+			ifaces = append(ifaces, &current.Interface{
+				Name:    br.Attrs().Name,
+				Mac:     br.Attrs().HardwareAddr.String(),
+				Sandbox: netns.Path(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ifaces, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	ifaces, err := setupTap(n, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+	undo.Push("delete link", func() error {
+		return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return ip.DelLinkByName(args.IfName)
+		})
+	})
+
+	result := &current.Result{Interfaces: ifaces}
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+		undo.Push("release IPAM allocation", func() error {
+			return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		})
+
+		// Convert whatever the IPAM result was into the current Result type
+		ipamResult, err := current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			return errors.New("IPAM plugin returned missing IP config")
+		}
+
+		// The addresses go on the bridge if there is one, as an
+		// enslaved tap cannot use them. The addresses handed out to the
+		// VM are only reported, on the tap the VM is behind.
+		addrIdx := len(ifaces) - 1
+		if n.VMAddresses {
+			addrIdx = 0
+		}
+		for _, ipc := range ipamResult.IPs {
+			ipc.Interface = current.Int(addrIdx)
+		}
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		addrIface := ifaces[addrIdx].Name
+		if !n.VMAddresses {
+			err = netns.Do(func(_ ns.NetNS) error {
+				if err := ipam.ConfigureIface(addrIface, result); err != nil {
+					return err
+				}
+
+				contIface, err := net.InterfaceByName(addrIface)
+				if err != nil {
+					return fmt.Errorf("failed to look up %q: %v", addrIface, err)
+				}
+
+				for _, ipc := range result.IPs {
+					if ipc.Version == "4" {
+						_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contIface)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	result.DNS = n.DNS
+
+	undo.Commit()
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	// The bridge may be shared with other taps and is left alone.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		resource := fmt.Sprintf("interface %q", args.IfName)
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(resource, "failed to find interface %q: %v", args.IfName, err)
+		}
+		if link.Type() != "tun" {
+			return utils.NewCheckError(resource, "interface %q is not a tap", args.IfName)
+		}
+		if n.MTU != 0 && link.Attrs().MTU != n.MTU {
+			return utils.NewCheckError(resource, "tap %q has MTU %d, expected %d", args.IfName, link.Attrs().MTU, n.MTU)
+		}
+
+		addrIface := args.IfName
+		if n.Bridge != "" {
+			br, err := netlink.LinkByName(n.Bridge)
+			if err != nil {
+				return utils.NewCheckError(fmt.Sprintf("bridge %q", n.Bridge), "failed to find bridge %q: %v", n.Bridge, err)
+			}
+			if link.Attrs().MasterIndex != br.Attrs().Index {
+				return utils.NewCheckError(resource, "tap %q is not attached to bridge %q", args.IfName, n.Bridge)
+			}
+			addrIface = n.Bridge
+		}
+
+		if n.VMAddresses {
+			// The addresses and routes are the VM's
+			return nil
+		}
+		if err := ip.ValidateExpectedInterfaceIPs(addrIface, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI tap plugin")
+}
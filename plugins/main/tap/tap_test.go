@@ -0,0 +1,218 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tap configuration", func() {
+	It("parses owner, group and multi-queue", func() {
+		n, _, err := loadConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "vm",
+	"type": "tap",
+	"owner": 0,
+	"group": 107,
+	"multiQueue": true,
+	"mtu": 1400
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n.Owner).To(Equal(0))
+		Expect(*n.Group).To(Equal(107))
+		Expect(n.MultiQueue).To(BeTrue())
+		Expect(n.MTU).To(Equal(1400))
+	})
+
+	It("leaves owner and group unset by default", func() {
+		n, _, err := loadConf([]byte(`{"cniVersion": "0.4.0", "name": "vm", "type": "tap"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Owner).To(BeNil())
+		Expect(n.Group).To(BeNil())
+	})
+
+	It("leaves the addresses to the VM only if told to", func() {
+		n, _, err := loadConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "vm",
+	"type": "tap",
+	"vmAddresses": true,
+	"ipam": {"type": "dhcp", "server": {"ipam": {"type": "host-local"}}}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.VMAddresses).To(BeTrue())
+
+		n, _, err = loadConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "vm",
+	"type": "tap",
+	"ipam": {"type": "dhcp", "server": {"ipam": {"type": "host-local"}}}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.VMAddresses).To(BeFalse())
+	})
+
+	It("rejects a negative owner", func() {
+		_, _, err := loadConf([]byte(`{"cniVersion": "0.4.0", "name": "vm", "type": "tap", "owner": -1}`))
+		Expect(err).To(MatchError("invalid owner -1"))
+	})
+})
+
+var _ = Describe("tap plugin", func() {
+	var originalNS, targetNS ns.NetNS
+	const IFNAME string = "tap0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	It("creates a tap on a bridge with ADD and deletes it with DEL", func() {
+		conf := `{
+	"cniVersion": "0.4.0",
+	"name": "vm",
+	"type": "tap",
+	"mtu": 1400,
+	"multiQueue": true,
+	"bridge": "br0",
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var result *current.Result
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.Interfaces[0].Name).To(Equal(IFNAME))
+			Expect(result.Interfaces[1].Name).To(Equal("br0"))
+			Expect(*result.IPs[0].Interface).To(Equal(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Type()).To(Equal("tun"))
+			Expect(link.Attrs().MTU).To(Equal(1400))
+
+			br, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("leaves an existing interface of the same name alone", func() {
+		conf := `{
+	"cniVersion": "0.4.0",
+	"name": "vm",
+	"type": "tap"
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{Name: IFNAME},
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(`interface "tap0" already exists`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Type()).To(Equal("bridge"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,419 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	ModeGRE    = "gre"
+	ModeGRETap = "gretap"
+	ModeIPIP   = "ipip"
+	ModeIP6GRE = "ip6gre"
+)
+
+// defaultHopLimit is the hop limit of ip6gre tunnels without a TTL, as
+// chosen by iproute2; unlike the IPv4 tunnels, they cannot inherit it.
+const defaultHopLimit = 64
+
+// fallbackDevices are created by the kernel in every namespace the first
+// tunnel of their module is created in, so they cannot be used as names.
+var fallbackDevices = map[string]bool{
+	"gre0":    true,
+	"gretap0": true,
+	"erspan0": true,
+	"tunl0":   true,
+	"ip6gre0": true,
+}
+
+type NetConf struct {
+	types.NetConf
+	Mode   string  `json:"mode"`
+	Local  net.IP  `json:"local,omitempty"`
+	Remote net.IP  `json:"remote"`
+	Key    *uint32 `json:"key,omitempty"`
+	TTL    int     `json:"ttl,omitempty"`
+	MTU    int     `json:"mtu,omitempty"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	switch n.Mode {
+	case ModeGRE, ModeGRETap, ModeIPIP, ModeIP6GRE:
+	case "":
+		return nil, "", fmt.Errorf(`"mode" field is required. It specifies the tunnel type`)
+	default:
+		return nil, "", fmt.Errorf("unknown tunnel mode %q", n.Mode)
+	}
+
+	if n.Remote == nil {
+		return nil, "", fmt.Errorf(`"remote" field is required. It specifies the far end of the tunnel`)
+	}
+	v6 := n.Mode == ModeIP6GRE
+	for _, addr := range []net.IP{n.Local, n.Remote} {
+		if addr != nil && (addr.To4() == nil) != v6 {
+			if v6 {
+				return nil, "", fmt.Errorf("%s tunnel endpoint %s is not an IPv6 address", n.Mode, addr)
+			}
+			return nil, "", fmt.Errorf("%s tunnel endpoint %s is not an IPv4 address", n.Mode, addr)
+		}
+	}
+
+	if n.Key != nil && n.Mode == ModeIPIP {
+		return nil, "", fmt.Errorf("ipip tunnels have no key")
+	}
+	if n.TTL < 0 || n.TTL > 255 {
+		return nil, "", fmt.Errorf("invalid TTL %d", n.TTL)
+	}
+	if n.MTU < 0 {
+		return nil, "", fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+func htons(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func htonl(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// addGRELink creates a GRE family tunnel in the current namespace. The
+// vendored netlink only knows gretap, so the request is built directly;
+// the attributes are the same for all of them.
+func addGRELink(conf *NetConf, ifName string) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(ifName)))
+	if conf.MTU > 0 {
+		req.AddData(nl.NewRtAttr(syscall.IFLA_MTU, nl.Uint32Attr(uint32(conf.MTU))))
+	}
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(conf.Mode))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+
+	addrBytes := func(addr net.IP) []byte {
+		if conf.Mode == ModeIP6GRE {
+			return []byte(addr.To16())
+		}
+		return []byte(addr.To4())
+	}
+	if conf.Local != nil {
+		nl.NewRtAttrChild(data, nl.IFLA_GRE_LOCAL, addrBytes(conf.Local))
+	}
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_REMOTE, addrBytes(conf.Remote))
+
+	var flags uint16
+	if conf.Key != nil {
+		nl.NewRtAttrChild(data, nl.IFLA_GRE_IKEY, htonl(*conf.Key))
+		nl.NewRtAttrChild(data, nl.IFLA_GRE_OKEY, htonl(*conf.Key))
+		flags |= nl.GRE_KEY
+	}
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_IFLAGS, htons(flags))
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_OFLAGS, htons(flags))
+
+	ttl := uint8(conf.TTL)
+	if conf.Mode == ModeIP6GRE {
+		if ttl == 0 {
+			ttl = defaultHopLimit
+		}
+	} else {
+		nl.NewRtAttrChild(data, nl.IFLA_GRE_PMTUDISC, nl.Uint8Attr(1))
+	}
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_TTL, nl.Uint8Attr(ttl))
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// createTunnel creates the tunnel in the current namespace and sets it up.
+func createTunnel(conf *NetConf, ifName string) (netlink.Link, error) {
+	var err error
+	if conf.Mode == ModeIPIP {
+		err = netlink.LinkAdd(&netlink.Iptun{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: ifName,
+				MTU:  conf.MTU,
+			},
+			Local:    conf.Local,
+			Remote:   conf.Remote,
+			Ttl:      uint8(conf.TTL),
+			PMtuDisc: 1,
+		})
+	} else {
+		err = addGRELink(conf, ifName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s tunnel %q: %v", conf.Mode, ifName, err)
+	}
+
+	// The tunnel exists from here on, and is deleted if a later step
+	// fails. A failed create must leave ifName alone, as it may be an
+	// interface that is not ours.
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		_ = ip.DelLinkByName(ifName)
+		return nil, fmt.Errorf("failed to refetch tunnel %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		_ = netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to set %q up: %v", ifName, err)
+	}
+	return link, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if fallbackDevices[args.IfName] {
+		return fmt.Errorf("interface name %q is reserved for the kernel fallback tunnel", args.IfName)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	var iface *current.Interface
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := createTunnel(n, args.IfName)
+		if err != nil {
+			return err
+		}
+		iface = &current.Interface{
+			Name:    args.IfName,
+			Sandbox: netns.Path(),
+		}
+		// Only gretap tunnels carry ethernet frames
+		if n.Mode == ModeGRETap {
+			iface.Mac = link.Attrs().HardwareAddr.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	undo.Push("delete link", func() error {
+		return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return ip.DelLinkByName(args.IfName)
+		})
+	})
+
+	result := &current.Result{Interfaces: []*current.Interface{iface}}
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+		undo.Push("release IPAM allocation", func() error {
+			return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		})
+
+		// Convert whatever the IPAM result was into the current Result type
+		ipamResult, err := current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			return errors.New("IPAM plugin returned missing IP config")
+		}
+
+		for _, ipc := range ipamResult.IPs {
+			ipc.Interface = current.Int(0)
+		}
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+				return err
+			}
+
+			if n.Mode != ModeGRETap {
+				return nil
+			}
+			contIface, err := net.InterfaceByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to look up %q: %v", args.IfName, err)
+			}
+			for _, ipc := range result.IPs {
+				if ipc.Version == "4" {
+					_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contIface)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS = n.DNS
+
+	undo.Commit()
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		resource := fmt.Sprintf("interface %q", args.IfName)
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(resource, "failed to find interface %q: %v", args.IfName, err)
+		}
+		if link.Type() != n.Mode {
+			return utils.NewCheckError(resource, "interface %q is a %s, expected a %s tunnel", args.IfName, link.Type(), n.Mode)
+		}
+		if n.MTU != 0 && link.Attrs().MTU != n.MTU {
+			return utils.NewCheckError(resource, "tunnel %q has MTU %d, expected %d", args.IfName, link.Attrs().MTU, n.MTU)
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI tunnel plugin")
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tunnel configuration", func() {
+	It("parses the endpoints, key and TTL", func() {
+		n, _, err := loadConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "tun",
+	"type": "tunnel",
+	"mode": "gre",
+	"local": "192.0.2.1",
+	"remote": "198.51.100.1",
+	"key": 42,
+	"ttl": 64
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Local).To(Equal(net.ParseIP("192.0.2.1")))
+		Expect(n.Remote).To(Equal(net.ParseIP("198.51.100.1")))
+		Expect(*n.Key).To(Equal(uint32(42)))
+		Expect(n.TTL).To(Equal(64))
+	})
+
+	It("rejects invalid tunnels", func() {
+		for conf, msg := range map[string]string{
+			`"remote": "198.51.100.1"`:                            `"mode" field is required. It specifies the tunnel type`,
+			`"mode": "vxlan", "remote": "198.51.100.1"`:           `unknown tunnel mode "vxlan"`,
+			`"mode": "gre"`:                                       `"remote" field is required. It specifies the far end of the tunnel`,
+			`"mode": "gre", "remote": "2001:db8::1"`:              "gre tunnel endpoint 2001:db8::1 is not an IPv4 address",
+			`"mode": "ip6gre", "remote": "198.51.100.1"`:          "ip6gre tunnel endpoint 198.51.100.1 is not an IPv6 address",
+			`"mode": "ipip", "remote": "198.51.100.1", "key": 1`:  "ipip tunnels have no key",
+			`"mode": "gre", "remote": "198.51.100.1", "ttl": 256`: "invalid TTL 256",
+		} {
+			_, _, err := loadConf([]byte(fmt.Sprintf(`{"cniVersion": "0.4.0", "name": "tun", "type": "tunnel", %s}`, conf)))
+			Expect(err).To(MatchError(msg))
+		}
+	})
+})
+
+var _ = Describe("tunnel plugin", func() {
+	var originalNS, targetNS ns.NetNS
+	const IFNAME string = "tun0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	It("rejects the fallback tunnel names", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "gre0",
+			StdinData:   []byte(`{"cniVersion": "0.4.0", "name": "tun", "type": "tunnel", "mode": "gre", "remote": "198.51.100.1"}`),
+		}
+		Expect(cmdAdd(args)).To(MatchError(`interface name "gre0" is reserved for the kernel fallback tunnel`))
+	})
+
+	It("leaves an existing interface of the same name alone when ADD fails", func() {
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(`{"cniVersion": "0.4.0", "name": "tun", "type": "tunnel", "mode": "gre", "remote": "198.51.100.1"}`),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(BeAssignableToTypeOf(&netlink.Bridge{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	for _, mode := range []string{ModeGRE, ModeGRETap, ModeIPIP, ModeIP6GRE} {
+		mode := mode
+		It(fmt.Sprintf("creates a %s tunnel with ADD, checks it with CHECK and deletes it with DEL", mode), func() {
+			local, remote := "192.0.2.1", "198.51.100.1"
+			if mode == ModeIP6GRE {
+				local, remote = "2001:db8::1", "2001:db8:1::1"
+			}
+			conf := fmt.Sprintf(`{
+	"cniVersion": "0.4.0",
+	"name": "tun",
+	"type": "tunnel",
+	"mode": %q,
+	"local": %q,
+	"remote": %q,
+	"mtu": 1400
+}`, mode, local, remote)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			var result *current.Result
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				r, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err = current.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Interfaces).To(HaveLen(1))
+				Expect(result.Interfaces[0].Name).To(Equal(IFNAME))
+				Expect(result.Interfaces[0].Sandbox).To(Equal(targetNS.Path()))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Type()).To(Equal(mode))
+				Expect(link.Attrs().MTU).To(Equal(1400))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				resultJSON := fmt.Sprintf(`{"ips": [], "interfaces": [{"name": %q, "sandbox": %q}]}`, IFNAME, targetNS.Path())
+				args.StdinData = []byte(conf[:len(conf)-1] + `, "prevResult": ` + resultJSON + "}")
+				err := testutils.CmdCheckWithResult(targetNS.Path(), IFNAME, func() error {
+					return cmdCheck(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, err := netlink.LinkByName(IFNAME)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+})
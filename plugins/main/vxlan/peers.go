@@ -0,0 +1,205 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// macPrefix starts the MAC of the bridge of each node; the rest is the
+// underlay address of the node. The other nodes can thus derive it from
+// the peer file.
+var macPrefix = []byte{0x0a, 0x76}
+
+// Peer is a node in the peer file.
+type Peer struct {
+	UnderlayIP net.IP      `json:"underlayIP"`
+	Subnet     types.IPNet `json:"subnet"`
+}
+
+// PeerFile lists all nodes of the overlay. It may include this node.
+type PeerFile struct {
+	Peers []Peer `json:"peers"`
+}
+
+func loadPeers(path string) ([]Peer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer file: %v", err)
+	}
+
+	pf := PeerFile{}
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("failed to parse peer file %s: %v", path, err)
+	}
+
+	for i, p := range pf.Peers {
+		if p.UnderlayIP.To4() == nil {
+			return nil, fmt.Errorf("peer %d in %s: underlay IP must be an IPv4 address", i, path)
+		}
+		if p.Subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("peer %d in %s: subnet must be an IPv4 subnet", i, path)
+		}
+	}
+	return pf.Peers, nil
+}
+
+func overlayMAC(underlayIP net.IP) net.HardwareAddr {
+	return append(append(net.HardwareAddr{}, macPrefix...), underlayIP.To4()...)
+}
+
+func isOverlayMAC(mac net.HardwareAddr) bool {
+	return len(mac) == 6 && mac[0] == macPrefix[0] && mac[1] == macPrefix[1]
+}
+
+// peerEntry holds what is programmed for a peer: its pod subnet is routed
+// to its bridge, through a next hop whose neighbor entry has the MAC of
+// that bridge, which the VXLAN device sends to the underlay IP.
+type peerEntry struct {
+	underlayIP net.IP
+	subnet     net.IPNet
+	nextHop    net.IP
+	mac        net.HardwareAddr
+}
+
+// peerEntries returns the entries for all peers but the local node. The
+// next hop is the network address of the subnet, which is never used by a
+// container.
+func peerEntries(peers []Peer, localIP net.IP) []peerEntry {
+	var entries []peerEntry
+	for _, p := range peers {
+		if p.UnderlayIP.Equal(localIP) {
+			continue
+		}
+		subnet := net.IPNet{IP: p.Subnet.IP.Mask(p.Subnet.Mask).To4(), Mask: p.Subnet.Mask}
+		entries = append(entries, peerEntry{
+			underlayIP: p.UnderlayIP.To4(),
+			subnet:     subnet,
+			nextHop:    subnet.IP,
+			mac:        overlayMAC(p.UnderlayIP),
+		})
+	}
+	return entries
+}
+
+// syncPeers programs the entries, and removes those of the peers that
+// are no longer in the peer file.
+func syncPeers(br *netlink.Bridge, vx *netlink.Vxlan, entries []peerEntry) error {
+	subnets := map[string]bool{}
+	nextHops := map[string]bool{}
+	macs := map[string]bool{}
+
+	for _, e := range entries {
+		subnets[e.subnet.String()] = true
+		nextHops[e.nextHop.String()] = true
+		macs[e.mac.String()] = true
+
+		// The bridge forwards the frames for the peer to the VXLAN
+		// device, which sends them to the underlay IP of the peer
+		err := netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    vx.Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_MASTER,
+			State:        netlink.NUD_NOARP,
+			HardwareAddr: e.mac,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add bridge fdb entry for %s: %v", e.mac, err)
+		}
+		err = netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    vx.Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			State:        netlink.NUD_PERMANENT,
+			IP:           e.underlayIP,
+			HardwareAddr: e.mac,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add vxlan fdb entry for %s: %v", e.mac, err)
+		}
+
+		err = netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    br.Index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           e.nextHop,
+			HardwareAddr: e.mac,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add neighbor %s: %v", e.nextHop, err)
+		}
+
+		subnet := e.subnet
+		err = netlink.RouteReplace(&netlink.Route{
+			LinkIndex: br.Index,
+			Dst:       &subnet,
+			Gw:        e.nextHop,
+			Flags:     int(netlink.FLAG_ONLINK),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", subnet.String(), err)
+		}
+	}
+
+	// Only onlink routes through the bridge, and entries with the
+	// overlay MACs, are ours
+	routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, r := range routes {
+		if r.Flags&int(netlink.FLAG_ONLINK) == 0 || r.Dst == nil || r.Gw == nil || subnets[r.Dst.String()] {
+			continue
+		}
+		if err := netlink.RouteDel(&r); err != nil {
+			return fmt.Errorf("failed to delete route to %s: %v", r.Dst.String(), err)
+		}
+	}
+
+	neighs, err := netlink.NeighList(br.Index, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors: %v", err)
+	}
+	for _, n := range neighs {
+		if n.State&netlink.NUD_PERMANENT == 0 || !isOverlayMAC(n.HardwareAddr) || nextHops[n.IP.String()] {
+			continue
+		}
+		if err := netlink.NeighDel(&n); err != nil {
+			return fmt.Errorf("failed to delete neighbor %s: %v", n.IP, err)
+		}
+	}
+
+	fdb, err := netlink.NeighList(vx.Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list fdb entries: %v", err)
+	}
+	for _, n := range fdb {
+		if !isOverlayMAC(n.HardwareAddr) || macs[n.HardwareAddr.String()] {
+			continue
+		}
+		if err := netlink.NeighDel(&n); err != nil {
+			return fmt.Errorf("failed to delete fdb entry for %s: %v", n.HardwareAddr, err)
+		}
+	}
+
+	return nil
+}
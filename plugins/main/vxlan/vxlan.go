@@ -0,0 +1,534 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultPort = 4789
+	maxVNI      = 1<<24 - 1
+	// vxlanOverhead is the size of the outer IPv4, UDP, VXLAN and
+	// ethernet headers.
+	vxlanOverhead = 50
+)
+
+type NetConf struct {
+	types.NetConf
+	VNI       int    `json:"vni"`
+	Port      int    `json:"port"`
+	Device    string `json:"device"`
+	LocalIP   net.IP `json:"localIP,omitempty"`
+	VxlanName string `json:"vxlanName"`
+	BrName    string `json:"bridge"`
+	MTU       int    `json:"mtu"`
+	PeerFile  string `json:"peerFile"`
+
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadNetConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Parse previous result, which is passed in on CHECK
+	if n.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*n.RawPrevResult)["cniVersion"]; !ok {
+			(*n.RawPrevResult)["cniVersion"] = n.CNIVersion
+		}
+		resultBytes, err := json.Marshal(n.RawPrevResult)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(n.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		n.RawPrevResult = nil
+		n.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	if n.VNI < 1 || n.VNI > maxVNI {
+		return nil, "", fmt.Errorf(`"vni" field is required. It must be between 1 and %d`, maxVNI)
+	}
+	if n.Port == 0 {
+		n.Port = defaultPort
+	}
+	if n.Port < 0 || n.Port > 65535 {
+		return nil, "", fmt.Errorf("invalid port %d", n.Port)
+	}
+	if n.Device == "" {
+		return nil, "", fmt.Errorf(`"device" field is required. It specifies the underlay interface`)
+	}
+	if n.LocalIP != nil && n.LocalIP.To4() == nil {
+		return nil, "", fmt.Errorf("local IP %s is not an IPv4 address", n.LocalIP)
+	}
+	if n.PeerFile == "" {
+		return nil, "", fmt.Errorf(`"peerFile" field is required. It lists the other nodes`)
+	}
+	if n.VxlanName == "" {
+		n.VxlanName = fmt.Sprintf("vxlan%d", n.VNI)
+	}
+	if n.BrName == "" {
+		n.BrName = fmt.Sprintf("vxbr%d", n.VNI)
+	}
+	if n.MTU < 0 {
+		return nil, "", fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+// localAddress returns the underlay address of this node: the configured
+// one, or else the first global IPv4 address of the underlay device.
+func localAddress(n *NetConf, dev netlink.Link) (net.IP, error) {
+	if n.LocalIP != nil {
+		return n.LocalIP.To4(), nil
+	}
+
+	addrs, err := netlink.AddrList(dev, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %q: %v", n.Device, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			return addr.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("%q has no IPv4 address to use as the local IP", n.Device)
+}
+
+func bridgeByName(name string) (*netlink.Bridge, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", name, err)
+	}
+	br, ok := l.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists but is not a bridge", name)
+	}
+	return br, nil
+}
+
+// ensureBridge creates the bridge if necessary. Its MAC is derived from
+// the local address, so that the other nodes can send to it.
+func ensureBridge(brName string, mtu int, mac net.HardwareAddr) (*netlink.Bridge, error) {
+	br := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: brName,
+			MTU:  mtu,
+			// Let kernel use default txqueuelen; leaving it unset
+			// means 0, and a zero-length TX queue messes up FIFO
+			// traffic shapers which use TX queue length as the
+			// default packet limit
+			TxQLen: -1,
+		},
+	}
+
+	err := netlink.LinkAdd(br)
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", brName, err)
+	}
+
+	// Re-fetch link to read all attributes and if it already existed,
+	// ensure it's really a bridge
+	br, err = bridgeByName(brName)
+	if err != nil {
+		return nil, err
+	}
+
+	if br.Attrs().HardwareAddr.String() != mac.String() {
+		if err := netlink.LinkSetHardwareAddr(br, mac); err != nil {
+			return nil, fmt.Errorf("could not set the mac of %q: %v", brName, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// ensureVxlan creates the VXLAN device if necessary and attaches it to the
+// bridge.
+func ensureVxlan(n *NetConf, devIndex int, localIP net.IP, mtu int, br *netlink.Bridge) (*netlink.Vxlan, error) {
+	vx := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   n.VxlanName,
+			MTU:    mtu,
+			TxQLen: -1,
+		},
+		VxlanId:      n.VNI,
+		VtepDevIndex: devIndex,
+		SrcAddr:      localIP,
+		Port:         n.Port,
+		// The forwarding entries all come from the peer file
+		Learning: false,
+	}
+
+	err := netlink.LinkAdd(vx)
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", n.VxlanName, err)
+	}
+
+	l, err := netlink.LinkByName(n.VxlanName)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", n.VxlanName, err)
+	}
+	vx, ok := l.(*netlink.Vxlan)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists but is not a vxlan device", n.VxlanName)
+	}
+	if vx.VxlanId != n.VNI {
+		return nil, fmt.Errorf("%q already exists with VNI %d", n.VxlanName, vx.VxlanId)
+	}
+
+	if vx.MasterIndex != br.Index {
+		if err := netlink.LinkSetMaster(vx, br); err != nil {
+			return nil, fmt.Errorf("failed to connect %q to bridge %q: %v", n.VxlanName, br.Name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(vx); err != nil {
+		return nil, err
+	}
+
+	return vx, nil
+}
+
+// setupOverlay creates the bridge and the VXLAN device, which are shared
+// by all containers of the network, and programs the peers from the peer
+// file. It returns the bridge and the MTU of the overlay.
+func setupOverlay(n *NetConf) (*netlink.Bridge, int, error) {
+	dev, err := netlink.LinkByName(n.Device)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to lookup underlay device %q: %v", n.Device, err)
+	}
+
+	localIP, err := localAddress(n, dev)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	mtu := n.MTU
+	if mtu == 0 {
+		mtu = dev.Attrs().MTU - vxlanOverhead
+	}
+
+	br, err := ensureBridge(n.BrName, mtu, overlayMAC(localIP))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	}
+
+	vx, err := ensureVxlan(n, dev.Attrs().Index, localIP, mtu, br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	peers, err := loadPeers(n.PeerFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := syncPeers(br, vx, peerEntries(peers, localIP)); err != nil {
+		return nil, 0, err
+	}
+
+	return br, mtu, nil
+}
+
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int) (*current.Interface, *current.Interface, error) {
+	contIface := &current.Interface{}
+	hostIface := &current.Interface{}
+
+	err := netns.Do(func(hostNS ns.NetNS) error {
+		// create the veth pair in the container and move host end into host netns
+		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, hostNS)
+		if err != nil {
+			return err
+		}
+		contIface.Name = containerVeth.Name
+		contIface.Mac = containerVeth.HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
+		hostIface.Name = hostVeth.Name
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// need to lookup hostVeth again as its index has changed during ns move
+	hostVeth, err := netlink.LinkByName(hostIface.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
+	}
+	hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
+
+	// connect host veth end to the bridge
+	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	}
+
+	return hostIface, contIface, nil
+}
+
+// ensureBridgeAddr sets the gateway address on the bridge, unless it is
+// already there.
+func ensureBridgeAddr(br *netlink.Bridge, ipn *net.IPNet) error {
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+
+	ipnStr := ipn.String()
+	for _, a := range addrs {
+		// string comp is actually easiest for doing IPNet comps
+		if a.IPNet.String() == ipnStr {
+			return nil
+		}
+		return fmt.Errorf("%q already has an IP address different from %v", br.Name, ipnStr)
+	}
+
+	if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: ipn}); err != nil {
+		return fmt.Errorf("could not add IP address to %q: %v", br.Name, err)
+	}
+	return nil
+}
+
+func calcGatewayIP(ipn *net.IPNet) net.IP {
+	nid := ipn.IP.Mask(ipn.Mask)
+	return ip.NextIP(nid)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	br, mtu, err := setupOverlay(n)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// Undo whatever was set up so far if a later step fails
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, mtu)
+	if err != nil {
+		return err
+	}
+	undo.Push("delete link", func() error {
+		return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return ip.DelLinkByName(args.IfName)
+		})
+	})
+
+	// run the IPAM plugin and get back the config to apply
+	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	undo.Push("release IPAM allocation", func() error {
+		return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	})
+
+	// Convert whatever the IPAM result was into the current Result type
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return err
+	}
+
+	if len(result.IPs) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+
+	brInterface := &current.Interface{
+		Name: br.Attrs().Name,
+		Mac:  br.Attrs().HardwareAddr.String(),
+	}
+	result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
+
+	// The bridge is the gateway of the containers on this node
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(2)
+		if ipc.Version != "4" {
+			return fmt.Errorf("IPAM returned %s, but the overlay only supports IPv4", ipc.Address.String())
+		}
+		if ipc.Gateway == nil {
+			ipc.Gateway = calcGatewayIP(&ipc.Address)
+		}
+		gw := net.IPNet{IP: ipc.Gateway, Mask: ipc.Address.Mask}
+		if err := ensureBridgeAddr(br, &gw); err != nil {
+			return fmt.Errorf("failed to set bridge addr: %v", err)
+		}
+	}
+	if err := ip.EnableIP4Forward(); err != nil {
+		return fmt.Errorf("failed to enable forwarding: %v", err)
+	}
+
+	// Configure the container IP address(es)
+	if err := netns.Do(func(_ ns.NetNS) error {
+		contVeth, err := net.InterfaceByName(args.IfName)
+		if err != nil {
+			return err
+		}
+
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+
+		// Send a gratuitous arp
+		for _, ipc := range result.IPs {
+			_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	result.DNS = n.DNS
+
+	undo.Commit()
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	// The bridge and the VXLAN device are shared and are left alone.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	brResource := fmt.Sprintf("bridge %q", n.BrName)
+	br, err := bridgeByName(n.BrName)
+	if err != nil {
+		return utils.NewCheckError(brResource, "%v", err)
+	}
+	vxResource := fmt.Sprintf("interface %q", n.VxlanName)
+	l, err := netlink.LinkByName(n.VxlanName)
+	if err != nil {
+		return utils.NewCheckError(vxResource, "failed to find interface %q: %v", n.VxlanName, err)
+	}
+	vx, ok := l.(*netlink.Vxlan)
+	if !ok || vx.VxlanId != n.VNI {
+		return utils.NewCheckError(vxResource, "interface %q is not a vxlan device with VNI %d", n.VxlanName, n.VNI)
+	}
+	if vx.MasterIndex != br.Index {
+		return utils.NewCheckError(vxResource, "interface %q is not attached to bridge %q", n.VxlanName, n.BrName)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		resource := fmt.Sprintf("interface %q", args.IfName)
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return utils.NewCheckError(resource, "failed to find interface %q: %v", args.IfName, err)
+		}
+		if _, ok := link.(*netlink.Veth); !ok {
+			return utils.NewCheckError(resource, "interface %q is not a veth", args.IfName)
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI vxlan plugin")
+}
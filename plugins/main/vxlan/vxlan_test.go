@@ -0,0 +1,262 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("vxlan configuration", func() {
+	It("applies the defaults", func() {
+		n, _, err := loadNetConf([]byte(`{
+	"cniVersion": "0.4.0",
+	"name": "overlay",
+	"type": "vxlan",
+	"vni": 42,
+	"device": "eth0",
+	"peerFile": "/etc/cni/vxlan/peers.json"
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Port).To(Equal(4789))
+		Expect(n.VxlanName).To(Equal("vxlan42"))
+		Expect(n.BrName).To(Equal("vxbr42"))
+		Expect(n.MTU).To(Equal(0))
+	})
+
+	It("rejects an out of range VNI", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "overlay", "type": "vxlan", "vni": 16777216, "device": "eth0", "peerFile": "p"}`))
+		Expect(err).To(MatchError(`"vni" field is required. It must be between 1 and 16777215`))
+	})
+
+	It("requires a peer file", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "overlay", "type": "vxlan", "vni": 1, "device": "eth0"}`))
+		Expect(err).To(MatchError(`"peerFile" field is required. It lists the other nodes`))
+	})
+
+	It("rejects an IPv6 local IP", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "overlay", "type": "vxlan", "vni": 1, "device": "eth0", "peerFile": "p", "localIP": "2001:db8::1"}`))
+		Expect(err).To(MatchError("local IP 2001:db8::1 is not an IPv4 address"))
+	})
+})
+
+var _ = Describe("vxlan peers", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "vxlan")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writePeers := func(data string) string {
+		path := filepath.Join(dir, "peers.json")
+		Expect(ioutil.WriteFile(path, []byte(data), 0644)).To(Succeed())
+		return path
+	}
+
+	It("derives the MAC of a node from its underlay IP", func() {
+		mac := overlayMAC(net.ParseIP("192.0.2.10"))
+		Expect(mac.String()).To(Equal("0a:76:c0:00:02:0a"))
+		Expect(isOverlayMAC(mac)).To(BeTrue())
+		Expect(isOverlayMAC(net.HardwareAddr{0x0a, 0x58, 0, 0, 0, 1})).To(BeFalse())
+	})
+
+	It("computes the entries of all peers but the local node", func() {
+		peers, err := loadPeers(writePeers(`{
+	"peers": [
+		{"underlayIP": "192.0.2.10", "subnet": "10.244.1.0/24"},
+		{"underlayIP": "192.0.2.11", "subnet": "10.244.2.1/24"}
+	]
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peers).To(HaveLen(2))
+
+		entries := peerEntries(peers, net.ParseIP("192.0.2.10").To4())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].underlayIP.String()).To(Equal("192.0.2.11"))
+		Expect(entries[0].subnet.String()).To(Equal("10.244.2.0/24"))
+		Expect(entries[0].nextHop.String()).To(Equal("10.244.2.0"))
+		Expect(entries[0].mac.String()).To(Equal("0a:76:c0:00:02:0b"))
+	})
+
+	It("rejects an IPv6 peer", func() {
+		path := writePeers(`{"peers": [{"underlayIP": "2001:db8::1", "subnet": "10.244.1.0/24"}]}`)
+		_, err := loadPeers(path)
+		Expect(err).To(MatchError("peer 0 in " + path + ": underlay IP must be an IPv4 address"))
+	})
+
+	It("fails if the peer file is missing", func() {
+		_, err := loadPeers(filepath.Join(dir, "missing.json"))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("vxlan plugin", func() {
+	var originalNS, targetNS ns.NetNS
+	var dir string
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		dir, err = ioutil.TempDir("", "vxlan")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{Name: "underlay0", MTU: 1500},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName("underlay0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("creates the overlay and the peers with ADD, and prunes removed peers on the next ADD", func() {
+		peerFile := filepath.Join(dir, "peers.json")
+		Expect(ioutil.WriteFile(peerFile, []byte(`{
+	"peers": [
+		{"underlayIP": "192.0.2.10", "subnet": "10.244.1.0/24"},
+		{"underlayIP": "192.0.2.11", "subnet": "10.244.2.0/24"}
+	]
+}`), 0644)).To(Succeed())
+
+		conf := `{
+	"cniVersion": "0.4.0",
+	"name": "overlay",
+	"type": "vxlan",
+	"vni": 42,
+	"device": "underlay0",
+	"peerFile": "` + peerFile + `",
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.244.1.0/24",
+		"routes": [{"dst": "10.244.0.0/16"}]
+	}
+}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(3))
+			Expect(result.Interfaces[0].Name).To(Equal("vxbr42"))
+			Expect(result.Interfaces[0].Mac).To(Equal("0a:76:c0:00:02:0a"))
+
+			l, err := netlink.LinkByName("vxlan42")
+			Expect(err).NotTo(HaveOccurred())
+			vx, ok := l.(*netlink.Vxlan)
+			Expect(ok).To(BeTrue())
+			Expect(vx.VxlanId).To(Equal(42))
+			Expect(vx.Port).To(Equal(4789))
+			Expect(vx.MTU).To(Equal(1450))
+
+			br, err := netlink.LinkByName("vxbr42")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vx.MasterIndex).To(Equal(br.Attrs().Index))
+
+			routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			var peerRoutes []string
+			for _, r := range routes {
+				if r.Gw != nil {
+					peerRoutes = append(peerRoutes, r.Dst.String()+" via "+r.Gw.String())
+				}
+			}
+			Expect(peerRoutes).To(ConsistOf("10.244.2.0/24 via 10.244.2.0"))
+
+			fdb, err := netlink.NeighList(vx.Index, netlink.FAMILY_ALL)
+			Expect(err).NotTo(HaveOccurred())
+			var dsts []string
+			for _, n := range fdb {
+				if n.HardwareAddr.String() == "0a:76:c0:00:02:0b" && n.IP != nil {
+					dsts = append(dsts, n.IP.String())
+				}
+			}
+			Expect(dsts).To(ConsistOf("192.0.2.11"))
+
+			err = testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// The peer is gone from the file on the next ADD
+			Expect(ioutil.WriteFile(peerFile, []byte(`{"peers": []}`), 0644)).To(Succeed())
+			_, _, err = testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err = netlink.RouteList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			for _, r := range routes {
+				Expect(r.Gw).To(BeNil())
+			}
+
+			err = testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,213 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const accountingConf = `{
+	"name": "test",
+	"type": "accounting",
+	"cniVersion": "0.4.0",
+	"prevResult": {
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			},
+			{
+				"version": "6",
+				"address": "2001:db8::2/64",
+				"interface": 1
+			},
+			{
+				"version": "4",
+				"address": "10.0.0.1/24",
+				"interface": 0
+			}
+		]
+	}
+}`
+
+var _ = Describe("accounting configuration", func() {
+	It("finds the container IPs", func() {
+		_, ips, err := parseConf([]byte(accountingConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2")}))
+	})
+
+	It("generates a correct container chain", func() {
+		comment := utils.FormatComment("test", "dummy")
+		ch := genContainerChain("test", "dummy", []net.IP{net.ParseIP("10.0.0.2")})
+		Expect(ch).To(Equal(utils.Chain{
+			Table:       "filter",
+			Name:        utils.FormatChainNameWithPrefix("test", "dummy", "AC-"),
+			EntryChains: []string{AccountingChainName},
+			EntryRules: [][]string{
+				{"-d", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+				{"-s", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+			},
+			Rules: [][]string{
+				{"-d", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+				{"-s", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+			},
+		}))
+	})
+})
+
+var _ = Describe("accounting stats", func() {
+	It("parses counting rules", func() {
+		r, err := parseCounterRule(`-A CNI-AC-0123456789abcdef01234 -d 10.0.0.2/32 -m comment --comment "name: \"test\" id: \"dummy\"" -c 10 840`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r).To(Equal(&counterRule{
+			network:     "test",
+			containerID: "dummy",
+			ingress:     true,
+			packets:     10,
+			bytes:       840,
+		}))
+
+		r, err = parseCounterRule(`-A CNI-AC-0123456789abcdef01234 -s 2001:db8::2/128 -m comment --comment "name: \"test\" id: \"dummy\"" -c 3 312`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.ingress).To(BeFalse())
+		Expect(r.packets).To(Equal(uint64(3)))
+		Expect(r.bytes).To(Equal(uint64(312)))
+	})
+
+	It("rejects other rules", func() {
+		_, err := parseCounterRule(`-A CNI-AC-0123456789abcdef01234 -d 10.0.0.2/32 -m comment --comment "name: \"test\" id: \"dummy\""`)
+		Expect(err).To(HaveOccurred())
+
+		_, err = parseCounterRule(`-A CNI-AC-0123456789abcdef01234 -d 10.0.0.2/32 -m comment --comment "something else" -c 1 1`)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("sums the counters of a container", func() {
+		stats := map[string]*ContainerStats{}
+		addCounters(stats, &counterRule{network: "test", containerID: "dummy", ingress: true, packets: 10, bytes: 840})
+		addCounters(stats, &counterRule{network: "test", containerID: "dummy", ingress: true, packets: 2, bytes: 160})
+		addCounters(stats, &counterRule{network: "test", containerID: "dummy", packets: 3, bytes: 312})
+		addCounters(stats, &counterRule{network: "test", containerID: "other", packets: 1, bytes: 60})
+		Expect(stats).To(Equal(map[string]*ContainerStats{
+			"test/dummy": {
+				Network:        "test",
+				ContainerID:    "dummy",
+				IngressPackets: 12,
+				IngressBytes:   1000,
+				EgressPackets:  3,
+				EgressBytes:    312,
+			},
+			"test/other": {
+				Network:       "test",
+				ContainerID:   "other",
+				EgressPackets: 1,
+				EgressBytes:   60,
+			},
+		}))
+	})
+})
+
+var _ = Describe("accounting plugin", func() {
+	var originalNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("installs the counters with ADD, checks them with CHECK and removes them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   []byte(accountingConf),
+		}
+		containerChain := genContainerChain("test", "dummy", nil).Name
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			stats, err := collectStats()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stats).To(Equal([]*ContainerStats{{Network: "test", ContainerID: "dummy"}}))
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Drop the counting rules
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+			err = ipt.ClearChain("filter", containerChain)
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf("chain %q", containerChain)))
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "filter", containerChain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
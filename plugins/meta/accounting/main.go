@@ -0,0 +1,216 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that counts the bytes and packets sent and
+// received by a container. Each container gets a chain in the filter table
+// holding a counting rule per IP and direction; the "stats" subcommand
+// reads them back and prints them per network and container ID.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// AccountingChainName is the name of the shared chain the per-container
+// chains hang off. It should never be changed, or else upgrading will
+// require manual intervention.
+const AccountingChainName = "CNI-ACCOUNTING"
+
+// containerChainPrefix follows "CNI-" in the per-container chain names.
+const containerChainPrefix = "AC-"
+
+// AccountingNetConf represents the accounting plugin configuration.
+type AccountingNetConf struct {
+	types.NetConf
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+func parseConf(data []byte, ifName string) (*AccountingNetConf, []net.IP, error) {
+	conf := AccountingNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	// The previous result may leave its version to the configuration
+	if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+		conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+	}
+	resultBytes, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	res, err := version.NewResult(conf.CNIVersion, resultBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	conf.RawPrevResult = nil
+	conf.PrevResult, err = current.NewResultFromResult(res)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	return &conf, utils.ContainerIPs(conf.PrevResult, ifName), nil
+}
+
+// genAccountingChain creates the shared chain. It sees the forwarded
+// traffic as well as the traffic between the containers and the host.
+func genAccountingChain() utils.Chain {
+	return utils.Chain{
+		Table:       "filter",
+		Name:        AccountingChainName,
+		EntryChains: []string{"FORWARD", "INPUT", "OUTPUT"},
+		EntryRules:  [][]string{{"-m", "comment", "--comment", "CNI accounting plugin rules"}},
+	}
+}
+
+// genContainerChain creates the chain of a container. The traffic to each
+// of its IPs is counted by a "-d" rule and the traffic from it by a "-s"
+// rule; the rules carry the network name and container ID in a comment.
+func genContainerChain(netName, containerID string, ips []net.IP) utils.Chain {
+	ch := utils.Chain{
+		Table:       "filter",
+		Name:        utils.FormatChainNameWithPrefix(netName, containerID, containerChainPrefix),
+		EntryChains: []string{AccountingChainName},
+	}
+
+	comment := utils.FormatComment(netName, containerID)
+	for _, ip := range ips {
+		cidr := utils.HostCIDR(ip)
+		ch.EntryRules = append(ch.EntryRules,
+			[]string{"-d", cidr, "-m", "comment", "--comment", comment},
+			[]string{"-s", cidr, "-m", "comment", "--comment", comment},
+		)
+		ch.Rules = append(ch.Rules,
+			[]string{"-d", cidr, "-m", "comment", "--comment", comment},
+			[]string{"-s", cidr, "-m", "comment", "--comment", comment},
+		)
+	}
+	return ch
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	for proto, ips := range utils.SplitByFamily(containerIPs) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+
+		accountingChain := genAccountingChain()
+		if err := accountingChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", accountingChain.Name, err)
+		}
+
+		containerChain := genContainerChain(conf.Name, args.ContainerID, ips)
+		if err := containerChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", containerChain.Name, err)
+		}
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// Tear down both protocols, since the chain is found by name and we
+	// may not have the IPs. The counters of the container are gone after
+	// this.
+	containerChain := genContainerChain(conf.Name, args.ContainerID, nil)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// Swallow the error - this protocol is not usable, so we
+			// cannot have added anything
+			continue
+		}
+		if err := containerChain.Teardown(ipt); err != nil {
+			return fmt.Errorf("failed to teardown chain %s: %v", containerChain.Name, err)
+		}
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	for proto, ips := range utils.SplitByFamily(containerIPs) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+
+		for _, c := range []utils.Chain{genAccountingChain(), genContainerChain(conf.Name, args.ContainerID, ips)} {
+			if err := c.Check(ipt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		var network string
+		var containerID string
+		statsFlags := flag.NewFlagSet("stats", flag.ExitOnError)
+		statsFlags.StringVar(&network, "network", "", "optional network name to print the counters of")
+		statsFlags.StringVar(&containerID, "container", "", "optional container ID to print the counters of")
+		statsFlags.Parse(os.Args[2:])
+
+		if err := printStats(os.Stdout, network, containerID); err != nil {
+			log.Print(err.Error())
+			os.Exit(1)
+		}
+	} else {
+		skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI accounting plugin")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/mattn/go-shellwords"
+)
+
+// ContainerStats holds the counters of a container, summed over its IPs.
+// Ingress is the traffic to the container and egress the traffic from it.
+type ContainerStats struct {
+	Network        string `json:"network"`
+	ContainerID    string `json:"containerID"`
+	IngressPackets uint64 `json:"ingressPackets"`
+	IngressBytes   uint64 `json:"ingressBytes"`
+	EgressPackets  uint64 `json:"egressPackets"`
+	EgressBytes    uint64 `json:"egressBytes"`
+}
+
+// counterRule is a counting rule of a container chain.
+type counterRule struct {
+	network     string
+	containerID string
+	ingress     bool
+	packets     uint64
+	bytes       uint64
+}
+
+// parseCounterRule parses a rule as listed by "iptables -v -S", e.g.
+//
+//	-A CNI-AC-... -d 10.0.0.2/32 -m comment --comment "name: \"mynet\" id: \"abc\"" -c 10 840
+func parseCounterRule(rule string) (*counterRule, error) {
+	args, err := shellwords.Parse(rule)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing iptables rule: %s: %v", rule, err)
+	}
+
+	r := &counterRule{}
+	var comment string
+	var hasCounters, hasAddr bool
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-d", "-s":
+			r.ingress = args[i] == "-d"
+			hasAddr = true
+		case "--comment":
+			if i+1 < len(args) {
+				comment = args[i+1]
+			}
+		case "-c":
+			if i+2 >= len(args) {
+				break
+			}
+			if r.packets, err = strconv.ParseUint(args[i+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid packet count in rule %s: %v", rule, err)
+			}
+			if r.bytes, err = strconv.ParseUint(args[i+2], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid byte count in rule %s: %v", rule, err)
+			}
+			hasCounters = true
+		}
+	}
+	if !hasAddr || !hasCounters {
+		return nil, fmt.Errorf("not a counting rule: %s", rule)
+	}
+	if _, err := fmt.Sscanf(comment, "name: %q id: %q", &r.network, &r.containerID); err != nil {
+		return nil, fmt.Errorf("invalid comment in rule %s: %v", rule, err)
+	}
+	return r, nil
+}
+
+// collectStats sums the counters of all container chains, over both
+// protocols. The result is sorted by network and container ID.
+func collectStats() ([]*ContainerStats, error) {
+	stats := map[string]*ContainerStats{}
+
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// This protocol is not usable, so nothing was counted
+			continue
+		}
+
+		chains, err := ipt.ListChains("filter")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chains: %v", err)
+		}
+		for _, chain := range chains {
+			if !strings.HasPrefix(chain, "CNI-"+containerChainPrefix) {
+				continue
+			}
+			rules, err := ipt.ListWithCounters("filter", chain)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list chain %s: %v", chain, err)
+			}
+			for _, rule := range rules {
+				if !strings.HasPrefix(rule, "-A ") {
+					continue
+				}
+				r, err := parseCounterRule(rule)
+				if err != nil {
+					return nil, err
+				}
+				addCounters(stats, r)
+			}
+		}
+	}
+
+	var result []*ContainerStats
+	for _, s := range stats {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Network != result[j].Network {
+			return result[i].Network < result[j].Network
+		}
+		return result[i].ContainerID < result[j].ContainerID
+	})
+	return result, nil
+}
+
+func addCounters(stats map[string]*ContainerStats, r *counterRule) {
+	key := r.network + "/" + r.containerID
+	s, ok := stats[key]
+	if !ok {
+		s = &ContainerStats{Network: r.network, ContainerID: r.containerID}
+		stats[key] = s
+	}
+	if r.ingress {
+		s.IngressPackets += r.packets
+		s.IngressBytes += r.bytes
+	} else {
+		s.EgressPackets += r.packets
+		s.EgressBytes += r.bytes
+	}
+}
+
+// printStats writes the counters as a JSON array, optionally only those
+// of the given network and container.
+func printStats(w io.Writer, network, containerID string) error {
+	stats, err := collectStats()
+	if err != nil {
+		return err
+	}
+
+	filtered := []*ContainerStats{}
+	for _, s := range stats {
+		if (network == "" || s.Network == network) && (containerID == "" || s.ContainerID == containerID) {
+			filtered = append(filtered, s)
+		}
+	}
+
+	data, err := json.MarshalIndent(filtered, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,400 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The interfaces of the previous result of ptp, and of bridge, which lists
+// the bridge before the host veth
+const (
+	ptpInterfaces = `[
+			{"name": "host0"},
+			{"name": "eth0", "sandbox": "netns"}
+		]`
+	bridgeInterfaces = `[
+			{"name": "cni0"},
+			{"name": "host0"},
+			{"name": "eth0", "sandbox": "netns"}
+		]`
+)
+
+func bandwidthConfWithInterfaces(interfaces, bandwidth string) []byte {
+	return []byte(fmt.Sprintf(`{
+	"name": "mynet",
+	"type": "bandwidth",
+	"cniVersion": "0.4.0",
+	"runtimeConfig": {
+		"bandwidth": %s
+	},
+	"prevResult": {
+		"interfaces": %s,
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1"
+			}
+		]
+	}
+}`, bandwidth, interfaces))
+}
+
+func bandwidthConf(bandwidth string) []byte {
+	return bandwidthConfWithInterfaces(ptpInterfaces, bandwidth)
+}
+
+var _ = Describe("bandwidth config", func() {
+	It("takes the limits from the runtimeConfig", func() {
+		conf, err := parseConfig(bandwidthConf(`{"ingressRate": 8000, "ingressBurst": 80, "egressRate": 16000, "egressBurst": 160}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getBandwidth(conf)).To(Equal(&BandwidthEntry{
+			IngressRate:  8000,
+			IngressBurst: 80,
+			EgressRate:   16000,
+			EgressBurst:  160,
+		}))
+	})
+
+	It("prefers the runtime limits to those of the configuration", func() {
+		conf, err := parseConfig([]byte(`{
+	"name": "mynet",
+	"type": "bandwidth",
+	"cniVersion": "0.4.0",
+	"ingressRate": 8000,
+	"ingressBurst": 80
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getBandwidth(conf)).To(Equal(&BandwidthEntry{IngressRate: 8000, IngressBurst: 80}))
+
+		conf, err = parseConfig([]byte(`{
+	"name": "mynet",
+	"type": "bandwidth",
+	"cniVersion": "0.4.0",
+	"ingressRate": 8000,
+	"ingressBurst": 80,
+	"runtimeConfig": {
+		"bandwidth": {"egressRate": 16000, "egressBurst": 160}
+	}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getBandwidth(conf)).To(Equal(&BandwidthEntry{EgressRate: 16000, EgressBurst: 160}))
+	})
+
+	It("rejects a rate without a burst", func() {
+		_, err := parseConfig(bandwidthConf(`{"ingressRate": 8000}`))
+		Expect(err).To(MatchError("if rate is set, burst must also be set"))
+
+		_, err = parseConfig(bandwidthConf(`{"egressBurst": 80}`))
+		Expect(err).To(MatchError("if burst is set, rate must also be set"))
+	})
+
+	It("rejects a burst over 4GB", func() {
+		_, err := parseConfig(bandwidthConf(`{"ingressRate": 8000, "ingressBurst": 34359738368}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("derives a valid ifb device name", func() {
+		name := getIfbDeviceName("mynet", "dummy")
+		Expect(name).To(HavePrefix(ifbDevicePrefix))
+		Expect(len(name)).To(Equal(maxIfbDeviceLength))
+		Expect(getIfbDeviceName("mynet", "dummy")).To(Equal(name))
+		Expect(getIfbDeviceName("mynet", "other")).NotTo(Equal(name))
+	})
+})
+
+var _ = Describe("bandwidth plugin", func() {
+	var hostNs, containerNs ns.NetNS
+	const HOSTIFNAME string = "host0"
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		hostNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		containerNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		// A veth between the namespaces, as ptp or bridge leave it
+		err = hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: HOSTIFNAME,
+				},
+				PeerName: IFNAME,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(hostVeth)).To(Succeed())
+
+			contVeth, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(contVeth, int(containerNs.Fd()))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(containerNs.Close()).To(Succeed())
+		Expect(hostNs.Close()).To(Succeed())
+	})
+
+	It("shapes traffic in both directions with ADD, checks it with CHECK and removes it with DEL", func() {
+		conf := bandwidthConf(`{"ingressRate": 8000, "ingressBurst": 80, "egressRate": 16000, "egressBurst": 160}`)
+		ifbDeviceName := getIfbDeviceName("mynet", "dummy")
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(containerNs.Path(), IFNAME, conf, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(3))
+			Expect(result.Interfaces[2].Name).To(Equal(ifbDeviceName))
+
+			// Traffic towards the container is shaped on the host device
+			tbf, err := getTBF(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).NotTo(BeNil())
+			Expect(tbf.Rate).To(Equal(uint64(1000)))
+
+			// Traffic from the container is redirected to the ifb device
+			// and shaped there
+			hostDevice, err := netlink.LinkByName(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			filters, err := netlink.FilterList(hostDevice, netlink.HANDLE_MIN_INGRESS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(1))
+
+			tbf, err = getTBF(ifbDeviceName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).NotTo(BeNil())
+			Expect(tbf.Rate).To(Equal(uint64(2000)))
+
+			err = testutils.CmdCheckWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// A changed limit is reported against the host device
+			args.StdinData = bandwidthConf(`{"ingressRate": 4000, "ingressBurst": 80}`)
+			err = testutils.CmdCheckWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(`interface "host0"`))
+
+			args.StdinData = conf
+			err = testutils.CmdDelWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = netlink.LinkByName(ifbDeviceName)
+			Expect(err).To(HaveOccurred())
+
+			tbf, err = getTBF(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).To(BeNil())
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("shares the clsact qdisc of the host veth with other plugins", func() {
+		conf := bandwidthConf(`{"egressRate": 16000, "egressBurst": 160}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// A filter of another plugin, e.g. mirror, is already there
+			hostDevice, err := netlink.LinkByName(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ensureClsact(hostDevice)).To(Succeed())
+			lo, err := netlink.LinkByName("lo")
+			Expect(err).NotTo(HaveOccurred())
+			mirror := netlink.NewMirredAction(lo.Attrs().Index)
+			mirror.MirredAction = netlink.TCA_EGRESS_MIRROR
+			err = netlink.FilterAdd(&netlink.U32{
+				FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: hostDevice.Attrs().Index,
+					Parent:    netlink.HANDLE_MIN_INGRESS,
+					Priority:  1,
+					Protocol:  syscall.ETH_P_ALL,
+				},
+				Actions: []netlink.Action{mirror},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = testutils.CmdAddWithResult(containerNs.Path(), IFNAME, conf, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			filters, err := netlink.FilterList(hostDevice, netlink.HANDLE_MIN_INGRESS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(2))
+
+			err = testutils.CmdDelWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Only the redirect is removed, the clsact qdisc stays
+			filters, err = netlink.FilterList(hostDevice, netlink.HANDLE_MIN_INGRESS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(1))
+			Expect(filters[0].Attrs().Priority).To(Equal(uint16(1)))
+
+			qdiscs, err := netlink.QdiscList(hostDevice)
+			Expect(err).NotTo(HaveOccurred())
+			var kinds []string
+			for _, qdisc := range qdiscs {
+				kinds = append(kinds, qdisc.Type())
+			}
+			Expect(kinds).To(ContainElement("clsact"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("passes prevResult through unchanged without limits", func() {
+		conf := bandwidthConf(`{}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(containerNs.Path(), IFNAME, conf, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(2))
+
+			tbf, err := getTBF(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("shapes the host veth rather than the bridge listed before it", func() {
+		const BRNAME = "cni0"
+		conf := bandwidthConfWithInterfaces(bridgeInterfaces, `{"ingressRate": 8000, "ingressBurst": 80, "egressRate": 16000, "egressBurst": 160}`)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: BRNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMaster(hostVeth, br.(*netlink.Bridge))).To(Succeed())
+
+			_, _, err = testutils.CmdAddWithResult(containerNs.Path(), IFNAME, conf, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			tbf, err := getTBF(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).NotTo(BeNil())
+
+			tbf, err = getTBF(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).To(BeNil())
+
+			err = testutils.CmdCheckWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			tbf, err = getTBF(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tbf).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
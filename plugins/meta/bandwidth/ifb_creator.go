@@ -0,0 +1,292 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/vishvananda/netlink"
+)
+
+// latencyInMillis is the maximum time a packet may sit in a tbf queue;
+// it determines the queue limit together with the rate and burst.
+const latencyInMillis = 25
+
+// redirectPriority is the priority of the filter that redirects the traffic
+// from the container to the ifb device. The redirect takes the packets
+// away, so it comes after the filters of other plugins on the clsact
+// qdisc, such as mirror and tc-bpf.
+const redirectPriority = 0xffff
+
+// CreateIfb creates the ifb device that traffic leaving the container is
+// redirected to, so that it can be shaped on egress of the ifb.
+func CreateIfb(ifbDeviceName string, mtu int) error {
+	err := netlink.LinkAdd(&netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  ifbDeviceName,
+			Flags: net.FlagUp,
+			MTU:   mtu,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("adding link: %s", err)
+	}
+
+	return nil
+}
+
+// TeardownIfb deletes the ifb device. It will not error if the device
+// doesn't exist.
+func TeardownIfb(deviceName string) error {
+	err := ip.DelLinkByName(deviceName)
+	if err == ip.ErrLinkNotFound {
+		return nil
+	}
+	return err
+}
+
+// CreateIngressQdisc shapes traffic towards the container with a tbf
+// qdisc on the host side of its veth.
+func CreateIngressQdisc(rateInBits, burstInBits int, hostDeviceName string) error {
+	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	if err != nil {
+		return fmt.Errorf("get host device: %s", err)
+	}
+	return createTBF(rateInBits, burstInBits, hostDevice.Attrs().Index)
+}
+
+// CreateEgressQdisc redirects traffic from the container, which arrives on
+// the ingress of the host veth, to the ifb device and shapes it there. The
+// redirect is on the ingress hook of a clsact qdisc, which other plugins
+// can share.
+func CreateEgressQdisc(rateInBits, burstInBits int, hostDeviceName string, ifbDeviceName string) error {
+	ifbDevice, err := netlink.LinkByName(ifbDeviceName)
+	if err != nil {
+		return fmt.Errorf("get ifb device: %s", err)
+	}
+	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	if err != nil {
+		return fmt.Errorf("get host device: %s", err)
+	}
+
+	if err := ensureClsact(hostDevice); err != nil {
+		return err
+	}
+
+	// add filter on host device to redirect traffic to ifb device
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostDevice.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  redirectPriority,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifbDevice.Attrs().Index,
+	}
+	err = netlink.FilterAdd(filter)
+	if err != nil {
+		return fmt.Errorf("add filter: %s", err)
+	}
+
+	// throttle traffic on ifb device
+	err = createTBF(rateInBits, burstInBits, ifbDevice.Attrs().Index)
+	if err != nil {
+		return fmt.Errorf("create ifb qdisc: %s", err)
+	}
+	return nil
+}
+
+// ensureClsact adds a clsact qdisc to the device, unless it already has one.
+func ensureClsact(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	for _, qdisc := range qdiscs {
+		switch qdisc.Type() {
+		case "clsact":
+			return nil
+		case "ingress":
+			return fmt.Errorf("device %q has an ingress qdisc, shaping the egress needs a clsact qdisc", link.Attrs().Name)
+		}
+	}
+
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(clsact); err != nil {
+		return fmt.Errorf("create clsact qdisc: %s", err)
+	}
+	return nil
+}
+
+// TeardownHostQdiscs removes the root tbf and the redirect filter from the
+// host device, and the clsact qdisc if nothing else uses it. The ingress
+// qdisc of earlier versions is removed as well. It will not error if the
+// device or the qdiscs don't exist.
+func TeardownHostQdiscs(hostDeviceName string) error {
+	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("get host device: %s", err)
+	}
+
+	qdiscs, err := netlink.QdiscList(hostDevice)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	for _, qdisc := range qdiscs {
+		switch q := qdisc.(type) {
+		case *netlink.Tbf:
+			if q.Parent != netlink.HANDLE_ROOT {
+				continue
+			}
+		case *netlink.Ingress:
+		default:
+			if qdisc.Type() == "clsact" {
+				if err := teardownRedirect(hostDevice, qdisc); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("delete %s qdisc: %s", qdisc.Type(), err)
+		}
+	}
+	return nil
+}
+
+// getRedirect returns the redirect filter of the device, or nil if there is
+// none.
+func getRedirect(link netlink.Link) (*netlink.U32, error) {
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		return nil, fmt.Errorf("list filters: %s", err)
+	}
+	for _, filter := range filters {
+		if u32, ok := filter.(*netlink.U32); ok && u32.Priority == redirectPriority {
+			return u32, nil
+		}
+	}
+	return nil, nil
+}
+
+// teardownRedirect removes the redirect filter, and the clsact qdisc if it
+// has no other filters left.
+func teardownRedirect(link netlink.Link, clsact netlink.Qdisc) error {
+	filter, err := getRedirect(link)
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		if err := netlink.FilterDel(filter); err != nil {
+			return fmt.Errorf("delete filter: %s", err)
+		}
+	}
+
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		remaining, err := netlink.FilterList(link, parent)
+		if err != nil {
+			return fmt.Errorf("list filters: %s", err)
+		}
+		if len(remaining) > 0 {
+			return nil
+		}
+	}
+	if err := netlink.QdiscDel(clsact); err != nil {
+		return fmt.Errorf("delete clsact qdisc: %s", err)
+	}
+	return nil
+}
+
+// getTBF returns the root tbf qdisc of the device, or nil if there is none.
+func getTBF(deviceName string) (*netlink.Tbf, error) {
+	device, err := netlink.LinkByName(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	qdiscs, err := netlink.QdiscList(device)
+	if err != nil {
+		return nil, fmt.Errorf("list qdiscs: %s", err)
+	}
+	for _, qdisc := range qdiscs {
+		if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+			return tbf, nil
+		}
+	}
+	return nil, nil
+}
+
+func createTBF(rateInBits, burstInBits, linkIndex int) error {
+	// Equivalent to
+	// tc qdisc add dev link root tbf
+	//		rate netConf.BandwidthLimits.Rate
+	//		burst netConf.BandwidthLimits.Burst
+	if rateInBits <= 0 {
+		return fmt.Errorf("invalid rate: %d", rateInBits)
+	}
+	if burstInBits <= 0 {
+		return fmt.Errorf("invalid burst: %d", burstInBits)
+	}
+	rateInBytes := rateInBits / 8
+	burstInBytes := burstInBits / 8
+	bufferInBytes := buffer(uint64(rateInBytes), uint32(burstInBytes))
+	latency := latencyInUsec(latencyInMillis)
+	limitInBytes := limit(uint64(rateInBytes), latency, uint32(burstInBytes))
+
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  uint32(limitInBytes),
+		Rate:   uint64(rateInBytes),
+		Buffer: uint32(bufferInBytes),
+	}
+	err := netlink.QdiscAdd(qdisc)
+	if err != nil {
+		return fmt.Errorf("create qdisc: %s", err)
+	}
+	return nil
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * float64(netlink.TickInUsec()))
+}
+
+func buffer(rate uint64, burst uint32) uint32 {
+	return time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+}
+
+func limit(rate uint64, latency float64, buffer uint32) uint32 {
+	return uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + buffer
+}
+
+func latencyInUsec(latencyInMillis float64) float64 {
+	return float64(netlink.TIME_UNITS_PER_SEC) * (latencyInMillis / 1000.0)
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "meta-plugin". It reads the bandwidth limits from the
+// runtimeConfig and shapes the traffic of the container using tc on the
+// host side of its veth.
+
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// maxIfbDeviceLength is the longest interface name the kernel accepts.
+const maxIfbDeviceLength = 15
+const ifbDevicePrefix = "bwp"
+
+// BandwidthEntry corresponds to a single entry in the bandwidth argument,
+// see CONVENTIONS.md
+type BandwidthEntry struct {
+	IngressRate  int `json:"ingressRate"`  // Bandwidth rate in bps for traffic through container. 0 for no limit. If ingressRate is set, ingressBurst must also be set
+	IngressBurst int `json:"ingressBurst"` // Bandwidth burst in bits for traffic through container. 0 for no limit. If ingressBurst is set, ingressRate must also be set
+
+	EgressRate  int `json:"egressRate"`  // Bandwidth rate in bps for traffic through container. 0 for no limit. If egressRate is set, egressBurst must also be set
+	EgressBurst int `json:"egressBurst"` // Bandwidth burst in bits for traffic through container. 0 for no limit. If egressBurst is set, egressRate must also be set
+}
+
+func (bw *BandwidthEntry) isZero() bool {
+	return bw.IngressBurst == 0 && bw.IngressRate == 0 && bw.EgressBurst == 0 && bw.EgressRate == 0
+}
+
+// PluginConf represents the bandwidth plugin configuration.
+type PluginConf struct {
+	types.NetConf
+
+	RuntimeConfig struct {
+		Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+
+	// Limits for every container of the network; the runtime's take
+	// precedence
+	*BandwidthEntry
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from stdin.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	bandwidth := getBandwidth(&conf)
+	if bandwidth != nil {
+		if err := validateRateAndBurst(bandwidth.IngressRate, bandwidth.IngressBurst); err != nil {
+			return nil, err
+		}
+		if err := validateRateAndBurst(bandwidth.EgressRate, bandwidth.EgressBurst); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	return &conf, nil
+}
+
+// getBandwidth returns the limits passed by the runtime, or else those of
+// the network configuration.
+func getBandwidth(conf *PluginConf) *BandwidthEntry {
+	if conf.RuntimeConfig.Bandwidth != nil {
+		return conf.RuntimeConfig.Bandwidth
+	}
+	return conf.BandwidthEntry
+}
+
+func validateRateAndBurst(rate int, burst int) error {
+	switch {
+	case burst < 0 || rate < 0:
+		return fmt.Errorf("rate and burst must be a positive integer")
+	case burst == 0 && rate != 0:
+		return fmt.Errorf("if rate is set, burst must also be set")
+	case rate == 0 && burst != 0:
+		return fmt.Errorf("if burst is set, rate must also be set")
+	case uint64(burst)/8 > math.MaxUint32:
+		return fmt.Errorf("burst cannot be more than 4GB")
+	}
+
+	return nil
+}
+
+// getIfbDeviceName derives a stable name for the ifb device of the given
+// container, so that DEL can find it again.
+func getIfbDeviceName(networkName string, containerID string) string {
+	output := sha512.Sum512([]byte(networkName + containerID))
+	name := fmt.Sprintf("%s%x", ifbDevicePrefix, output)
+	return name[:maxIfbDeviceLength]
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	bandwidth := getBandwidth(conf)
+	if bandwidth == nil || bandwidth.isZero() {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	result := conf.PrevResult
+	hostVeth, err := ip.GetHostVethPeer(args.Netns, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if bandwidth.IngressRate > 0 && bandwidth.IngressBurst > 0 {
+		err = CreateIngressQdisc(bandwidth.IngressRate, bandwidth.IngressBurst, hostVeth.Attrs().Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bandwidth.EgressRate > 0 && bandwidth.EgressBurst > 0 {
+		ifbDeviceName := getIfbDeviceName(conf.Name, args.ContainerID)
+
+		err = CreateIfb(ifbDeviceName, hostVeth.Attrs().MTU)
+		if err != nil {
+			return err
+		}
+
+		ifbDevice, err := netlink.LinkByName(ifbDeviceName)
+		if err != nil {
+			return err
+		}
+
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: ifbDeviceName,
+			Mac:  ifbDevice.Attrs().HardwareAddr.String(),
+		})
+		err = CreateEgressQdisc(bandwidth.EgressRate, bandwidth.EgressBurst, hostVeth.Attrs().Name, ifbDeviceName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// The qdiscs go away with the host veth, but the veth stays when only
+	// this plugin is removed from the chain
+	if args.Netns != "" {
+		hostVeth, err := ip.GetHostVethPeer(args.Netns, args.IfName)
+		if err == nil {
+			if err := TeardownHostQdiscs(hostVeth.Attrs().Name); err != nil {
+				return err
+			}
+		} else if _, ok := err.(ns.NSPathNotExistErr); !ok && err != ip.ErrLinkNotFound {
+			return err
+		}
+	}
+
+	ifbDeviceName := getIfbDeviceName(conf.Name, args.ContainerID)
+
+	return TeardownIfb(ifbDeviceName)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	bandwidth := getBandwidth(conf)
+	if bandwidth == nil || bandwidth.isZero() {
+		return nil
+	}
+
+	hostVeth, err := ip.GetHostVethPeer(args.Netns, args.IfName)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "failed to find host veth of %q: %v", args.IfName, err)
+	}
+
+	if bandwidth.IngressRate > 0 && bandwidth.IngressBurst > 0 {
+		if err := checkTBF(hostVeth.Attrs().Name, bandwidth.IngressRate); err != nil {
+			return err
+		}
+	}
+
+	if bandwidth.EgressRate > 0 && bandwidth.EgressBurst > 0 {
+		ifbDeviceName := getIfbDeviceName(conf.Name, args.ContainerID)
+		if err := checkTBF(ifbDeviceName, bandwidth.EgressRate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTBF verifies that the device has a root tbf qdisc shaping at rate.
+func checkTBF(deviceName string, rateInBits int) error {
+	resource := fmt.Sprintf("interface %q", deviceName)
+
+	tbf, err := getTBF(deviceName)
+	if err != nil {
+		return utils.NewCheckError(resource, "failed to get tbf qdisc of %q: %v", deviceName, err)
+	}
+	if tbf == nil {
+		return utils.NewCheckError(resource, "no tbf qdisc on %q", deviceName)
+	}
+	if tbf.Rate != uint64(rateInBits/8) {
+		return utils.NewCheckError(resource, "tbf qdisc on %q has rate %d bps, expected %d bps", deviceName, tbf.Rate*8, rateInBits)
+	}
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI bandwidth plugin")
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that allows forwarded traffic to and from the
+// container through the host firewall, for hosts whose FORWARD policy drops
+// it by default.
+//
+// It is intended to be used as a chained CNI plugin, and determines the
+// container IPs from the previous result. Each container gets its own chain,
+// jumped to from the CNI-FORWARD chain, so that DEL can remove it in one go.
+// An admin chain is evaluated before CNI-FORWARD and is never modified by
+// the plugin, so administrators can add their own rules there.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// The names of the shared chains.
+// These should never be changed, or else upgrading will require manual
+// intervention.
+const ForwardChainName = "CNI-FORWARD"
+const DefaultAdminChainName = "CNI-ADMIN"
+
+// FirewallNetConf represents the firewall plugin configuration.
+type FirewallNetConf struct {
+	types.NetConf
+
+	// IptablesAdminChainName is an optional name to use instead of
+	// CNI-ADMIN for the chain holding the administrator's rules.
+	IptablesAdminChainName string `json:"iptablesAdminChainName,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+func parseConf(data []byte, ifName string) (*FirewallNetConf, []net.IP, error) {
+	conf := FirewallNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.IptablesAdminChainName == "" {
+		conf.IptablesAdminChainName = DefaultAdminChainName
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	// The previous result may leave its version to the configuration
+	if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+		conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+	}
+	resultBytes, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	res, err := version.NewResult(conf.CNIVersion, resultBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	conf.RawPrevResult = nil
+	conf.PrevResult, err = current.NewResultFromResult(res)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	return &conf, utils.ContainerIPs(conf.PrevResult, ifName), nil
+}
+
+// genForwardChain creates the top-level chain that the per-container
+// chains hang off.
+func genForwardChain() utils.Chain {
+	return utils.Chain{
+		Table:       "filter",
+		Name:        ForwardChainName,
+		EntryChains: []string{"FORWARD"},
+		EntryRules:  [][]string{{"-m", "comment", "--comment", "CNI firewall plugin rules"}},
+	}
+}
+
+// genAdminChain creates the chain for the administrator's rules. It is
+// set up after the forward chain, so its entry rule comes first.
+func genAdminChain(name string) utils.Chain {
+	return utils.Chain{
+		Table:       "filter",
+		Name:        name,
+		EntryChains: []string{"FORWARD"},
+		EntryRules:  [][]string{{"-m", "comment", "--comment", "CNI firewall plugin admin overrides"}},
+	}
+}
+
+// genContainerChain creates the per-container chain. It accepts traffic
+// from the container and the replies to it; traffic reaches it through an
+// entry rule per container IP.
+func genContainerChain(netName, containerID string, ips []net.IP) utils.Chain {
+	c := utils.Chain{
+		Table:       "filter",
+		Name:        utils.FormatChainNameWithPrefix(netName, containerID, "FW-"),
+		EntryChains: []string{ForwardChainName},
+	}
+
+	comment := utils.FormatComment(netName, containerID)
+	for _, ip := range ips {
+		addr := utils.HostCIDR(ip)
+		c.EntryRules = append(c.EntryRules,
+			[]string{"-s", addr, "-m", "comment", "--comment", comment},
+			[]string{"-d", addr, "-m", "comment", "--comment", comment},
+		)
+		c.Rules = append(c.Rules,
+			[]string{"-s", addr, "-j", "ACCEPT"},
+			[]string{"-d", addr, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		)
+	}
+	return c
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	for proto, ips := range utils.SplitByFamily(containerIPs) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+
+		forwardChain := genForwardChain()
+		if err := forwardChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", forwardChain.Name, err)
+		}
+
+		adminChain := genAdminChain(conf.IptablesAdminChainName)
+		if err := adminChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", adminChain.Name, err)
+		}
+
+		containerChain := genContainerChain(conf.Name, args.ContainerID, ips)
+		if err := containerChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", containerChain.Name, err)
+		}
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// The container chain is found by name, so we don't need the IPs;
+	// deletion is idempotent
+	containerChain := genContainerChain(conf.Name, args.ContainerID, nil)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// Swallow the error - this protocol is not usable, so we
+			// cannot have added anything
+			continue
+		}
+		if err := containerChain.Teardown(ipt); err != nil {
+			return fmt.Errorf("failed to teardown chain %s: %v", containerChain.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	for proto, ips := range utils.SplitByFamily(containerIPs) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+
+		for _, c := range []utils.Chain{
+			genForwardChain(),
+			genAdminChain(conf.IptablesAdminChainName),
+			genContainerChain(conf.Name, args.ContainerID, ips),
+		} {
+			if err := c.Check(ipt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI firewall plugin")
+}
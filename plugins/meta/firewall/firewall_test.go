@@ -0,0 +1,181 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const firewallConf = `{
+	"name": "test",
+	"type": "firewall",
+	"cniVersion": "0.4.0",
+	"prevResult": {
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			},
+			{
+				"version": "4",
+				"address": "10.0.0.1/24",
+				"interface": 0
+			}
+		]
+	}
+}`
+
+var _ = Describe("firewall configuration", func() {
+	It("finds the container IPs in the previous result", func() {
+		conf, ips, err := parseConf([]byte(firewallConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IptablesAdminChainName).To(Equal(DefaultAdminChainName))
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+	})
+
+	It("generates a correct container chain", func() {
+		ch := genContainerChain("test", "dummy", []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2")})
+		comment := utils.FormatComment("test", "dummy")
+		Expect(ch).To(Equal(utils.Chain{
+			Table:       "filter",
+			Name:        "CNI-FW-c606a6fca1d31e8dad40c",
+			EntryChains: []string{"CNI-FORWARD"},
+			EntryRules: [][]string{
+				{"-s", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+				{"-d", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+				{"-s", "2001:db8::2/128", "-m", "comment", "--comment", comment},
+				{"-d", "2001:db8::2/128", "-m", "comment", "--comment", comment},
+			},
+			Rules: [][]string{
+				{"-s", "10.0.0.2/32", "-j", "ACCEPT"},
+				{"-d", "10.0.0.2/32", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+				{"-s", "2001:db8::2/128", "-j", "ACCEPT"},
+				{"-d", "2001:db8::2/128", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+			},
+		}))
+	})
+})
+
+var _ = Describe("firewall plugin", func() {
+	var originalNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("installs the rules with ADD, checks them with CHECK and removes them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   []byte(firewallConf),
+		}
+		containerChain := genContainerChain("test", "dummy", nil).Name
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(2))
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The admin chain is evaluated before the plugin's rules
+			rules, err := ipt.List("filter", "FORWARD")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1]).To(HaveSuffix("-j " + DefaultAdminChainName))
+			Expect(rules[2]).To(HaveSuffix("-j " + ForwardChainName))
+
+			rules, err = ipt.List("filter", ForwardChainName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(HaveLen(3))
+			for _, rule := range rules[1:] {
+				Expect(rule).To(ContainSubstring("10.0.0.2/32"))
+				Expect(rule).To(HaveSuffix("-j " + containerChain))
+			}
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Drop the accept rule for traffic from the container
+			err = ipt.Delete("filter", containerChain, "-s", "10.0.0.2/32", "-j", "ACCEPT")
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf("chain %q", containerChain)))
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "filter", containerChain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			rules, err = ipt.List("filter", ForwardChainName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(HaveLen(1))
+
+			// The shared chains are kept
+			exists, err = utils.ChainExists(ipt, "filter", DefaultAdminChainName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
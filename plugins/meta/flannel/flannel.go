@@ -20,6 +20,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -33,6 +34,7 @@ import (
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
 )
 
 const (
@@ -148,6 +150,10 @@ func consumeScratchNetConf(containerID, dataDir string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+func readScratchNetConf(containerID, dataDir string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(dataDir, containerID))
+}
+
 func delegateAdd(cid, dataDir string, netconf map[string]interface{}) error {
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
@@ -159,7 +165,7 @@ func delegateAdd(cid, dataDir string, netconf map[string]interface{}) error {
 		return err
 	}
 
-	result, err := invoke.DelegateAdd(netconf["type"].(string), netconfBytes)
+	result, err := invoke.DelegateAdd(context.TODO(), netconf["type"].(string), netconfBytes, nil)
 	if err != nil {
 		return err
 	}
@@ -261,9 +267,48 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to parse netconf: %v", err)
 	}
 
-	return invoke.DelegateDel(n.Type, netconfBytes)
+	return invoke.DelegateDel(context.TODO(), n.Type, netconfBytes, nil)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	nc, err := loadFlannelNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netconfBytes, err := readScratchNetConf(args.ContainerID, nc.DataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return utils.NewCheckError(fmt.Sprintf("netconf %q", args.ContainerID), "no saved netconf for container %q", args.ContainerID)
+		}
+		return err
+	}
+
+	// The delegate must see the same cniVersion and prevResult as we did
+	stdin := map[string]interface{}{}
+	if err = json.Unmarshal(args.StdinData, &stdin); err != nil {
+		return fmt.Errorf("failed to parse netconf: %v", err)
+	}
+	netconf := map[string]interface{}{}
+	if err = json.Unmarshal(netconfBytes, &netconf); err != nil {
+		return fmt.Errorf("failed to parse netconf: %v", err)
+	}
+	netconf["cniVersion"] = nc.CNIVersion
+	if prevResult, ok := stdin["prevResult"]; ok {
+		netconf["prevResult"] = prevResult
+	}
+	if !hasKey(netconf, "type") || !isString(netconf["type"]) {
+		return fmt.Errorf("saved netconf has no delegate type")
+	}
+
+	netconfBytes, err = json.Marshal(netconf)
+	if err != nil {
+		return fmt.Errorf("error serializing delegate netconf: %v", err)
+	}
+
+	return invoke.DelegateCheck(context.TODO(), netconf["type"].(string), netconfBytes, nil)
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI flannel plugin")
 }
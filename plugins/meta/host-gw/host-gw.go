@@ -0,0 +1,334 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that routes the pod subnets of the other
+// nodes through their node IPs, as the flannel host-gw backend does, but
+// from a static list of peers. Together with bridge and host-local it
+// connects the containers of a small cluster whose nodes share a layer 2
+// network.
+//
+// The routes are shared by all containers of the host. They are tagged
+// with their own routing protocol, and the peers of each network are kept
+// in a state file, so that the routes of peers that are no longer listed
+// can be removed on the next ADD without touching other networks.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// routeProtocol marks the routes managed by this plugin
+const routeProtocol = 73
+
+const defaultDataDir = "/var/lib/cni/host-gw"
+
+// Peer is a remote node and its pod subnet.
+type Peer struct {
+	Subnet types.IPNet `json:"subnet"`
+	NodeIP net.IP      `json:"nodeIP"`
+}
+
+// PeerFile is the format of the peer file.
+type PeerFile struct {
+	Peers []Peer `json:"peers"`
+}
+
+// HostGWConf represents the host-gw plugin configuration.
+type HostGWConf struct {
+	types.NetConf
+	Peers    []Peer `json:"peers,omitempty"`
+	PeerFile string `json:"peerFile,omitempty"`
+	DataDir  string `json:"dataDir,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+func parseConf(data []byte) (*HostGWConf, error) {
+	conf := HostGWConf{
+		DataDir: defaultDataDir,
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	if err := validatePeers(conf.Peers); err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+func validatePeers(peers []Peer) error {
+	for _, p := range peers {
+		if p.NodeIP == nil {
+			return fmt.Errorf("nodeIP must be specified for subnet %s", (*net.IPNet)(&p.Subnet))
+		}
+		if (p.NodeIP.To4() != nil) != (p.Subnet.IP.To4() != nil) {
+			return fmt.Errorf("node IP %s is not in the same family as subnet %s", p.NodeIP, (*net.IPNet)(&p.Subnet))
+		}
+	}
+	return nil
+}
+
+// loadPeers returns the peers of the config, followed by those of the
+// peer file. The file is read on every call, so that edits are picked up
+// by the next ADD.
+func loadPeers(conf *HostGWConf) ([]Peer, error) {
+	peers := append([]Peer{}, conf.Peers...)
+	if conf.PeerFile == "" {
+		return peers, nil
+	}
+
+	data, err := ioutil.ReadFile(conf.PeerFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer file: %v", err)
+	}
+	pf := PeerFile{}
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("failed to parse peer file %s: %v", conf.PeerFile, err)
+	}
+	if err := validatePeers(pf.Peers); err != nil {
+		return nil, fmt.Errorf("invalid peer file %s: %v", conf.PeerFile, err)
+	}
+
+	return append(peers, pf.Peers...), nil
+}
+
+// genRoutes returns the routes to the peers that are not this node. The
+// same peer list can thus be given to every node.
+func genRoutes(peers []Peer, isLocal func(net.IP) bool) []netlink.Route {
+	var routes []netlink.Route
+	for i := range peers {
+		if isLocal(peers[i].NodeIP) {
+			continue
+		}
+		routes = append(routes, peerRoute(&peers[i]))
+	}
+	return routes
+}
+
+// localAddrs returns a function that reports whether an IP is assigned
+// to this host.
+func localAddrs() (func(net.IP) bool, error) {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host addresses: %v", err)
+	}
+	return func(ip net.IP) bool {
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func routeKey(r *netlink.Route) string {
+	return r.Dst.String() + " via " + r.Gw.String()
+}
+
+// peerRoute returns the route to the subnet of a peer.
+func peerRoute(p *Peer) netlink.Route {
+	dst := net.IPNet{IP: p.Subnet.IP.Mask(p.Subnet.Mask), Mask: p.Subnet.Mask}
+	return netlink.Route{
+		Dst:      &dst,
+		Gw:       p.NodeIP,
+		Protocol: routeProtocol,
+	}
+}
+
+// syncRoutes adds the routes of the network, and removes the routes of
+// the peers it had on the previous ADD that it no longer lists, unless
+// another network still routes them.
+func syncRoutes(dataDir, network string, routes []netlink.Route) error {
+	lock, err := lockState(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to lock state: %v", err)
+	}
+	defer lock.Close()
+
+	old, err := loadState(dataDir, network)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	s := &state{}
+	for i := range routes {
+		route := &routes[i]
+		// The node must be directly reachable
+		via, err := netlink.RouteGet(route.Gw)
+		if err != nil {
+			return fmt.Errorf("failed to find the route to node %s: %v", route.Gw, err)
+		}
+		if len(via) == 0 || via[0].Gw != nil {
+			return fmt.Errorf("node %s is not directly reachable", route.Gw)
+		}
+		route.LinkIndex = via[0].LinkIndex
+
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", routeKey(route), err)
+		}
+		wanted[routeKey(route)] = true
+		s.Peers = append(s.Peers, Peer{Subnet: types.IPNet(*route.Dst), NodeIP: route.Gw})
+	}
+
+	others, err := otherNetworks(dataDir, network)
+	if err != nil {
+		return err
+	}
+	// The routes that other networks list stay
+	for _, other := range others {
+		otherState, err := loadState(dataDir, other)
+		if err != nil {
+			return err
+		}
+		for i := range otherState.Peers {
+			route := peerRoute(&otherState.Peers[i])
+			wanted[routeKey(&route)] = true
+		}
+	}
+
+	for i := range old.Peers {
+		route := peerRoute(&old.Peers[i])
+		if wanted[routeKey(&route)] {
+			continue
+		}
+		if err := netlink.RouteDel(&route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route %s: %v", routeKey(&route), err)
+		}
+	}
+
+	return saveState(dataDir, network, s)
+}
+
+// listRoutes returns the routes of the plugin in the main table.
+func listRoutes() ([]netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+		&netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	return routes, nil
+}
+
+func peerRoutes(conf *HostGWConf) ([]netlink.Route, error) {
+	peers, err := loadPeers(conf)
+	if err != nil {
+		return nil, err
+	}
+	isLocal, err := localAddrs()
+	if err != nil {
+		return nil, err
+	}
+	return genRoutes(peers, isLocal), nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	routes, err := peerRoutes(conf)
+	if err != nil {
+		return err
+	}
+	if err := syncRoutes(conf.DataDir, conf.Name, routes); err != nil {
+		return err
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	// The routes are shared by all containers of the host, so there is
+	// nothing to remove
+	_, err := parseConf(args.StdinData)
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	routes, err := peerRoutes(conf)
+	if err != nil {
+		return err
+	}
+	existing, err := listRoutes()
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for i := range existing {
+		found[routeKey(&existing[i])] = true
+	}
+	for i := range routes {
+		if key := routeKey(&routes[i]); !found[key] {
+			return utils.NewCheckError(fmt.Sprintf("route %q", key), "route %s is missing", key)
+		}
+	}
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI host-gw plugin")
+}
@@ -0,0 +1,302 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prevResult = `{
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.244.1.2/24",
+				"gateway": "10.244.1.1",
+				"interface": 1
+			}
+		]
+	}`
+
+func hostGWConf(name, peers, peerFile, dataDir string) []byte {
+	return []byte(fmt.Sprintf(`{
+	"name": %q,
+	"type": "host-gw",
+	"cniVersion": "0.4.0",
+	"peers": %s,
+	"peerFile": %q,
+	"dataDir": %q,
+	"prevResult": %s
+}`, name, peers, peerFile, dataDir, prevResult))
+}
+
+var _ = Describe("host-gw configuration", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "host-gw")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("merges the peers of the config and of the peer file", func() {
+		peerFile := filepath.Join(dir, "peers.json")
+		Expect(ioutil.WriteFile(peerFile, []byte(`{
+	"peers": [{"subnet": "10.244.3.0/24", "nodeIP": "192.0.2.13"}]
+}`), 0644)).To(Succeed())
+
+		conf, err := parseConf(hostGWConf("test", `[{"subnet": "10.244.2.0/24", "nodeIP": "192.0.2.12"}]`, peerFile, dir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.PrevResult).NotTo(BeNil())
+
+		peers, err := loadPeers(conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peers).To(HaveLen(2))
+		Expect(peers[0].NodeIP.String()).To(Equal("192.0.2.12"))
+		Expect(peers[1].NodeIP.String()).To(Equal("192.0.2.13"))
+	})
+
+	It("rejects a node IP of another family", func() {
+		_, err := parseConf(hostGWConf("test", `[{"subnet": "10.244.2.0/24", "nodeIP": "2001:db8::12"}]`, "", dir))
+		Expect(err).To(MatchError("node IP 2001:db8::12 is not in the same family as subnet 10.244.2.0/24"))
+	})
+
+	It("rejects an invalid peer file", func() {
+		peerFile := filepath.Join(dir, "peers.json")
+		Expect(ioutil.WriteFile(peerFile, []byte(`{"peers": [{"subnet": "10.244.3.0/24"}]}`), 0644)).To(Succeed())
+
+		conf, err := parseConf(hostGWConf("test", `[]`, peerFile, dir))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = loadPeers(conf)
+		Expect(err).To(MatchError(fmt.Sprintf("invalid peer file %s: nodeIP must be specified for subnet 10.244.3.0/24", peerFile)))
+	})
+
+	It("skips the local node", func() {
+		_, subnet, _ := net.ParseCIDR("10.244.1.0/24")
+		_, remote, _ := net.ParseCIDR("10.244.2.0/24")
+		peers := []Peer{
+			{Subnet: types.IPNet(*subnet), NodeIP: net.ParseIP("192.0.2.11")},
+			{Subnet: types.IPNet(*remote), NodeIP: net.ParseIP("192.0.2.12")},
+		}
+		routes := genRoutes(peers, func(ip net.IP) bool {
+			return ip.Equal(net.ParseIP("192.0.2.11"))
+		})
+		Expect(routes).To(HaveLen(1))
+		Expect(routeKey(&routes[0])).To(Equal("10.244.2.0/24 via 192.0.2.12"))
+		Expect(routes[0].Protocol).To(Equal(routeProtocol))
+	})
+})
+
+var _ = Describe("host-gw plugin", func() {
+	var originalNS ns.NetNS
+	var dir string
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		dir, err = ioutil.TempDir("", "host-gw")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "node0"}})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName("node0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.11/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("adds the peer routes with ADD, and removes unlisted peers on the next ADD", func() {
+		peerFile := filepath.Join(dir, "peers.json")
+		Expect(ioutil.WriteFile(peerFile, []byte(`{
+	"peers": [
+		{"subnet": "10.244.1.0/24", "nodeIP": "192.0.2.11"},
+		{"subnet": "10.244.2.0/24", "nodeIP": "192.0.2.12"},
+		{"subnet": "10.244.3.0/24", "nodeIP": "192.0.2.13"}
+	]
+}`), 0644)).To(Succeed())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   hostGWConf("test", `[]`, peerFile, dir),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err := listRoutes()
+			Expect(err).NotTo(HaveOccurred())
+			var keys []string
+			for i := range routes {
+				keys = append(keys, routeKey(&routes[i]))
+			}
+			Expect(keys).To(ConsistOf("10.244.2.0/24 via 192.0.2.12", "10.244.3.0/24 via 192.0.2.13"))
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(peerFile, []byte(`{
+	"peers": [{"subnet": "10.244.2.0/24", "nodeIP": "192.0.2.12"}]
+}`), 0644)).To(Succeed())
+			_, _, err = testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err = listRoutes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routeKey(&routes[0])).To(Equal("10.244.2.0/24 via 192.0.2.12"))
+
+			// Remove the route behind the plugin's back
+			Expect(netlink.RouteDel(&routes[0])).To(Succeed())
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(`route "10.244.2.0/24 via 192.0.2.12"`))
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("leaves the routes of other networks alone", func() {
+		peers := `[
+		{"subnet": "10.244.2.0/24", "nodeIP": "192.0.2.12"},
+		{"subnet": "10.244.3.0/24", "nodeIP": "192.0.2.13"}
+	]`
+		argsA := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   hostGWConf("a", peers, "", dir),
+		}
+		argsB := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   hostGWConf("b", `[{"subnet": "10.244.4.0/24", "nodeIP": "192.0.2.14"}]`, "", dir),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, args := range []*skel.CmdArgs{argsA, argsB} {
+				_, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			routes, err := listRoutes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(3))
+
+			// Network a drops a peer, which b still routes
+			argsA.StdinData = hostGWConf("a", `[
+		{"subnet": "10.244.2.0/24", "nodeIP": "192.0.2.12"},
+		{"subnet": "10.244.4.0/24", "nodeIP": "192.0.2.14"}
+	]`, "", dir)
+			_, _, err = testutils.CmdAddWithResult(argsA.Netns, IFNAME, argsA.StdinData, func() error {
+				return cmdAdd(argsA)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err = listRoutes()
+			Expect(err).NotTo(HaveOccurred())
+			var keys []string
+			for i := range routes {
+				keys = append(keys, routeKey(&routes[i]))
+			}
+			Expect(keys).To(ConsistOf("10.244.2.0/24 via 192.0.2.12", "10.244.4.0/24 via 192.0.2.14"))
+
+			err = testutils.CmdCheckWithResult(argsB.Netns, IFNAME, func() error {
+				return cmdCheck(argsB)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("fails if a node is not directly reachable", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   hostGWConf("test", `[{"subnet": "10.244.4.0/24", "nodeIP": "198.51.100.4"}]`, "", dir),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
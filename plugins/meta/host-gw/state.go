@@ -0,0 +1,95 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// state is what the plugin keeps about the routes of a network, so that
+// the routes of its old peers can be removed without touching those of the
+// other networks.
+type state struct {
+	Peers []Peer `json:"peers,omitempty"`
+}
+
+func statePath(dataDir, network string) string {
+	return filepath.Join(dataDir, network)
+}
+
+// lockState takes the lock of the state of all networks, creating the data
+// directory if needed.
+func lockState(dataDir string) (*filemutex.FileMutex, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := filemutex.New(filepath.Join(dataDir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Lock(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// loadState returns the state of the network, or an empty state if there
+// is none.
+func loadState(dataDir, network string) (*state, error) {
+	s := &state{}
+	data, err := ioutil.ReadFile(statePath(dataDir, network))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state of network %q: %v", network, err)
+	}
+	return s, nil
+}
+
+func saveState(dataDir, network string, s *state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(dataDir, network), data, 0600)
+}
+
+// otherNetworks returns the names of the networks other than network that
+// have a state.
+func otherNetworks(dataDir, network string) ([]string, error) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "lock" || f.Name() == network {
+			continue
+		}
+		names = append(names, f.Name())
+	}
+	return names, nil
+}
@@ -0,0 +1,295 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "meta-plugin". It mirrors the traffic of a container, as seen
+// on the host side of its veth, to another host interface with the tc
+// mirred action, so that it can be captured on its own.
+
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// maxMirrorDeviceLength is the longest interface name the kernel accepts.
+const maxMirrorDeviceLength = 15
+const mirrorDevicePrefix = "mir"
+
+// The directions are those of the container traffic.
+const (
+	DirectionIngress = "ingress"
+	DirectionEgress  = "egress"
+	DirectionBoth    = "both"
+)
+
+// MirrorFilter selects the packets to mirror. The fields that are set must
+// all match.
+type MirrorFilter struct {
+	Protocol string      `json:"protocol,omitempty"` // tcp, udp, sctp or icmp; any if unset
+	CIDR     types.IPNet `json:"cidr,omitempty"`     // The remote end; any if unset
+}
+
+// MirrorEntry describes what to mirror and where to.
+type MirrorEntry struct {
+	Target     string         `json:"target,omitempty"`     // An existing host interface
+	TargetVeth string         `json:"targetVeth,omitempty"` // The capture end of a veth to create
+	Direction  string         `json:"direction,omitempty"`  // ingress, egress or both; both if unset
+	Filters    []MirrorFilter `json:"filters,omitempty"`    // Everything if unset
+}
+
+// PluginConf represents the mirror plugin configuration.
+type PluginConf struct {
+	types.NetConf
+
+	RuntimeConfig struct {
+		Mirror *MirrorEntry `json:"mirror,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+
+	// The mirror of every container of the network. A runtime that
+	// captures per container passes runtimeConfig.mirror instead.
+	*MirrorEntry
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from stdin.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	if conf.RuntimeConfig.Mirror != nil {
+		conf.MirrorEntry = conf.RuntimeConfig.Mirror
+	}
+	if conf.MirrorEntry != nil {
+		if err := validateMirror(conf.MirrorEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	return &conf, nil
+}
+
+func validateMirror(mirror *MirrorEntry) error {
+	if (mirror.Target == "") == (mirror.TargetVeth == "") {
+		return fmt.Errorf("exactly one of target and targetVeth must be set")
+	}
+	if len(mirror.TargetVeth) > maxMirrorDeviceLength {
+		return fmt.Errorf("targetVeth %q is longer than %d characters", mirror.TargetVeth, maxMirrorDeviceLength)
+	}
+
+	switch mirror.Direction {
+	case "":
+		mirror.Direction = DirectionBoth
+	case DirectionIngress, DirectionEgress, DirectionBoth:
+	default:
+		return fmt.Errorf("direction must be %q, %q or %q", DirectionIngress, DirectionEgress, DirectionBoth)
+	}
+
+	for i, f := range mirror.Filters {
+		if _, ok := ipProtocols[f.Protocol]; !ok && f.Protocol != "" {
+			return fmt.Errorf("filter %d: unknown protocol %q", i, f.Protocol)
+		}
+	}
+	return nil
+}
+
+// getMirrorDeviceName derives a stable name for the end of the veth that
+// the traffic of the given container is mirrored to, so that DEL can find
+// it again.
+func getMirrorDeviceName(networkName string, containerID string) string {
+	output := sha512.Sum512([]byte(networkName + containerID))
+	name := fmt.Sprintf("%s%x", mirrorDevicePrefix, output)
+	return name[:maxMirrorDeviceLength]
+}
+
+// createMirrorVeth creates a veth pair on the host: the traffic is mirrored
+// to one end and the capture tool listens on the other.
+func createMirrorVeth(mirrorDeviceName, captureDeviceName string, mtu int) (netlink.Link, error) {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  mirrorDeviceName,
+			Flags: net.FlagUp,
+			MTU:   mtu,
+		},
+		PeerName: captureDeviceName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("failed to create veth %q: %v", captureDeviceName, err)
+	}
+
+	capture, err := netlink.LinkByName(captureDeviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", captureDeviceName, err)
+	}
+	if err := netlink.LinkSetUp(capture); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", captureDeviceName, err)
+	}
+	return capture, nil
+}
+
+// getTargetDeviceName returns the interface that the mirred action sends
+// the traffic to.
+func getTargetDeviceName(mirror *MirrorEntry, networkName, containerID string) string {
+	if mirror.TargetVeth != "" {
+		return getMirrorDeviceName(networkName, containerID)
+	}
+	return mirror.Target
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.MirrorEntry == nil {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	result := conf.PrevResult
+	hostDevice, err := ip.GetHostVethPeer(args.Netns, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.TargetVeth != "" {
+		capture, err := createMirrorVeth(getMirrorDeviceName(conf.Name, args.ContainerID), conf.TargetVeth, hostDevice.Attrs().MTU)
+		if err != nil {
+			return err
+		}
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: capture.Attrs().Name,
+			Mac:  capture.Attrs().HardwareAddr.String(),
+		})
+	}
+
+	targetDeviceName := getTargetDeviceName(conf.MirrorEntry, conf.Name, args.ContainerID)
+	targetDevice, err := netlink.LinkByName(targetDeviceName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", targetDeviceName, err)
+	}
+
+	if err := CreateMirror(conf.MirrorEntry, hostDevice, targetDevice.Attrs().Index); err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Deleting the host veth stops the mirroring, but if this plugin is
+	// dropped from a chain whose veth lives on, the filters would keep
+	// copying the container traffic to the target
+	if args.Netns != "" {
+		hostDevice, err := ip.GetHostVethPeer(args.Netns, args.IfName)
+		if err == nil {
+			if err := TeardownMirror(hostDevice.Attrs().Name); err != nil {
+				return err
+			}
+		} else if _, ok := err.(ns.NSPathNotExistErr); !ok && err != ip.ErrLinkNotFound {
+			return err
+		}
+	}
+
+	// Deleting our end of the veth deletes the capture end too
+	err = ip.DelLinkByName(getMirrorDeviceName(conf.Name, args.ContainerID))
+	if err != nil && err != ip.ErrLinkNotFound {
+		return err
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.MirrorEntry == nil {
+		return nil
+	}
+
+	hostDevice, err := ip.GetHostVethPeer(args.Netns, args.IfName)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", args.IfName), "failed to find host veth of %q: %v", args.IfName, err)
+	}
+
+	targetDeviceName := getTargetDeviceName(conf.MirrorEntry, conf.Name, args.ContainerID)
+	targetDevice, err := netlink.LinkByName(targetDeviceName)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", targetDeviceName), "failed to lookup %q: %v", targetDeviceName, err)
+	}
+	if conf.TargetVeth != "" {
+		if _, err := netlink.LinkByName(conf.TargetVeth); err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", conf.TargetVeth), "failed to lookup %q: %v", conf.TargetVeth, err)
+		}
+	}
+
+	return CheckMirror(conf.MirrorEntry, hostDevice, targetDevice.Attrs().Index)
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI mirror plugin")
+}
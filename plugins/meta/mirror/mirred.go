@@ -0,0 +1,309 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// ipProtocols maps the filter protocols to their IPv4 and IPv6 numbers.
+var ipProtocols = map[string][2]uint32{
+	"tcp":  {syscall.IPPROTO_TCP, syscall.IPPROTO_TCP},
+	"udp":  {syscall.IPPROTO_UDP, syscall.IPPROTO_UDP},
+	"sctp": {132, 132},
+	"icmp": {syscall.IPPROTO_ICMP, syscall.IPPROTO_ICMPV6},
+}
+
+// genFilters returns the u32 filters mirroring the traffic of the host
+// device to the target. Traffic to the container leaves the host device,
+// so it is filtered on the egress hook of the clsact qdisc; traffic from
+// the container on the ingress hook.
+func genFilters(mirror *MirrorEntry, hostIndex, targetIndex int) []*netlink.U32 {
+	filters := mirror.Filters
+	if len(filters) == 0 {
+		filters = []MirrorFilter{{}}
+	}
+
+	// The u32 filters of both hooks share their hash tables, so a dump of
+	// either hook lists all filters of the same priority. Each filter gets
+	// a priority of its own, so that a hook only lists its own filters.
+	var u32s []*netlink.U32
+	var priority uint16
+	hooks := []struct {
+		direction string
+		parent    uint32
+	}{
+		{DirectionIngress, netlink.HANDLE_MIN_EGRESS},
+		{DirectionEgress, netlink.HANDLE_MIN_INGRESS},
+	}
+	for _, hook := range hooks {
+		if mirror.Direction != hook.direction && mirror.Direction != DirectionBoth {
+			continue
+		}
+		// The remote end is the source of the traffic to the container
+		remoteIsSrc := hook.direction == DirectionIngress
+
+		for _, f := range filters {
+			for _, family := range filterFamilies(&f) {
+				priority++
+				u32s = append(u32s, &netlink.U32{
+					FilterAttrs: netlink.FilterAttrs{
+						LinkIndex: hostIndex,
+						Parent:    hook.parent,
+						Priority:  priority,
+						Protocol:  family,
+					},
+					Sel: filterSel(&f, family, remoteIsSrc),
+					Actions: []netlink.Action{&netlink.MirredAction{
+						ActionAttrs: netlink.ActionAttrs{
+							Action: netlink.TC_ACT_PIPE,
+						},
+						MirredAction: netlink.TCA_EGRESS_MIRROR,
+						Ifindex:      targetIndex,
+					}},
+				})
+			}
+		}
+	}
+	return u32s
+}
+
+// filterFamilies returns the ethernet protocols the filter applies to.
+func filterFamilies(f *MirrorFilter) []uint16 {
+	switch {
+	case f.CIDR.IP != nil && f.CIDR.IP.To4() != nil:
+		return []uint16{syscall.ETH_P_IP}
+	case f.CIDR.IP != nil:
+		return []uint16{syscall.ETH_P_IPV6}
+	case f.Protocol != "":
+		return []uint16{syscall.ETH_P_IP, syscall.ETH_P_IPV6}
+	default:
+		return []uint16{syscall.ETH_P_ALL}
+	}
+}
+
+// filterSel returns the u32 keys matching the filter in the given family,
+// or nil to match everything. The offsets are those of the IPv4 and IPv6
+// headers; the values are in host order.
+func filterSel(f *MirrorFilter, family uint16, remoteIsSrc bool) *netlink.TcU32Sel {
+	var keys []netlink.TcU32Key
+
+	if f.Protocol != "" {
+		if family == syscall.ETH_P_IP {
+			// The protocol byte of the TTL/protocol/checksum word
+			keys = append(keys, netlink.TcU32Key{Off: 8, Mask: 0x00ff0000, Val: ipProtocols[f.Protocol][0] << 16})
+		} else {
+			// The next header byte of the length/next header/hop limit word
+			keys = append(keys, netlink.TcU32Key{Off: 4, Mask: 0x0000ff00, Val: ipProtocols[f.Protocol][1] << 8})
+		}
+	}
+
+	if f.CIDR.IP != nil {
+		addr := f.CIDR.IP.To4()
+		off := int32(16)
+		if remoteIsSrc {
+			off = 12
+		}
+		if addr == nil {
+			addr = f.CIDR.IP.To16()
+			off = 24
+			if remoteIsSrc {
+				off = 8
+			}
+		}
+		mask := net.IP(f.CIDR.Mask)
+		if len(mask) != len(addr) {
+			mask = net.IP(net.CIDRMask(len(addr)*8, len(addr)*8))
+		}
+		for i := 0; i < len(addr); i += 4 {
+			m := binary.BigEndian.Uint32(mask[i:])
+			if m == 0 {
+				continue
+			}
+			keys = append(keys, netlink.TcU32Key{
+				Off:  off + int32(i),
+				Mask: m,
+				Val:  binary.BigEndian.Uint32(addr[i:]) & m,
+			})
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return &netlink.TcU32Sel{
+		Flags: netlink.TC_U32_TERMINAL,
+		Keys:  keys,
+	}
+}
+
+// ensureClsact adds a clsact qdisc to the device, unless it already has one.
+func ensureClsact(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	for _, qdisc := range qdiscs {
+		switch qdisc.Type() {
+		case "clsact":
+			return nil
+		case "ingress":
+			return fmt.Errorf("device %q has an ingress qdisc, mirroring needs a clsact qdisc", link.Attrs().Name)
+		}
+	}
+
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(clsact); err != nil {
+		return fmt.Errorf("create clsact qdisc: %s", err)
+	}
+	return nil
+}
+
+// CreateMirror mirrors the traffic of the host device to the target device.
+func CreateMirror(mirror *MirrorEntry, hostDevice netlink.Link, targetIndex int) error {
+	if err := ensureClsact(hostDevice); err != nil {
+		return err
+	}
+
+	for _, filter := range genFilters(mirror, hostDevice.Attrs().Index, targetIndex) {
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("add filter: %s", err)
+		}
+	}
+	return nil
+}
+
+// listMirrorFilters returns the filters of the device that mirror traffic.
+func listMirrorFilters(link netlink.Link) ([]*netlink.U32, error) {
+	var u32s []*netlink.U32
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := netlink.FilterList(link, parent)
+		if err != nil {
+			return nil, fmt.Errorf("list filters: %s", err)
+		}
+		for _, filter := range filters {
+			if u32, ok := filter.(*netlink.U32); ok && mirrorTarget(u32) != 0 {
+				u32s = append(u32s, u32)
+			}
+		}
+	}
+	return u32s, nil
+}
+
+// mirrorTarget returns the index of the interface that the filter mirrors
+// traffic to, or 0 if it doesn't mirror.
+func mirrorTarget(filter *netlink.U32) int {
+	for _, action := range filter.Actions {
+		if mirred, ok := action.(*netlink.MirredAction); ok && mirred.MirredAction == netlink.TCA_EGRESS_MIRROR {
+			return mirred.Ifindex
+		}
+	}
+	return 0
+}
+
+// TeardownMirror removes the mirroring filters from the host device, and
+// the clsact qdisc if nothing else uses it. It will not error if the device
+// or the filters don't exist.
+func TeardownMirror(hostDeviceName string) error {
+	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("get host device: %s", err)
+	}
+
+	qdiscs, err := netlink.QdiscList(hostDevice)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	var clsact netlink.Qdisc
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			clsact = qdisc
+		}
+	}
+	if clsact == nil {
+		return nil
+	}
+
+	filters, err := listMirrorFilters(hostDevice)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if err := netlink.FilterDel(filter); err != nil {
+			return fmt.Errorf("delete filter: %s", err)
+		}
+	}
+
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		remaining, err := netlink.FilterList(hostDevice, parent)
+		if err != nil {
+			return fmt.Errorf("list filters: %s", err)
+		}
+		if len(remaining) > 0 {
+			return nil
+		}
+	}
+	if err := netlink.QdiscDel(clsact); err != nil {
+		return fmt.Errorf("delete clsact qdisc: %s", err)
+	}
+	return nil
+}
+
+// CheckMirror verifies that the host device has a mirroring filter for
+// each of the expected ones.
+func CheckMirror(mirror *MirrorEntry, hostDevice netlink.Link, targetIndex int) error {
+	name := hostDevice.Attrs().Name
+	resource := fmt.Sprintf("interface %q", name)
+
+	filters, err := listMirrorFilters(hostDevice)
+	if err != nil {
+		return utils.NewCheckError(resource, "failed to get the filters of %q: %v", name, err)
+	}
+
+	for _, expected := range genFilters(mirror, hostDevice.Attrs().Index, targetIndex) {
+		found := false
+		for _, filter := range filters {
+			if filter.Parent == expected.Parent &&
+				filter.Priority == expected.Priority &&
+				filter.Protocol == expected.Protocol &&
+				mirrorTarget(filter) == targetIndex {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return utils.NewCheckError(resource, "no filter on %q with priority %d mirroring to interface %d",
+				name, expected.Priority, targetIndex)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func mirrorConf(mirror string) []byte {
+	return []byte(fmt.Sprintf(`{
+	"name": "mynet",
+	"type": "mirror",
+	"cniVersion": "0.4.0",
+	"runtimeConfig": {
+		"mirror": %s
+	},
+	"prevResult": {
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "host0"},
+			{"name": "eth0", "sandbox": "netns"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 2
+			}
+		]
+	}
+}`, mirror))
+}
+
+var _ = Describe("mirror config", func() {
+	It("takes the mirror from the runtimeConfig", func() {
+		conf, err := parseConfig(mirrorConf(`{"targetVeth": "capture0", "filters": [{"protocol": "tcp"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.MirrorEntry).To(Equal(&MirrorEntry{
+			TargetVeth: "capture0",
+			Direction:  DirectionBoth,
+			Filters:    []MirrorFilter{{Protocol: "tcp"}},
+		}))
+	})
+
+	It("rejects invalid mirrors", func() {
+		_, err := parseConfig(mirrorConf(`{}`))
+		Expect(err).To(MatchError("exactly one of target and targetVeth must be set"))
+
+		_, err = parseConfig(mirrorConf(`{"target": "eth1", "targetVeth": "capture0"}`))
+		Expect(err).To(MatchError("exactly one of target and targetVeth must be set"))
+
+		_, err = parseConfig(mirrorConf(`{"target": "eth1", "direction": "out"}`))
+		Expect(err).To(MatchError(`direction must be "ingress", "egress" or "both"`))
+
+		_, err = parseConfig(mirrorConf(`{"target": "eth1", "filters": [{"protocol": "gre"}]}`))
+		Expect(err).To(MatchError(`filter 0: unknown protocol "gre"`))
+	})
+
+	It("derives a valid mirror device name", func() {
+		name := getMirrorDeviceName("mynet", "dummy")
+		Expect(name).To(HavePrefix(mirrorDevicePrefix))
+		Expect(len(name)).To(Equal(maxMirrorDeviceLength))
+		Expect(getMirrorDeviceName("mynet", "dummy")).To(Equal(name))
+		Expect(getMirrorDeviceName("mynet", "other")).NotTo(Equal(name))
+	})
+
+	It("generates filters matching the remote end in each direction", func() {
+		conf, err := parseConfig(mirrorConf(`{"target": "eth1", "filters": [
+			{"protocol": "udp", "cidr": "192.0.2.0/24"},
+			{"protocol": "icmp"}
+		]}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		filters := genFilters(conf.MirrorEntry, 3, 7)
+		Expect(filters).To(HaveLen(6))
+		for _, f := range filters {
+			Expect(f.LinkIndex).To(Equal(3))
+			Expect(mirrorTarget(f)).To(Equal(7))
+		}
+
+		// Traffic to the container leaves the host device
+		Expect(filters[0].Parent).To(Equal(uint32(netlink.HANDLE_MIN_EGRESS)))
+		Expect(filters[0].Priority).To(Equal(uint16(1)))
+		Expect(filters[0].Protocol).To(Equal(uint16(syscall.ETH_P_IP)))
+		Expect(filters[0].Sel.Keys).To(Equal([]netlink.TcU32Key{
+			{Off: 8, Mask: 0x00ff0000, Val: 17 << 16},
+			{Off: 12, Mask: 0xffffff00, Val: 0xc0000200},
+		}))
+		Expect(filters[1].Protocol).To(Equal(uint16(syscall.ETH_P_IP)))
+		Expect(filters[1].Sel.Keys).To(Equal([]netlink.TcU32Key{
+			{Off: 8, Mask: 0x00ff0000, Val: 1 << 16},
+		}))
+		Expect(filters[2].Priority).To(Equal(uint16(3)))
+		Expect(filters[2].Protocol).To(Equal(uint16(syscall.ETH_P_IPV6)))
+		Expect(filters[2].Sel.Keys).To(Equal([]netlink.TcU32Key{
+			{Off: 4, Mask: 0x0000ff00, Val: 58 << 8},
+		}))
+
+		// Traffic from the container enters it, to the remote end
+		Expect(filters[3].Parent).To(Equal(uint32(netlink.HANDLE_MIN_INGRESS)))
+		Expect(filters[3].Priority).To(Equal(uint16(4)))
+		Expect(filters[3].Sel.Keys[1]).To(Equal(netlink.TcU32Key{Off: 16, Mask: 0xffffff00, Val: 0xc0000200}))
+	})
+
+	It("matches all traffic of one direction without filters", func() {
+		conf, err := parseConfig(mirrorConf(`{"target": "eth1", "direction": "egress"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		filters := genFilters(conf.MirrorEntry, 3, 7)
+		Expect(filters).To(HaveLen(1))
+		Expect(filters[0].Parent).To(Equal(uint32(netlink.HANDLE_MIN_INGRESS)))
+		Expect(filters[0].Protocol).To(Equal(uint16(syscall.ETH_P_ALL)))
+		Expect(filters[0].Sel).To(BeNil())
+	})
+})
+
+var _ = Describe("mirror plugin", func() {
+	var hostNs, containerNs ns.NetNS
+	const HOSTIFNAME string = "host0"
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		hostNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		containerNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		// The veth of the container, behind a bridge that the previous
+		// result lists first
+		err = hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: "cni0",
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: HOSTIFNAME,
+				},
+				PeerName: IFNAME,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(hostVeth)).To(Succeed())
+
+			contVeth, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(contVeth, int(containerNs.Fd()))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(containerNs.Close()).To(Succeed())
+		Expect(hostNs.Close()).To(Succeed())
+	})
+
+	It("mirrors traffic to a new veth with ADD, checks it with CHECK and removes it with DEL", func() {
+		conf := mirrorConf(`{"targetVeth": "capture0"}`)
+		mirrorDeviceName := getMirrorDeviceName("mynet", "dummy")
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := hostNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(containerNs.Path(), IFNAME, conf, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(4))
+			Expect(result.Interfaces[3].Name).To(Equal("capture0"))
+
+			mirrorDevice, err := netlink.LinkByName(mirrorDeviceName)
+			Expect(err).NotTo(HaveOccurred())
+			hostDevice, err := netlink.LinkByName(HOSTIFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			filters, err := listMirrorFilters(hostDevice)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(2))
+			for _, f := range filters {
+				Expect(mirrorTarget(f)).To(Equal(mirrorDevice.Attrs().Index))
+			}
+
+			// Nothing is mirrored from the bridge
+			bridge, err := netlink.LinkByName("cni0")
+			Expect(err).NotTo(HaveOccurred())
+			filters, err = listMirrorFilters(bridge)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(BeEmpty())
+			filters, err = listMirrorFilters(hostDevice)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdCheckWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// A missing filter is reported against the host device
+			Expect(netlink.FilterDel(filters[0])).To(Succeed())
+			err = testutils.CmdCheckWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(`interface "host0"`))
+
+			err = testutils.CmdDelWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = netlink.LinkByName("capture0")
+			Expect(err).To(HaveOccurred())
+			qdiscs, err := netlink.QdiscList(hostDevice)
+			Expect(err).NotTo(HaveOccurred())
+			for _, q := range qdiscs {
+				Expect(q.Type()).NotTo(Equal("clsact"))
+			}
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(containerNs.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,258 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that installs permanent neighbor entries,
+// ARP for IPv4 and ND for IPv6, on the container interface, so that the
+// container never has to resolve the addresses of fixed peers such as its
+// gateways, and cannot be misled by spoofed replies. It can also turn off
+// ARP on the interface altogether.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// Neighbor is a fixed mapping of an IP to a MAC.
+type Neighbor struct {
+	IP  net.IP `json:"ip"`
+	MAC string `json:"mac"`
+}
+
+// PluginConf represents the neighbor plugin configuration.
+type PluginConf struct {
+	types.NetConf
+	Neighbors []Neighbor `json:"neighbors,omitempty"`
+	// DisableARP sets IFF_NOARP on the interface, so only the listed
+	// neighbors can be reached
+	DisableARP bool `json:"disableARP,omitempty"`
+
+	RuntimeConfig struct {
+		Neighbors []Neighbor `json:"neighbors,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from
+// stdin, and adds the runtime neighbors to the static ones.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	conf.Neighbors = append(conf.Neighbors, conf.RuntimeConfig.Neighbors...)
+	for i, n := range conf.Neighbors {
+		if n.IP == nil {
+			return nil, fmt.Errorf("neighbor %d: ip must be specified", i)
+		}
+		if _, err := net.ParseMAC(n.MAC); err != nil {
+			return nil, fmt.Errorf("neighbor %s: invalid mac %q: %v", n.IP, n.MAC, err)
+		}
+	}
+
+	return &conf, nil
+}
+
+func genNeighbors(neighbors []Neighbor, linkIndex int) []*netlink.Neigh {
+	var neighs []*netlink.Neigh
+	for _, n := range neighbors {
+		family := netlink.FAMILY_V6
+		if n.IP.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		mac, _ := net.ParseMAC(n.MAC)
+		neighs = append(neighs, &netlink.Neigh{
+			LinkIndex:    linkIndex,
+			Family:       family,
+			State:        netlink.NUD_PERMANENT,
+			IP:           n.IP,
+			HardwareAddr: mac,
+		})
+	}
+	return neighs
+}
+
+// applyNeighbors configures the interface in the current namespace.
+func applyNeighbors(conf *PluginConf, iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find %q: %v", iface, err)
+	}
+
+	// Turning ARP off flushes the neighbor cache, so it comes first
+	if conf.DisableARP {
+		if err := netlink.LinkSetARPOff(link); err != nil {
+			return fmt.Errorf("failed to disable ARP on %q: %v", iface, err)
+		}
+	}
+
+	for _, neigh := range genNeighbors(conf.Neighbors, link.Attrs().Index) {
+		if err := netlink.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to add neighbor %s: %v", neigh.IP, err)
+		}
+	}
+	return nil
+}
+
+// removeNeighbors undoes applyNeighbors, for interfaces that outlive the
+// container, e.g. with host-device.
+func removeNeighbors(conf *PluginConf, iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to find %q: %v", iface, err)
+	}
+
+	for _, neigh := range genNeighbors(conf.Neighbors, link.Attrs().Index) {
+		if err := netlink.NeighDel(neigh); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("failed to delete neighbor %s: %v", neigh.IP, err)
+		}
+	}
+
+	if conf.DisableARP {
+		if err := netlink.LinkSetARPOn(link); err != nil {
+			return fmt.Errorf("failed to enable ARP on %q: %v", iface, err)
+		}
+	}
+	return nil
+}
+
+// checkNeighbors verifies that the neighbors are permanent entries with
+// the expected MACs.
+func checkNeighbors(conf *PluginConf, iface string) error {
+	resource := fmt.Sprintf("interface %q", iface)
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return utils.NewCheckError(resource, "failed to find %q: %v", iface, err)
+	}
+
+	if conf.DisableARP && link.Attrs().RawFlags&syscall.IFF_NOARP == 0 {
+		return utils.NewCheckError(resource, "ARP is enabled on %q", iface)
+	}
+
+	for _, want := range genNeighbors(conf.Neighbors, link.Attrs().Index) {
+		neighs, err := netlink.NeighList(link.Attrs().Index, want.Family)
+		if err != nil {
+			return fmt.Errorf("failed to list neighbors of %q: %v", iface, err)
+		}
+		found := false
+		for _, n := range neighs {
+			if n.IP.Equal(want.IP) {
+				found = n.State&netlink.NUD_PERMANENT != 0 && n.HardwareAddr.String() == want.HardwareAddr.String()
+				break
+			}
+		}
+		if !found {
+			return utils.NewCheckError(fmt.Sprintf("neighbor %q", want.IP.String()), "neighbor %s is not a permanent entry for %s", want.IP, want.HardwareAddr)
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return applyNeighbors(conf, args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return removeNeighbors(conf, args.IfName)
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return checkNeighbors(conf, args.IfName)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI neighbor plugin")
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prevResult = `{
+		"interfaces": [
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.1.1.2/24",
+				"gateway": "10.1.1.1",
+				"interface": 0
+			}
+		]
+	}`
+
+var neighborConf = fmt.Sprintf(`{
+	"name": "test",
+	"type": "neighbor",
+	"cniVersion": "0.4.0",
+	"neighbors": [
+		{"ip": "10.1.1.1", "mac": "02:00:00:00:01:01"},
+		{"ip": "fd00::1", "mac": "02:00:00:00:01:02"}
+	],
+	"disableARP": true,
+	"prevResult": %s
+}`, prevResult)
+
+var _ = Describe("neighbor configuration", func() {
+	It("adds the runtime neighbors to the static ones", func() {
+		conf, err := parseConfig([]byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "neighbor",
+	"cniVersion": "0.4.0",
+	"neighbors": [{"ip": "10.1.1.1", "mac": "02:00:00:00:01:01"}],
+	"runtimeConfig": {
+		"neighbors": [{"ip": "10.1.1.254", "mac": "02:00:00:00:01:fe"}]
+	},
+	"prevResult": %s
+}`, prevResult)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Neighbors).To(HaveLen(2))
+		Expect(conf.Neighbors[1].IP.String()).To(Equal("10.1.1.254"))
+		Expect(conf.DisableARP).To(BeFalse())
+	})
+
+	It("rejects an invalid MAC", func() {
+		_, err := parseConfig([]byte(`{
+	"name": "test",
+	"type": "neighbor",
+	"neighbors": [{"ip": "10.1.1.1", "mac": "02:00:00"}]
+}`))
+		Expect(err).To(MatchError(`neighbor 10.1.1.1: invalid mac "02:00:00": address 02:00:00: invalid MAC address`))
+	})
+
+	It("generates permanent entries in the family of each IP", func() {
+		conf, err := parseConfig([]byte(neighborConf))
+		Expect(err).NotTo(HaveOccurred())
+
+		neighs := genNeighbors(conf.Neighbors, 3)
+		Expect(neighs).To(HaveLen(2))
+		Expect(neighs[0].Family).To(Equal(netlink.FAMILY_V4))
+		Expect(neighs[1].Family).To(Equal(netlink.FAMILY_V6))
+		for _, n := range neighs {
+			Expect(n.LinkIndex).To(Equal(3))
+			Expect(n.State).To(Equal(netlink.NUD_PERMANENT))
+		}
+		Expect(neighs[1].HardwareAddr.String()).To(Equal("02:00:00:00:01:02"))
+	})
+})
+
+var _ = Describe("neighbor plugin", func() {
+	var targetNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IFNAME}})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	It("installs the neighbors with ADD, checks them with CHECK and removes them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(neighborConf),
+		}
+
+		_, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, args.StdinData, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().RawFlags & syscall.IFF_NOARP).NotTo(BeZero())
+
+			neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(neighs).To(HaveLen(1))
+			Expect(neighs[0].IP).To(Equal(net.ParseIP("10.1.1.1").To4()))
+			Expect(neighs[0].State).To(Equal(netlink.NUD_PERMANENT))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdCheckWithResult(targetNS.Path(), IFNAME, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Replace the gateway entry behind the plugin's back
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			mac, _ := net.ParseMAC("02:00:00:00:66:66")
+			return netlink.NeighSet(&netlink.Neigh{
+				LinkIndex:    link.Attrs().Index,
+				Family:       netlink.FAMILY_V4,
+				State:        netlink.NUD_PERMANENT,
+				IP:           net.ParseIP("10.1.1.1"),
+				HardwareAddr: mac,
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = testutils.CmdCheckWithResult(targetNS.Path(), IFNAME, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Details).To(Equal(`neighbor "10.1.1.1"`))
+
+		err = testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().RawFlags & syscall.IFF_NOARP).To(BeZero())
+
+			neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+			Expect(err).NotTo(HaveOccurred())
+			for _, n := range neighs {
+				Expect(n.State & netlink.NUD_PERMANENT).To(BeZero())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
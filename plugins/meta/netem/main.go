@@ -0,0 +1,249 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "meta-plugin". It emulates a lossy, slow network for a
+// container, with a netem qdisc on the host end of its veth or on the
+// container interface, for fault injection in resilience tests.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// NetemEntry describes the impairments of the traffic leaving the
+// interface. The percentages are between 0 and 100.
+type NetemEntry struct {
+	Latency   string  `json:"latency,omitempty"`   // A duration, e.g. "100ms"
+	Jitter    string  `json:"jitter,omitempty"`    // A duration; needs a latency
+	Loss      float32 `json:"loss,omitempty"`      // Percentage of packets dropped
+	Duplicate float32 `json:"duplicate,omitempty"` // Percentage of packets sent twice
+	Reorder   float32 `json:"reorder,omitempty"`   // Percentage of packets sent without the latency
+	Side      string  `json:"side,omitempty"`      // host or container; host if unset
+}
+
+// PluginConf represents the netem plugin configuration.
+type PluginConf struct {
+	types.NetConf
+
+	RuntimeConfig struct {
+		Netem *NetemEntry `json:"netem,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+
+	// The impairments of every container of the network; a netem
+	// capability of the runtime sets others for this container
+	*NetemEntry
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from stdin.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	if conf.RuntimeConfig.Netem != nil {
+		conf.NetemEntry = conf.RuntimeConfig.Netem
+	}
+	if conf.NetemEntry != nil {
+		if err := validateNetem(conf.NetemEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	return &conf, nil
+}
+
+func validateNetem(entry *NetemEntry) error {
+	if _, err := entry.qdiscAttrs(); err != nil {
+		return err
+	}
+
+	switch entry.Side {
+	case "":
+		entry.Side = ip.VethSideHost
+	case ip.VethSideHost, ip.VethSideContainer:
+	default:
+		return fmt.Errorf("side must be %q or %q", ip.VethSideHost, ip.VethSideContainer)
+	}
+	return nil
+}
+
+// qdiscAttrs converts the entry to the attributes of the netem qdisc.
+func (entry *NetemEntry) qdiscAttrs() (netlink.NetemQdiscAttrs, error) {
+	attrs := netlink.NetemQdiscAttrs{}
+
+	latency, err := parseDuration("latency", entry.Latency)
+	if err != nil {
+		return attrs, err
+	}
+	jitter, err := parseDuration("jitter", entry.Jitter)
+	if err != nil {
+		return attrs, err
+	}
+	if latency == 0 && (jitter > 0 || entry.Reorder > 0) {
+		return attrs, fmt.Errorf("jitter and reorder need a latency")
+	}
+
+	for _, p := range []struct {
+		name  string
+		value float32
+	}{
+		{"loss", entry.Loss},
+		{"duplicate", entry.Duplicate},
+		{"reorder", entry.Reorder},
+	} {
+		if p.value < 0 || p.value > 100 {
+			return attrs, fmt.Errorf("%s must be between 0 and 100", p.name)
+		}
+	}
+
+	attrs.Latency = uint32(latency / time.Microsecond)
+	attrs.Jitter = uint32(jitter / time.Microsecond)
+	attrs.Loss = entry.Loss
+	attrs.Duplicate = entry.Duplicate
+	attrs.ReorderProb = entry.Reorder
+	return attrs, nil
+}
+
+// maxDuration is the longest delay the netem qdisc takes, in microseconds.
+const maxDuration = time.Duration(1<<32-1) * time.Microsecond
+
+func parseDuration(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, s, err)
+	}
+	if d < 0 || d > maxDuration {
+		return 0, fmt.Errorf("%s must be between 0 and %v", name, maxDuration)
+	}
+	return d, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.NetemEntry == nil {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	attrs, err := conf.qdiscAttrs()
+	if err != nil {
+		return err
+	}
+	err = ip.WithVethSide(conf.Side, args.Netns, args.IfName, func(link netlink.Link) error {
+		return CreateNetem(link, attrs)
+	})
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Remove the qdisc in case the interface stays around, as it does
+	// when the plugin is taken off the chain of a running container
+	if conf.NetemEntry != nil && args.Netns != "" {
+		err := ip.WithVethSide(conf.Side, args.Netns, args.IfName, TeardownNetem)
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok && err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.NetemEntry == nil {
+		return nil
+	}
+
+	attrs, err := conf.qdiscAttrs()
+	if err != nil {
+		return err
+	}
+	return ip.WithVethSide(conf.Side, args.Netns, args.IfName, func(link netlink.Link) error {
+		if err := CheckNetem(link, attrs); err != nil {
+			return utils.NewCheckError(fmt.Sprintf("interface %q", link.Attrs().Name), "%v", err)
+		}
+		return nil
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI netem plugin")
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// netemHandle is the handle of the netem qdiscs of the plugin ("ne"), which
+// tells them apart from the qdiscs of other plugins.
+var netemHandle = netlink.MakeHandle(0x6e65, 0)
+
+// findNetem returns the netem qdisc of the plugin on the device, or nil.
+func findNetem(qdiscs []netlink.Qdisc) *netlink.Netem {
+	for _, qdisc := range qdiscs {
+		if netem, ok := qdisc.(*netlink.Netem); ok && netem.Handle == netemHandle {
+			return netem
+		}
+	}
+	return nil
+}
+
+// findParent returns where the netem qdisc goes. It replaces the root
+// qdisc if that is the default one of the kernel, which has no handle.
+// Under a root tbf, as set up by the bandwidth plugin, it replaces the
+// inner qdisc of the tbf, so that both apply. Other root qdiscs are left
+// alone.
+func findParent(link netlink.Link, qdiscs []netlink.Qdisc) (uint32, error) {
+	if netem := findNetem(qdiscs); netem != nil {
+		return netem.Parent, nil
+	}
+
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if attrs.Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		switch {
+		case attrs.Handle == 0:
+			return netlink.HANDLE_ROOT, nil
+		case qdisc.Type() == "tbf":
+			major, _ := netlink.MajorMinor(attrs.Handle)
+			return netlink.MakeHandle(major, 1), nil
+		default:
+			return 0, fmt.Errorf("device %q has a %s root qdisc, netem can only go under a tbf or replace the default qdisc", link.Attrs().Name, qdisc.Type())
+		}
+	}
+	return netlink.HANDLE_ROOT, nil
+}
+
+func genNetem(linkIndex int, parent uint32, attrs netlink.NetemQdiscAttrs) *netlink.Netem {
+	return netlink.NewNetem(netlink.QdiscAttrs{
+		LinkIndex: linkIndex,
+		Handle:    netemHandle,
+		Parent:    parent,
+	}, attrs)
+}
+
+// CreateNetem adds the netem qdisc to the device, or updates it.
+func CreateNetem(link netlink.Link, attrs netlink.NetemQdiscAttrs) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	parent, err := findParent(link, qdiscs)
+	if err != nil {
+		return err
+	}
+
+	if err := netlink.QdiscReplace(genNetem(link.Attrs().Index, parent, attrs)); err != nil {
+		return fmt.Errorf("create netem qdisc: %s", err)
+	}
+	return nil
+}
+
+// TeardownNetem removes the netem qdisc of the device. Under a tbf, it is
+// replaced by a fifo, as a tbf without an inner qdisc drops everything.
+func TeardownNetem(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	netem := findNetem(qdiscs)
+	if netem == nil {
+		return nil
+	}
+
+	if netem.Parent == netlink.HANDLE_ROOT {
+		if err := netlink.QdiscDel(netem); err != nil {
+			return fmt.Errorf("delete netem qdisc: %s", err)
+		}
+		return nil
+	}
+
+	fifo := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netem.Parent,
+		},
+		QdiscType: "bfifo",
+	}
+	if err := netlink.QdiscReplace(fifo); err != nil {
+		return fmt.Errorf("replace netem qdisc: %s", err)
+	}
+	return nil
+}
+
+// CheckNetem verifies that the device has the netem qdisc of the plugin,
+// with the given attributes.
+func CheckNetem(link netlink.Link, attrs netlink.NetemQdiscAttrs) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	netem := findNetem(qdiscs)
+	if netem == nil {
+		return fmt.Errorf("no netem qdisc with handle %s", netlink.HandleStr(netemHandle))
+	}
+
+	want := genNetem(link.Attrs().Index, netem.Parent, attrs)
+	if netem.Latency != want.Latency || netem.Jitter != want.Jitter ||
+		netem.Loss != want.Loss || netem.Duplicate != want.Duplicate ||
+		netem.ReorderProb != want.ReorderProb {
+		return fmt.Errorf("netem qdisc has latency %d, jitter %d, loss %d, duplicate %d and reorder %d, expected %d, %d, %d, %d and %d",
+			netem.Latency, netem.Jitter, netem.Loss, netem.Duplicate, netem.ReorderProb,
+			want.Latency, want.Jitter, want.Loss, want.Duplicate, want.ReorderProb)
+	}
+	return nil
+}
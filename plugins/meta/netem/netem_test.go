@@ -0,0 +1,278 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func netemConf(entry string) []byte {
+	return []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "netem",
+	"cniVersion": "0.4.0",
+	%s
+	"prevResult": {
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "veth0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": []
+	}
+}`, entry))
+}
+
+var _ = Describe("netem configuration", func() {
+	It("converts the impairments to qdisc attributes", func() {
+		conf, err := parseConfig(netemConf(`
+	"latency": "100ms",
+	"jitter": "10ms",
+	"loss": 1.5,
+	"duplicate": 0.5,
+	"reorder": 25,`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Side).To(Equal(ip.VethSideHost))
+
+		attrs, err := conf.qdiscAttrs()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(Equal(netlink.NetemQdiscAttrs{
+			Latency:     100000,
+			Jitter:      10000,
+			Loss:        1.5,
+			Duplicate:   0.5,
+			ReorderProb: 25,
+		}))
+	})
+
+	It("uses the runtime config over the static one", func() {
+		conf, err := parseConfig(netemConf(`
+	"latency": "100ms",
+	"runtimeConfig": {
+		"netem": {"loss": 10, "side": "container"}
+	},`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Latency).To(BeEmpty())
+		Expect(conf.Loss).To(Equal(float32(10)))
+		Expect(conf.Side).To(Equal(ip.VethSideContainer))
+	})
+
+	It("rejects jitter without latency", func() {
+		_, err := parseConfig(netemConf(`"jitter": "10ms",`))
+		Expect(err).To(MatchError("jitter and reorder need a latency"))
+	})
+
+	It("rejects a loss above 100%", func() {
+		_, err := parseConfig(netemConf(`"loss": 101,`))
+		Expect(err).To(MatchError("loss must be between 0 and 100"))
+	})
+
+	It("rejects an invalid duration", func() {
+		_, err := parseConfig(netemConf(`"latency": "100",`))
+		Expect(err).To(MatchError(`invalid latency "100": time: missing unit in duration "100"`))
+	})
+})
+
+var _ = Describe("netem placement", func() {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 3}}
+
+	qdisc := func(kind string, handle, parent uint32) netlink.Qdisc {
+		attrs := netlink.QdiscAttrs{LinkIndex: 3, Handle: handle, Parent: parent}
+		switch kind {
+		case "tbf":
+			return &netlink.Tbf{QdiscAttrs: attrs}
+		case "netem":
+			return &netlink.Netem{QdiscAttrs: attrs}
+		default:
+			return &netlink.GenericQdisc{QdiscAttrs: attrs, QdiscType: kind}
+		}
+	}
+
+	It("replaces the default root qdisc", func() {
+		parent, err := findParent(link, []netlink.Qdisc{qdisc("noqueue", 0, netlink.HANDLE_ROOT)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parent).To(Equal(uint32(netlink.HANDLE_ROOT)))
+	})
+
+	It("goes under a root tbf", func() {
+		parent, err := findParent(link, []netlink.Qdisc{
+			qdisc("tbf", netlink.MakeHandle(1, 0), netlink.HANDLE_ROOT),
+			qdisc("ingress", netlink.MakeHandle(0xffff, 0), netlink.HANDLE_INGRESS),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parent).To(Equal(netlink.MakeHandle(1, 1)))
+	})
+
+	It("keeps the place of its own qdisc", func() {
+		parent, err := findParent(link, []netlink.Qdisc{
+			qdisc("tbf", netlink.MakeHandle(1, 0), netlink.HANDLE_ROOT),
+			qdisc("netem", netemHandle, netlink.MakeHandle(1, 1)),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parent).To(Equal(netlink.MakeHandle(1, 1)))
+	})
+
+	It("leaves other root qdiscs alone", func() {
+		_, err := findParent(link, []netlink.Qdisc{qdisc("htb", netlink.MakeHandle(1, 0), netlink.HANDLE_ROOT)})
+		Expect(err).To(MatchError(`device "veth0" has a htb root qdisc, netem can only go under a tbf or replace the default qdisc`))
+	})
+})
+
+var _ = Describe("netem plugin", func() {
+	var hostNS, containerNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		containerNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		// The veth of the container, behind a bridge that the previous
+		// result lists first
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: IFNAME})
+			Expect(err).NotTo(HaveOccurred())
+			contVeth, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(contVeth, int(containerNS.Fd()))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(containerNS.Close()).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+	})
+
+	It("adds the qdisc under the tbf of the bandwidth plugin, and restores a fifo on DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   netemConf(`"latency": "50ms", "loss": 5,`),
+		}
+
+		err := hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.QdiscAdd(&netlink.Tbf{
+				QdiscAttrs: netlink.QdiscAttrs{
+					LinkIndex: link.Attrs().Index,
+					Handle:    netlink.MakeHandle(1, 0),
+					Parent:    netlink.HANDLE_ROOT,
+				},
+				Limit:  10000,
+				Rate:   125000,
+				Buffer: 10000,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			qdiscs, err := netlink.QdiscList(link)
+			Expect(err).NotTo(HaveOccurred())
+			netem := findNetem(qdiscs)
+			Expect(netem).NotTo(BeNil())
+			Expect(netem.Parent).To(Equal(netlink.MakeHandle(1, 1)))
+
+			// The bridge listed first in the previous result is left alone
+			bridge, err := netlink.LinkByName("cni0")
+			Expect(err).NotTo(HaveOccurred())
+			qdiscs, err = netlink.QdiscList(bridge)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(findNetem(qdiscs)).To(BeNil())
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// A change of the impairments is caught by CHECK, and
+			// applied by ADD
+			args.StdinData = netemConf(`"latency": "80ms", "loss": 5,`)
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(`interface "veth0"`))
+			_, _, err = testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			qdiscs, err = netlink.QdiscList(link)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(findNetem(qdiscs)).To(BeNil())
+			var kinds []string
+			for _, q := range qdiscs {
+				kinds = append(kinds, q.Type())
+			}
+			Expect(kinds).To(ContainElement("tbf"))
+			Expect(kinds).To(ContainElement("bfifo"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("succeeds on DEL once the container interface is gone", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   netemConf(`"latency": "50ms",`),
+		}
+
+		err := hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(ip.DelLinkByName("veth0")).To(Succeed())
+			err := testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
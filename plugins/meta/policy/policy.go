@@ -0,0 +1,437 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that enforces an allow-list on the traffic
+// to and from a container. Once a policy is given, everything it does not
+// allow is dropped, except for replies to allowed connections.
+//
+// Each container gets an ingress and an egress chain in the filter table.
+// When the previous result has a host-side interface (bridge, ptp), the
+// chains are in the host and are jumped to from the CNI-POLICY chain in
+// FORWARD, per container IP. Otherwise (macvlan, ipvlan) the traffic never
+// crosses the host, so the chains are in the container namespace and are
+// jumped to from INPUT and OUTPUT for the container interface.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// PolicyChainName is the name of the shared chain in the host.
+// It should never be changed, or else upgrading will require manual
+// intervention.
+const PolicyChainName = "CNI-POLICY"
+
+const (
+	DirectionIngress = "ingress"
+	DirectionEgress  = "egress"
+)
+
+// PolicyRule allows the traffic that matches all of its set fields.
+type PolicyRule struct {
+	Direction string      `json:"direction"`
+	CIDR      types.IPNet `json:"cidr,omitempty"`     // The remote end; any if unset
+	Protocol  string      `json:"protocol,omitempty"` // tcp, udp, sctp or icmp; any if unset
+	Port      int         `json:"port,omitempty"`     // The destination port; any if unset
+}
+
+// PolicyNetConf represents the policy plugin configuration.
+type PolicyNetConf struct {
+	types.NetConf
+
+	Policy []PolicyRule `json:"policy,omitempty"`
+
+	RuntimeConfig struct {
+		Policy []PolicyRule `json:"policy,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+func parseConf(data []byte, ifName string) (*PolicyNetConf, []net.IP, error) {
+	conf := PolicyNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// The runtime config overrides the static config
+	if conf.RuntimeConfig.Policy != nil {
+		conf.Policy = conf.RuntimeConfig.Policy
+	}
+	for i, rule := range conf.Policy {
+		if err := validateRule(&rule); err != nil {
+			return nil, nil, fmt.Errorf("invalid policy rule %d: %v", i, err)
+		}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	// The previous result may leave its version to the configuration
+	if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+		conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+	}
+	resultBytes, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	res, err := version.NewResult(conf.CNIVersion, resultBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	conf.RawPrevResult = nil
+	conf.PrevResult, err = current.NewResultFromResult(res)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	return &conf, utils.ContainerIPs(conf.PrevResult, ifName), nil
+}
+
+func validateRule(rule *PolicyRule) error {
+	if rule.Direction != DirectionIngress && rule.Direction != DirectionEgress {
+		return fmt.Errorf("direction must be %q or %q", DirectionIngress, DirectionEgress)
+	}
+	switch rule.Protocol {
+	case "", "icmp":
+		if rule.Port != 0 {
+			return fmt.Errorf("port requires protocol tcp, udp or sctp")
+		}
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("unknown protocol %q", rule.Protocol)
+	}
+	if rule.Port < 0 || rule.Port > 65535 {
+		return fmt.Errorf("invalid port %d", rule.Port)
+	}
+	return nil
+}
+
+// hostSide reports whether the previous result has an interface on the
+// host, through which the container traffic is routed or bridged.
+func hostSide(result *current.Result) bool {
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ndpTypes are the ICMPv6 types of neighbor discovery, which the chains
+// always allow.
+var ndpTypes = []string{"neighbor-solicitation", "neighbor-advertisement", "router-advertisement"}
+
+// checkBridgeNetfilter fails if the previous result has a bridge on the host
+// whose traffic iptables does not see. Without br_netfilter, the traffic
+// between containers on the bridge would bypass the policy.
+func checkBridgeNetfilter(result *current.Result, proto iptables.Protocol) error {
+	key := "net/bridge/bridge-nf-call-iptables"
+	if proto == iptables.ProtocolIPv6 {
+		key = "net/bridge/bridge-nf-call-ip6tables"
+	}
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" {
+			continue
+		}
+		link, err := netlink.LinkByName(iface.Name)
+		if err != nil || link.Type() != "bridge" {
+			continue
+		}
+		if value, err := sysctl.Sysctl(key); err != nil || value != "1" {
+			return fmt.Errorf("bridge %q does not pass its traffic to iptables: load br_netfilter and set %s to 1", iface.Name, strings.Replace(key, "/", ".", -1))
+		}
+	}
+	return nil
+}
+
+// policyChains holds the chains of a container for one IP family.
+type policyChains struct {
+	ingress utils.Chain
+	egress  utils.Chain
+}
+
+// genPolicyChain creates the top-level chain in the host that the
+// per-container chains hang off.
+func genPolicyChain() utils.Chain {
+	return utils.Chain{
+		Table:       "filter",
+		Name:        PolicyChainName,
+		EntryChains: []string{"FORWARD"},
+		EntryRules:  [][]string{{"-m", "comment", "--comment", "CNI policy plugin rules"}},
+	}
+}
+
+// genContainerChains creates the per-container chains for the family of
+// proto. With onHost, they are entered from CNI-POLICY for the container
+// IPs; otherwise from INPUT and OUTPUT for the container interface.
+func genContainerChains(netName, containerID, ifName string, onHost bool, proto iptables.Protocol, ips []net.IP, rules []PolicyRule) policyChains {
+	pc := policyChains{
+		ingress: utils.Chain{
+			Table: "filter",
+			Name:  utils.FormatChainNameWithPrefix(netName, containerID, "PI-"),
+		},
+		egress: utils.Chain{
+			Table: "filter",
+			Name:  utils.FormatChainNameWithPrefix(netName, containerID, "PE-"),
+		},
+	}
+
+	comment := utils.FormatComment(netName, containerID)
+	if onHost {
+		pc.ingress.EntryChains = []string{PolicyChainName}
+		pc.egress.EntryChains = []string{PolicyChainName}
+		for _, ip := range ips {
+			pc.ingress.EntryRules = append(pc.ingress.EntryRules,
+				[]string{"-d", utils.HostCIDR(ip), "-m", "comment", "--comment", comment})
+			pc.egress.EntryRules = append(pc.egress.EntryRules,
+				[]string{"-s", utils.HostCIDR(ip), "-m", "comment", "--comment", comment})
+		}
+	} else {
+		pc.ingress.EntryChains = []string{"INPUT"}
+		pc.ingress.EntryRules = [][]string{{"-i", ifName, "-m", "comment", "--comment", comment}}
+		pc.egress.EntryChains = []string{"OUTPUT"}
+		pc.egress.EntryRules = [][]string{{"-o", ifName, "-m", "comment", "--comment", comment}}
+	}
+
+	established := []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"}
+	pc.ingress.Rules = append(pc.ingress.Rules, established)
+	pc.egress.Rules = append(pc.egress.Rules, established)
+	if proto == iptables.ProtocolIPv6 {
+		// IPv6 does not work without neighbor discovery
+		for _, icmpType := range ndpTypes {
+			r := []string{"-p", "ipv6-icmp", "--icmpv6-type", icmpType, "-j", "RETURN"}
+			pc.ingress.Rules = append(pc.ingress.Rules, r)
+			pc.egress.Rules = append(pc.egress.Rules, r)
+		}
+	}
+	for _, rule := range rules {
+		r, ok := ruleArgs(&rule, proto)
+		if !ok {
+			continue
+		}
+		if rule.Direction == DirectionIngress {
+			pc.ingress.Rules = append(pc.ingress.Rules, r)
+		} else {
+			pc.egress.Rules = append(pc.egress.Rules, r)
+		}
+	}
+	pc.ingress.Rules = append(pc.ingress.Rules, []string{"-j", "DROP"})
+	pc.egress.Rules = append(pc.egress.Rules, []string{"-j", "DROP"})
+
+	return pc
+}
+
+// ruleArgs returns the iptables rule allowing the traffic of rule, or false
+// if the rule is for the other IP family.
+func ruleArgs(rule *PolicyRule, proto iptables.Protocol) ([]string, bool) {
+	var r []string
+
+	if rule.CIDR.IP != nil {
+		if (rule.CIDR.IP.To4() != nil) != (proto == iptables.ProtocolIPv4) {
+			return nil, false
+		}
+		// The CIDR is the remote end of the traffic
+		flag := "-s"
+		if rule.Direction == DirectionEgress {
+			flag = "-d"
+		}
+		r = append(r, flag, (*net.IPNet)(&rule.CIDR).String())
+	}
+
+	if rule.Protocol != "" {
+		p := rule.Protocol
+		if p == "icmp" && proto == iptables.ProtocolIPv6 {
+			p = "icmpv6"
+		}
+		r = append(r, "-p", p)
+		if rule.Port != 0 {
+			r = append(r, "--dport", strconv.Itoa(rule.Port))
+		}
+	}
+
+	return append(r, "-j", "RETURN"), true
+}
+
+// inPolicyNS runs f in the namespace holding the chains.
+func inPolicyNS(onHost bool, netns string, f func() error) error {
+	if onHost {
+		return f()
+	}
+	return ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		return f()
+	})
+}
+
+func setupPolicy(conf *PolicyNetConf, args *skel.CmdArgs, onHost bool, proto iptables.Protocol, ips []net.IP) error {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return fmt.Errorf("failed to open iptables: %v", err)
+	}
+
+	if onHost {
+		if err := checkBridgeNetfilter(conf.PrevResult, proto); err != nil {
+			return err
+		}
+		policyChain := genPolicyChain()
+		if err := policyChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", policyChain.Name, err)
+		}
+	}
+
+	pc := genContainerChains(conf.Name, args.ContainerID, args.IfName, onHost, proto, ips, conf.Policy)
+	for _, c := range []utils.Chain{pc.ingress, pc.egress} {
+		// Replace the rules of a previous ADD
+		if err := c.Teardown(ipt); err != nil {
+			return fmt.Errorf("failed to teardown chain %s: %v", c.Name, err)
+		}
+		if err := c.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func teardownPolicy(netName, containerID string) error {
+	pc := genContainerChains(netName, containerID, "", true, iptables.ProtocolIPv4, nil, nil)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// Swallow the error - this protocol is not usable, so we
+			// cannot have added anything
+			continue
+		}
+		for _, c := range []utils.Chain{pc.ingress, pc.egress} {
+			// The entry chain depends on where the chain was set up
+			c.EntryChains = []string{PolicyChainName, "INPUT", "OUTPUT"}
+			if err := c.Teardown(ipt); err != nil {
+				return fmt.Errorf("failed to teardown chain %s: %v", c.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.Policy != nil {
+		onHost := hostSide(conf.PrevResult)
+		err := inPolicyNS(onHost, args.Netns, func() error {
+			for proto, ips := range utils.SplitByFamily(containerIPs) {
+				if err := setupPolicy(conf, args, onHost, proto, ips); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// The chains are found by name, so we don't need the IPs; deletion
+	// is idempotent. They may be in the host or in the container.
+	if err := teardownPolicy(conf.Name, args.ContainerID); err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return teardownPolicy(conf.Name, args.ContainerID)
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.Policy == nil {
+		return nil
+	}
+
+	onHost := hostSide(conf.PrevResult)
+	return inPolicyNS(onHost, args.Netns, func() error {
+		for proto, ips := range utils.SplitByFamily(containerIPs) {
+			ipt, err := iptables.NewWithProtocol(proto)
+			if err != nil {
+				return fmt.Errorf("failed to open iptables: %v", err)
+			}
+
+			pc := genContainerChains(conf.Name, args.ContainerID, args.IfName, onHost, proto, ips, conf.Policy)
+			chains := []utils.Chain{pc.ingress, pc.egress}
+			if onHost {
+				if err := checkBridgeNetfilter(conf.PrevResult, proto); err != nil {
+					return err
+				}
+				chains = append([]utils.Chain{genPolicyChain()}, chains...)
+			}
+			for _, c := range chains {
+				if err := c.Check(ipt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI policy plugin")
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prevResult = `{
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			},
+			{
+				"version": "6",
+				"address": "2001:db8::2/64",
+				"interface": 1
+			},
+			{
+				"version": "4",
+				"address": "10.0.0.1/24",
+				"interface": 0
+			}
+		]
+	}`
+
+var policyConf = fmt.Sprintf(`{
+	"name": "test",
+	"type": "policy",
+	"cniVersion": "0.4.0",
+	"policy": [
+		{"direction": "ingress", "protocol": "tcp", "port": 80},
+		{"direction": "ingress", "cidr": "10.1.0.0/16", "protocol": "icmp"},
+		{"direction": "egress", "cidr": "2001:db8:1::/48"},
+		{"direction": "egress", "protocol": "icmp"}
+	],
+	"prevResult": %s
+}`, prevResult)
+
+var _ = Describe("policy configuration", func() {
+	It("parses the policy and finds the container IPs", func() {
+		conf, ips, err := parseConf([]byte(policyConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Policy).To(HaveLen(4))
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2")}))
+		Expect(hostSide(conf.PrevResult)).To(BeTrue())
+	})
+
+	It("uses the runtime config if there is no static policy", func() {
+		conf, _, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "policy",
+	"runtimeConfig": {
+		"policy": [{"direction": "egress", "protocol": "udp", "port": 53}]
+	}
+}`), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Policy).To(Equal([]PolicyRule{{Direction: "egress", Protocol: "udp", Port: 53}}))
+	})
+
+	It("prefers the runtime config to the static config", func() {
+		conf, _, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "policy",
+	"policy": [{"direction": "ingress", "protocol": "tcp", "port": 80}],
+	"runtimeConfig": {
+		"policy": [{"direction": "egress", "protocol": "udp", "port": 53}]
+	}
+}`), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Policy).To(Equal([]PolicyRule{{Direction: "egress", Protocol: "udp", Port: 53}}))
+	})
+
+	It("rejects invalid rules", func() {
+		for conf, msg := range map[string]string{
+			`{"direction": "both"}`:                                      `invalid policy rule 0: direction must be "ingress" or "egress"`,
+			`{"direction": "ingress", "protocol": "gre"}`:                `invalid policy rule 0: unknown protocol "gre"`,
+			`{"direction": "ingress", "port": 80}`:                       "invalid policy rule 0: port requires protocol tcp, udp or sctp",
+			`{"direction": "ingress", "protocol": "tcp", "port": 70000}`: "invalid policy rule 0: invalid port 70000",
+		} {
+			_, _, err := parseConf([]byte(fmt.Sprintf(`{"name": "test", "type": "policy", "policy": [%s]}`, conf)), "eth0")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("generates correct host chains", func() {
+		conf, _, err := parseConf([]byte(policyConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+
+		comment := utils.FormatComment("test", "dummy")
+		pc := genContainerChains("test", "dummy", "eth0", true, iptables.ProtocolIPv4,
+			[]net.IP{net.ParseIP("10.0.0.2")}, conf.Policy)
+		Expect(pc.ingress).To(Equal(utils.Chain{
+			Table:       "filter",
+			Name:        utils.FormatChainNameWithPrefix("test", "dummy", "PI-"),
+			EntryChains: []string{PolicyChainName},
+			EntryRules: [][]string{
+				{"-d", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+			},
+			Rules: [][]string{
+				{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+				{"-p", "tcp", "--dport", "80", "-j", "RETURN"},
+				{"-s", "10.1.0.0/16", "-p", "icmp", "-j", "RETURN"},
+				{"-j", "DROP"},
+			},
+		}))
+		Expect(pc.egress).To(Equal(utils.Chain{
+			Table:       "filter",
+			Name:        utils.FormatChainNameWithPrefix("test", "dummy", "PE-"),
+			EntryChains: []string{PolicyChainName},
+			EntryRules: [][]string{
+				{"-s", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+			},
+			Rules: [][]string{
+				{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+				{"-p", "icmp", "-j", "RETURN"},
+				{"-j", "DROP"},
+			},
+		}))
+	})
+
+	It("generates correct container chains", func() {
+		conf, _, err := parseConf([]byte(policyConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+
+		comment := utils.FormatComment("test", "dummy")
+		pc := genContainerChains("test", "dummy", "eth0", false, iptables.ProtocolIPv6,
+			[]net.IP{net.ParseIP("2001:db8::2")}, conf.Policy)
+		Expect(pc.ingress.EntryChains).To(Equal([]string{"INPUT"}))
+		Expect(pc.ingress.EntryRules).To(Equal([][]string{{"-i", "eth0", "-m", "comment", "--comment", comment}}))
+		Expect(pc.ingress.Rules).To(Equal([][]string{
+			{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+			{"-p", "ipv6-icmp", "--icmpv6-type", "neighbor-solicitation", "-j", "RETURN"},
+			{"-p", "ipv6-icmp", "--icmpv6-type", "neighbor-advertisement", "-j", "RETURN"},
+			{"-p", "ipv6-icmp", "--icmpv6-type", "router-advertisement", "-j", "RETURN"},
+			{"-p", "tcp", "--dport", "80", "-j", "RETURN"},
+			{"-j", "DROP"},
+		}))
+		Expect(pc.egress.EntryChains).To(Equal([]string{"OUTPUT"}))
+		Expect(pc.egress.EntryRules).To(Equal([][]string{{"-o", "eth0", "-m", "comment", "--comment", comment}}))
+		Expect(pc.egress.Rules).To(Equal([][]string{
+			{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+			{"-p", "ipv6-icmp", "--icmpv6-type", "neighbor-solicitation", "-j", "RETURN"},
+			{"-p", "ipv6-icmp", "--icmpv6-type", "neighbor-advertisement", "-j", "RETURN"},
+			{"-p", "ipv6-icmp", "--icmpv6-type", "router-advertisement", "-j", "RETURN"},
+			{"-d", "2001:db8:1::/48", "-j", "RETURN"},
+			{"-p", "icmpv6", "-j", "RETURN"},
+			{"-j", "DROP"},
+		}))
+	})
+
+	It("allows neighbor discovery to an IPv6 container", func() {
+		conf, ips, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "policy",
+	"cniVersion": "0.4.0",
+	"policy": [{"direction": "ingress", "protocol": "tcp", "port": 22}],
+	"prevResult": {
+		"interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/test"}],
+		"ips": [{"version": "6", "address": "2001:db8::2/64", "interface": 0}]
+	}
+}`), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hostSide(conf.PrevResult)).To(BeFalse())
+
+		byFamily := utils.SplitByFamily(ips)
+		Expect(byFamily).To(HaveLen(1))
+		pc := genContainerChains("test", "dummy", "eth0", false, iptables.ProtocolIPv6,
+			byFamily[iptables.ProtocolIPv6], conf.Policy)
+		for _, rules := range [][][]string{pc.ingress.Rules, pc.egress.Rules} {
+			for _, icmpType := range []string{"neighbor-solicitation", "neighbor-advertisement", "router-advertisement"} {
+				Expect(rules).To(ContainElement([]string{"-p", "ipv6-icmp", "--icmpv6-type", icmpType, "-j", "RETURN"}))
+			}
+			// Before the rest is dropped
+			Expect(rules[len(rules)-1]).To(Equal([]string{"-j", "DROP"}))
+		}
+	})
+})
+
+var _ = Describe("policy plugin", func() {
+	var originalNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("refuses a bridge whose traffic bypasses iptables", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{Name: "cni0"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			conf, _, err := parseConf([]byte(policyConf), IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			const key = "net/bridge/bridge-nf-call-iptables"
+			value, err := sysctl.Sysctl(key)
+			if err != nil {
+				Skip("br_netfilter is not loaded")
+			}
+			defer sysctl.Sysctl(key, value)
+
+			_, err = sysctl.Sysctl(key, "1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(checkBridgeNetfilter(conf.PrevResult, iptables.ProtocolIPv4)).To(Succeed())
+
+			_, err = sysctl.Sysctl(key, "0")
+			Expect(err).NotTo(HaveOccurred())
+			err = checkBridgeNetfilter(conf.PrevResult, iptables.ProtocolIPv4)
+			Expect(err).To(MatchError(`bridge "cni0" does not pass its traffic to iptables: load br_netfilter and set net.bridge.bridge-nf-call-iptables to 1`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("installs the chains with ADD, checks them with CHECK and removes them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   []byte(policyConf),
+		}
+		pc := genContainerChains("test", "dummy", IFNAME, true, iptables.ProtocolIPv4, nil, nil)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			rules, err := ipt.List("filter", "FORWARD")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1]).To(HaveSuffix("-j " + PolicyChainName))
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Drop the ingress rules
+			err = ipt.ClearChain("filter", pc.ingress.Name)
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf("chain %q", pc.ingress.Name)))
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, name := range []string{pc.ingress.Name, pc.egress.Name} {
+				exists, err := utils.ChainExists(ipt, "filter", name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			}
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -32,7 +32,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 )
 
@@ -117,8 +117,39 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	netConf, err := parseConfig(args.StdinData, args.IfName)
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %v", err)
+	}
+
+	if netConf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if len(netConf.RuntimeConfig.PortMaps) == 0 {
+		return nil
+	}
+
+	netConf.ContainerID = args.ContainerID
+
+	if netConf.ContIPv4 != nil {
+		if err := checkPorts(netConf, netConf.ContIPv4); err != nil {
+			return err
+		}
+	}
+
+	if netConf.ContIPv6 != nil {
+		if err := checkPorts(netConf, netConf.ContIPv6); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.PluginSupports("", "0.1.0", "0.2.0", "0.3.0", version.Current()))
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("", "0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI portmap plugin")
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -131,6 +162,10 @@ func parseConfig(stdin []byte, ifName string) (*PortMapConf, error) {
 
 	// Parse previous result.
 	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
 		resultBytes, err := json.Marshal(conf.RawPrevResult)
 		if err != nil {
 			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
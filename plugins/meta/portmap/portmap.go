@@ -20,6 +20,7 @@ import (
 	"sort"
 	"strconv"
 
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/coreos/go-iptables/iptables"
 )
@@ -72,13 +73,13 @@ func forwardPorts(config *PortMapConf, containerIP net.IP) error {
 	if *config.SNAT {
 		if config.ExternalSetMarkChain == nil {
 			setMarkChain := genSetMarkChain(*config.MarkMasqBit)
-			if err := setMarkChain.setup(ipt); err != nil {
-				return fmt.Errorf("unable to create chain %s: %v", setMarkChain.name, err)
+			if err := setMarkChain.Setup(ipt); err != nil {
+				return fmt.Errorf("unable to create chain %s: %v", setMarkChain.Name, err)
 			}
 
 			masqChain := genMarkMasqChain(*config.MarkMasqBit)
-			if err := masqChain.setup(ipt); err != nil {
-				return fmt.Errorf("unable to create chain %s: %v", setMarkChain.name, err)
+			if err := masqChain.Setup(ipt); err != nil {
+				return fmt.Errorf("unable to create chain %s: %v", setMarkChain.Name, err)
 			}
 		}
 
@@ -96,7 +97,7 @@ func forwardPorts(config *PortMapConf, containerIP net.IP) error {
 
 	// Generate the DNAT (actual port forwarding) rules
 	toplevelDnatChain := genToplevelDnatChain()
-	if err := toplevelDnatChain.setup(ipt); err != nil {
+	if err := toplevelDnatChain.Setup(ipt); err != nil {
 		return fmt.Errorf("failed to create top-level DNAT chain: %v", err)
 	}
 
@@ -104,42 +105,62 @@ func forwardPorts(config *PortMapConf, containerIP net.IP) error {
 	// First, idempotently tear down this chain in case there was some
 	// sort of collision or bad state.
 	fillDnatRules(&dnatChain, config, containerIP)
-	if err := dnatChain.setup(ipt); err != nil {
+	if err := dnatChain.Setup(ipt); err != nil {
 		return fmt.Errorf("unable to setup DNAT: %v", err)
 	}
 
 	return nil
 }
 
+// checkPorts verifies that the DNAT chain for a given container IP is
+// present and holds the expected rules.
+func checkPorts(config *PortMapConf, containerIP net.IP) error {
+	isV6 := (containerIP.To4() == nil)
+
+	ipt := maybeGetIptables(isV6)
+	if ipt == nil {
+		return fmt.Errorf("failed to open iptables")
+	}
+
+	toplevelDnatChain := genToplevelDnatChain()
+	if err := toplevelDnatChain.Check(ipt); err != nil {
+		return err
+	}
+
+	dnatChain := genDnatChain(config.Name, config.ContainerID)
+	fillDnatRules(&dnatChain, config, containerIP)
+	return dnatChain.Check(ipt)
+}
+
 // genToplevelDnatChain creates the top-level summary chain that we'll
 // add our chain to. This is easy, because creating chains is idempotent.
 // IMPORTANT: do not change this, or else upgrading plugins will require
 // manual intervention.
-func genToplevelDnatChain() chain {
-	return chain{
-		table: "nat",
-		name:  TopLevelDNATChainName,
-		entryRules: [][]string{{
+func genToplevelDnatChain() utils.Chain {
+	return utils.Chain{
+		Table: "nat",
+		Name:  TopLevelDNATChainName,
+		EntryRules: [][]string{{
 			"-m", "addrtype",
 			"--dst-type", "LOCAL",
 		}},
-		entryChains: []string{"PREROUTING", "OUTPUT"},
+		EntryChains: []string{"PREROUTING", "OUTPUT"},
 	}
 }
 
 // genDnatChain creates the per-container chain.
 // Conditions are any static entry conditions for the chain.
-func genDnatChain(netName, containerID string) chain {
-	return chain{
-		table:       "nat",
-		name:        formatChainName("DN-", netName, containerID),
-		entryChains: []string{TopLevelDNATChainName},
+func genDnatChain(netName, containerID string) utils.Chain {
+	return utils.Chain{
+		Table:       "nat",
+		Name:        formatChainName("DN-", netName, containerID),
+		EntryChains: []string{TopLevelDNATChainName},
 	}
 }
 
 // dnatRules generates the destination NAT rules, one per port, to direct
 // traffic from hostip:hostport to podip:podport
-func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
+func fillDnatRules(c *utils.Chain, config *PortMapConf, containerIP net.IP) {
 	isV6 := (containerIP.To4() == nil)
 	comment := trimComment(fmt.Sprintf(`dnat name: "%s" id: "%s"`, config.Name, config.ContainerID))
 	entries := config.RuntimeConfig.PortMaps
@@ -172,7 +193,7 @@ func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
 			} else if !isV6 && config.ConditionsV4 != nil && len(*config.ConditionsV4) > 0 {
 				r = append(r, *config.ConditionsV4...)
 			}
-			c.entryRules = append(c.entryRules, r)
+			c.EntryRules = append(c.EntryRules, r)
 		}
 	}
 
@@ -181,7 +202,7 @@ func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
 	// - mark localhost for masq (for v4)
 	// - do dnat
 	// the ordering is important here; the mark rules must be first.
-	c.rules = make([][]string, 0, 3*len(entries))
+	c.Rules = make([][]string, 0, 3*len(entries))
 	for _, entry := range entries {
 		ruleBase := []string{
 			"-p", entry.Protocol,
@@ -201,7 +222,7 @@ func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
 				"-s", containerIP.String(),
 				"-j", setMarkChainName,
 			)
-			c.rules = append(c.rules, hpRule)
+			c.Rules = append(c.Rules, hpRule)
 
 			if !isV6 {
 				// localhost
@@ -212,7 +233,7 @@ func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
 					"-s", "127.0.0.1",
 					"-j", setMarkChainName,
 				)
-				c.rules = append(c.rules, localRule)
+				c.Rules = append(c.Rules, localRule)
 			}
 		}
 
@@ -223,20 +244,20 @@ func fillDnatRules(c *chain, config *PortMapConf, containerIP net.IP) {
 			"-j", "DNAT",
 			"--to-destination", fmtIpPort(containerIP, entry.ContainerPort),
 		)
-		c.rules = append(c.rules, dnatRule)
+		c.Rules = append(c.Rules, dnatRule)
 	}
 }
 
 // genSetMarkChain creates the SETMARK chain - the chain that sets the
 // "to-be-masqueraded" mark and returns.
 // Chains are idempotent, so we'll always create this.
-func genSetMarkChain(markBit int) chain {
+func genSetMarkChain(markBit int) utils.Chain {
 	markValue := 1 << uint(markBit)
 	markDef := fmt.Sprintf("%#x/%#x", markValue, markValue)
-	ch := chain{
-		table: "nat",
-		name:  SetMarkChainName,
-		rules: [][]string{{
+	ch := utils.Chain{
+		Table: "nat",
+		Name:  SetMarkChainName,
+		Rules: [][]string{{
 			"-m", "comment",
 			"--comment", "CNI portfwd masquerade mark",
 			"-j", "MARK",
@@ -248,18 +269,18 @@ func genSetMarkChain(markBit int) chain {
 
 // genMarkMasqChain creates the chain that masquerades all packets marked
 // in the SETMARK chain
-func genMarkMasqChain(markBit int) chain {
+func genMarkMasqChain(markBit int) utils.Chain {
 	markValue := 1 << uint(markBit)
 	markDef := fmt.Sprintf("%#x/%#x", markValue, markValue)
-	ch := chain{
-		table:       "nat",
-		name:        MarkMasqChainName,
-		entryChains: []string{"POSTROUTING"},
-		entryRules: [][]string{{
+	ch := utils.Chain{
+		Table:       "nat",
+		Name:        MarkMasqChainName,
+		EntryChains: []string{"POSTROUTING"},
+		EntryRules: [][]string{{
 			"-m", "comment",
 			"--comment", "CNI portfwd requiring masquerade",
 		}},
-		rules: [][]string{{
+		Rules: [][]string{{
 			"-m", "mark",
 			"--mark", markDef,
 			"-j", "MASQUERADE",
@@ -278,13 +299,13 @@ func enableLocalnetRouting(ifName string) error {
 
 // genOldSnatChain is no longer used, but used to be created. We'll try and
 // tear it down in case the plugin version changed between ADD and DEL
-func genOldSnatChain(netName, containerID string) chain {
+func genOldSnatChain(netName, containerID string) utils.Chain {
 	name := formatChainName("SN-", netName, containerID)
 
-	return chain{
-		table:       "nat",
-		name:        name,
-		entryChains: []string{OldTopLevelSNATChainName},
+	return utils.Chain{
+		Table:       "nat",
+		Name:        name,
+		EntryChains: []string{OldTopLevelSNATChainName},
 	}
 }
 
@@ -311,17 +332,17 @@ func unforwardPorts(config *PortMapConf) error {
 	}
 
 	if ip4t != nil {
-		if err := dnatChain.teardown(ip4t); err != nil {
+		if err := dnatChain.Teardown(ip4t); err != nil {
 			return fmt.Errorf("could not teardown ipv4 dnat: %v", err)
 		}
-		oldSnatChain.teardown(ip4t)
+		oldSnatChain.Teardown(ip4t)
 	}
 
 	if ip6t != nil {
-		if err := dnatChain.teardown(ip6t); err != nil {
+		if err := dnatChain.Teardown(ip6t); err != nil {
 			return fmt.Errorf("could not teardown ipv6 dnat: %v", err)
 		}
-		oldSnatChain.teardown(ip6t)
+		oldSnatChain.Teardown(ip6t)
 	}
 	return nil
 }
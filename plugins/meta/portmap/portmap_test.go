@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/containernetworking/plugins/pkg/utils"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -153,10 +155,10 @@ var _ = Describe("portmapping configuration", func() {
 			It("generates a correct standard container chain", func() {
 				ch := genDnatChain(netName, containerID)
 
-				Expect(ch).To(Equal(chain{
-					table:       "nat",
-					name:        "CNI-DN-bfd599665540dd91d5d28",
-					entryChains: []string{TopLevelDNATChainName},
+				Expect(ch).To(Equal(utils.Chain{
+					Table:       "nat",
+					Name:        "CNI-DN-bfd599665540dd91d5d28",
+					EntryChains: []string{TopLevelDNATChainName},
 				}))
 				configBytes := []byte(`{
 	"name": "test",
@@ -180,15 +182,15 @@ var _ = Describe("portmapping configuration", func() {
 				conf.ContainerID = containerID
 
 				ch = genDnatChain(conf.Name, containerID)
-				Expect(ch).To(Equal(chain{
-					table:       "nat",
-					name:        "CNI-DN-67e92b96e692a494b6b85",
-					entryChains: []string{"CNI-HOSTPORT-DNAT"},
+				Expect(ch).To(Equal(utils.Chain{
+					Table:       "nat",
+					Name:        "CNI-DN-67e92b96e692a494b6b85",
+					EntryChains: []string{"CNI-HOSTPORT-DNAT"},
 				}))
 
 				fillDnatRules(&ch, conf, net.ParseIP("10.0.0.2"))
 
-				Expect(ch.entryRules).To(Equal([][]string{
+				Expect(ch.EntryRules).To(Equal([][]string{
 					{"-m", "comment", "--comment",
 						fmt.Sprintf("dnat name: \"test\" id: \"%s\"", containerID),
 						"-m", "multiport",
@@ -203,7 +205,7 @@ var _ = Describe("portmapping configuration", func() {
 						"a", "b"},
 				}))
 
-				Expect(ch.rules).To(Equal([][]string{
+				Expect(ch.Rules).To(Equal([][]string{
 					{"-p", "tcp", "--dport", "8080", "-s", "10.0.0.2", "-j", "CNI-HOSTPORT-SETMARK"},
 					{"-p", "tcp", "--dport", "8080", "-s", "127.0.0.1", "-j", "CNI-HOSTPORT-SETMARK"},
 					{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:80"},
@@ -218,12 +220,12 @@ var _ = Describe("portmapping configuration", func() {
 					{"-p", "udp", "--dport", "8082", "-j", "DNAT", "--to-destination", "10.0.0.2:82"},
 				}))
 
-				ch.rules = nil
-				ch.entryRules = nil
+				ch.Rules = nil
+				ch.EntryRules = nil
 
 				fillDnatRules(&ch, conf, net.ParseIP("2001:db8::2"))
 
-				Expect(ch.rules).To(Equal([][]string{
+				Expect(ch.Rules).To(Equal([][]string{
 					{"-p", "tcp", "--dport", "8080", "-s", "2001:db8::2", "-j", "CNI-HOSTPORT-SETMARK"},
 					{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "[2001:db8::2]:80"},
 					{"-p", "tcp", "--dport", "8081", "-s", "2001:db8::2", "-j", "CNI-HOSTPORT-SETMARK"},
@@ -235,13 +237,13 @@ var _ = Describe("portmapping configuration", func() {
 				}))
 
 				// Disable snat, generate rules
-				ch.rules = nil
-				ch.entryRules = nil
+				ch.Rules = nil
+				ch.EntryRules = nil
 				fvar := false
 				conf.SNAT = &fvar
 
 				fillDnatRules(&ch, conf, net.ParseIP("10.0.0.2"))
-				Expect(ch.rules).To(Equal([][]string{
+				Expect(ch.Rules).To(Equal([][]string{
 					{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:80"},
 					{"-p", "tcp", "--dport", "8081", "-j", "DNAT", "--to-destination", "10.0.0.2:80"},
 					{"-p", "udp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:81"},
@@ -252,10 +254,10 @@ var _ = Describe("portmapping configuration", func() {
 			It("generates a correct chain with external mark", func() {
 				ch := genDnatChain(netName, containerID)
 
-				Expect(ch).To(Equal(chain{
-					table:       "nat",
-					name:        "CNI-DN-bfd599665540dd91d5d28",
-					entryChains: []string{TopLevelDNATChainName},
+				Expect(ch).To(Equal(utils.Chain{
+					Table:       "nat",
+					Name:        "CNI-DN-bfd599665540dd91d5d28",
+					EntryChains: []string{TopLevelDNATChainName},
 				}))
 				configBytes := []byte(`{
 	"name": "test",
@@ -277,7 +279,7 @@ var _ = Describe("portmapping configuration", func() {
 
 				ch = genDnatChain(conf.Name, containerID)
 				fillDnatRules(&ch, conf, net.ParseIP("10.0.0.2"))
-				Expect(ch.rules).To(Equal([][]string{
+				Expect(ch.Rules).To(Equal([][]string{
 					{"-p", "tcp", "--dport", "8080", "-s", "10.0.0.2", "-j", "PLZ-SET-MARK"},
 					{"-p", "tcp", "--dport", "8080", "-s", "127.0.0.1", "-j", "PLZ-SET-MARK"},
 					{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:80"},
@@ -287,21 +289,21 @@ var _ = Describe("portmapping configuration", func() {
 			It("generates a correct top-level chain", func() {
 				ch := genToplevelDnatChain()
 
-				Expect(ch).To(Equal(chain{
-					table:       "nat",
-					name:        "CNI-HOSTPORT-DNAT",
-					entryChains: []string{"PREROUTING", "OUTPUT"},
-					entryRules:  [][]string{{"-m", "addrtype", "--dst-type", "LOCAL"}},
+				Expect(ch).To(Equal(utils.Chain{
+					Table:       "nat",
+					Name:        "CNI-HOSTPORT-DNAT",
+					EntryChains: []string{"PREROUTING", "OUTPUT"},
+					EntryRules:  [][]string{{"-m", "addrtype", "--dst-type", "LOCAL"}},
 				}))
 			})
 
 			It("generates the correct mark chains", func() {
 				masqBit := 5
 				ch := genSetMarkChain(masqBit)
-				Expect(ch).To(Equal(chain{
-					table: "nat",
-					name:  "CNI-HOSTPORT-SETMARK",
-					rules: [][]string{{
+				Expect(ch).To(Equal(utils.Chain{
+					Table: "nat",
+					Name:  "CNI-HOSTPORT-SETMARK",
+					Rules: [][]string{{
 						"-m", "comment",
 						"--comment", "CNI portfwd masquerade mark",
 						"-j", "MARK",
@@ -310,15 +312,15 @@ var _ = Describe("portmapping configuration", func() {
 				}))
 
 				ch = genMarkMasqChain(masqBit)
-				Expect(ch).To(Equal(chain{
-					table:       "nat",
-					name:        "CNI-HOSTPORT-MASQ",
-					entryChains: []string{"POSTROUTING"},
-					entryRules: [][]string{{
+				Expect(ch).To(Equal(utils.Chain{
+					Table:       "nat",
+					Name:        "CNI-HOSTPORT-MASQ",
+					EntryChains: []string{"POSTROUTING"},
+					EntryRules: [][]string{{
 						"-m", "comment",
 						"--comment", "CNI portfwd requiring masquerade",
 					}},
-					rules: [][]string{{
+					Rules: [][]string{{
 						"-m", "mark",
 						"--mark", "0x20/0x20",
 						"-j", "MASQUERADE",
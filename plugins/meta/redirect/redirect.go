@@ -0,0 +1,296 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that redirects the traffic of the container
+// to some destinations, such as a metadata service or DNS, to an endpoint
+// on the host, e.g. a node-local cache or proxy. It is the reverse of
+// portmap, which forwards inbound host ports to the container.
+//
+// It is intended to be used as a chained CNI plugin, and determines the
+// container IPs from the previous result. Each container gets its own
+// chain in the nat table per IP family, jumped to from PREROUTING for each
+// container IP, so that DEL can remove it in one go.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Redirect sends the traffic to a destination to an endpoint on the host
+// instead. The destination is any IP and port unless they are set.
+type Redirect struct {
+	Destination net.IP `json:"destination,omitempty"`
+	Port        int    `json:"port,omitempty"`
+	Protocol    string `json:"protocol,omitempty"` // tcp, udp or sctp; tcp and udp if unset
+	ToIP        net.IP `json:"toIP"`
+	ToPort      int    `json:"toPort,omitempty"` // The original port if unset
+}
+
+// RedirectNetConf represents the redirect plugin configuration.
+type RedirectNetConf struct {
+	types.NetConf
+	Redirects []Redirect `json:"redirects,omitempty"`
+
+	RuntimeConfig struct {
+		Redirects []Redirect `json:"redirects,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+var protocols = map[string]bool{"tcp": true, "udp": true, "sctp": true}
+
+func parseConf(data []byte, ifName string) (*RedirectNetConf, []net.IP, error) {
+	conf := RedirectNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// The runtime config overrides the static config
+	if conf.RuntimeConfig.Redirects != nil {
+		conf.Redirects = conf.RuntimeConfig.Redirects
+	}
+	for i := range conf.Redirects {
+		if err := validateRedirect(&conf.Redirects[i]); err != nil {
+			return nil, nil, fmt.Errorf("redirect %d: %v", i, err)
+		}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	// The previous result may leave its version to the configuration
+	if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+		conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+	}
+	resultBytes, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	res, err := version.NewResult(conf.CNIVersion, resultBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	conf.RawPrevResult = nil
+	conf.PrevResult, err = current.NewResultFromResult(res)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	return &conf, utils.ContainerIPs(conf.PrevResult, ifName), nil
+}
+
+func validateRedirect(r *Redirect) error {
+	if r.ToIP == nil {
+		return fmt.Errorf("toIP must be specified")
+	}
+	if r.Destination != nil && isV6(r.Destination) != isV6(r.ToIP) {
+		return fmt.Errorf("destination %s is not in the same family as %s", r.Destination, r.ToIP)
+	}
+	if r.Protocol != "" && !protocols[r.Protocol] {
+		return fmt.Errorf("unknown protocol %q", r.Protocol)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d", r.Port)
+	}
+	if r.ToPort < 0 || r.ToPort > 65535 {
+		return fmt.Errorf("invalid toPort %d", r.ToPort)
+	}
+	if r.Destination == nil && r.Port == 0 {
+		return fmt.Errorf("destination or port must be specified")
+	}
+	return nil
+}
+
+// ruleProtocols returns the protocols to match. Ports need a protocol; all
+// traffic to the destination is redirected otherwise.
+func (r *Redirect) ruleProtocols() []string {
+	switch {
+	case r.Protocol != "":
+		return []string{r.Protocol}
+	case r.Port != 0 || r.ToPort != 0:
+		return []string{"tcp", "udp"}
+	default:
+		return []string{""}
+	}
+}
+
+func (r *Redirect) target() string {
+	port := r.ToPort
+	if port == 0 {
+		port = r.Port
+	}
+	if port == 0 {
+		return r.ToIP.String()
+	}
+	if isV6(r.ToIP) {
+		return fmt.Sprintf("[%s]:%d", r.ToIP.String(), port)
+	}
+	return fmt.Sprintf("%s:%d", r.ToIP.String(), port)
+}
+
+// genRedirectChain creates the per-container chain of a family, given the
+// container IPs and the redirects of that family.
+func genRedirectChain(netName, containerID string, redirects []Redirect, ips []net.IP) utils.Chain {
+	c := utils.Chain{
+		Table:       "nat",
+		Name:        utils.FormatChainNameWithPrefix(netName, containerID, "RD-"),
+		EntryChains: []string{"PREROUTING"},
+	}
+
+	comment := utils.FormatComment(netName, containerID)
+	for _, ip := range ips {
+		c.EntryRules = append(c.EntryRules,
+			[]string{"-s", utils.HostCIDR(ip), "-m", "comment", "--comment", comment})
+	}
+
+	for _, r := range redirects {
+		for _, proto := range r.ruleProtocols() {
+			rule := []string{}
+			if r.Destination != nil {
+				rule = append(rule, "-d", utils.HostCIDR(r.Destination))
+			}
+			if proto != "" {
+				rule = append(rule, "-p", proto)
+				if r.Port != 0 {
+					rule = append(rule, "--dport", strconv.Itoa(r.Port))
+				}
+			}
+			c.Rules = append(c.Rules, append(rule, "-j", "DNAT", "--to-destination", r.target()))
+		}
+	}
+	return c
+}
+
+// familyChains returns the chains of the families that have both
+// container IPs and redirects, by iptables protocol.
+func familyChains(conf *RedirectNetConf, containerID string, ips []net.IP) map[iptables.Protocol]utils.Chain {
+	chains := map[iptables.Protocol]utils.Chain{}
+	for _, v6 := range []bool{false, true} {
+		var familyIPs []net.IP
+		for _, ip := range ips {
+			if isV6(ip) == v6 {
+				familyIPs = append(familyIPs, ip)
+			}
+		}
+		var redirects []Redirect
+		for _, r := range conf.Redirects {
+			if isV6(r.ToIP) == v6 {
+				redirects = append(redirects, r)
+			}
+		}
+		if len(familyIPs) == 0 || len(redirects) == 0 {
+			continue
+		}
+		chains[protocolOf(v6)] = genRedirectChain(conf.Name, containerID, redirects, familyIPs)
+	}
+	return chains
+}
+
+func isV6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+func protocolOf(v6 bool) iptables.Protocol {
+	if v6 {
+		return iptables.ProtocolIPv6
+	}
+	return iptables.ProtocolIPv4
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	for proto, chain := range familyChains(conf, args.ContainerID, containerIPs) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+		if err := chain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", chain.Name, err)
+		}
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// The container chain is found by name, so we don't need the IPs;
+	// deletion is idempotent
+	chain := genRedirectChain(conf.Name, args.ContainerID, nil, nil)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// Swallow the error - this protocol is not usable, so we
+			// cannot have added anything
+			continue
+		}
+		if err := chain.Teardown(ipt); err != nil {
+			return fmt.Errorf("failed to teardown chain %s: %v", chain.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	for proto, chain := range familyChains(conf, args.ContainerID, containerIPs) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+		if err := chain.Check(ipt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI redirect plugin")
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prevResult = `{
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			},
+			{
+				"version": "6",
+				"address": "2001:db8::2/64",
+				"interface": 1
+			},
+			{
+				"version": "4",
+				"address": "10.0.0.1/24",
+				"interface": 0
+			}
+		]
+	}`
+
+var redirectConf = fmt.Sprintf(`{
+	"name": "test",
+	"type": "redirect",
+	"cniVersion": "0.4.0",
+	"redirects": [
+		{"destination": "169.254.169.254", "port": 80, "protocol": "tcp", "toIP": "10.0.0.1", "toPort": 8181},
+		{"port": 53, "toIP": "10.0.0.1"},
+		{"port": 53, "toIP": "2001:db8::1"}
+	],
+	"prevResult": %s
+}`, prevResult)
+
+var _ = Describe("redirect configuration", func() {
+	It("finds the container IPs", func() {
+		conf, ips, err := parseConf([]byte(redirectConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Redirects).To(HaveLen(3))
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2")}))
+	})
+
+	It("uses the runtime config if there is no static one", func() {
+		conf, _, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "redirect",
+	"cniVersion": "0.4.0",
+	"runtimeConfig": {
+		"redirects": [{"port": 53, "protocol": "udp", "toIP": "10.0.0.1"}]
+	}
+}`), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Redirects).To(Equal([]Redirect{
+			{Port: 53, Protocol: "udp", ToIP: net.ParseIP("10.0.0.1")},
+		}))
+	})
+
+	It("prefers the runtime config to the static config", func() {
+		conf, _, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "redirect",
+	"cniVersion": "0.4.0",
+	"redirects": [{"port": 53, "toIP": "10.0.0.1"}],
+	"runtimeConfig": {
+		"redirects": [{"port": 80, "protocol": "tcp", "toIP": "10.0.0.1", "toPort": 8080}]
+	}
+}`), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Redirects).To(Equal([]Redirect{
+			{Port: 80, Protocol: "tcp", ToIP: net.ParseIP("10.0.0.1"), ToPort: 8080},
+		}))
+	})
+
+	It("rejects invalid redirects", func() {
+		for redirect, msg := range map[string]string{
+			`{"port": 53}`: "redirect 0: toIP must be specified",
+			`{"destination": "2001:db8::53", "toIP": "10.0.0.1"}`:  "redirect 0: destination 2001:db8::53 is not in the same family as 10.0.0.1",
+			`{"port": 53, "protocol": "icmp", "toIP": "10.0.0.1"}`: `redirect 0: unknown protocol "icmp"`,
+			`{"port": 65536, "toIP": "10.0.0.1"}`:                  "redirect 0: invalid port 65536",
+			`{"toIP": "10.0.0.1"}`:                                 "redirect 0: destination or port must be specified",
+		} {
+			_, _, err := parseConf([]byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "redirect",
+	"redirects": [%s]
+}`, redirect)), "eth0")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("generates a correct container chain per family", func() {
+		conf, ips, err := parseConf([]byte(redirectConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+
+		chains := familyChains(conf, "dummy", ips)
+		Expect(chains).To(HaveLen(2))
+
+		name := utils.FormatChainNameWithPrefix("test", "dummy", "RD-")
+		comment := utils.FormatComment("test", "dummy")
+		Expect(chains[iptables.ProtocolIPv4]).To(Equal(utils.Chain{
+			Table:       "nat",
+			Name:        name,
+			EntryChains: []string{"PREROUTING"},
+			EntryRules: [][]string{
+				{"-s", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+			},
+			Rules: [][]string{
+				{"-d", "169.254.169.254/32", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "10.0.0.1:8181"},
+				{"-p", "tcp", "--dport", "53", "-j", "DNAT", "--to-destination", "10.0.0.1:53"},
+				{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "10.0.0.1:53"},
+			},
+		}))
+		Expect(chains[iptables.ProtocolIPv6].EntryRules).To(Equal([][]string{
+			{"-s", "2001:db8::2/128", "-m", "comment", "--comment", comment},
+		}))
+		Expect(chains[iptables.ProtocolIPv6].Rules).To(Equal([][]string{
+			{"-p", "tcp", "--dport", "53", "-j", "DNAT", "--to-destination", "[2001:db8::1]:53"},
+			{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "[2001:db8::1]:53"},
+		}))
+	})
+
+	It("redirects all traffic to a destination without a port", func() {
+		r := Redirect{Destination: net.ParseIP("192.0.2.1"), ToIP: net.ParseIP("10.0.0.1")}
+		ch := genRedirectChain("test", "dummy", []Redirect{r}, nil)
+		Expect(ch.Rules).To(Equal([][]string{
+			{"-d", "192.0.2.1/32", "-j", "DNAT", "--to-destination", "10.0.0.1"},
+		}))
+	})
+})
+
+var _ = Describe("redirect plugin", func() {
+	var originalNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("installs the rules with ADD, checks them with CHECK and removes them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   []byte(redirectConf),
+		}
+		redirectChain := genRedirectChain("test", "dummy", nil, nil).Name
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			rules, err := ipt.List("nat", "PREROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1]).To(ContainSubstring("10.0.0.2/32"))
+			Expect(rules[1]).To(HaveSuffix("-j " + redirectChain))
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Drop the DNAT rules
+			err = ipt.ClearChain("nat", redirectChain)
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf("chain %q", redirectChain)))
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "nat", redirectChain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,276 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that edits the routes of the container
+// interface after the main plugin has set them up: it may flush them,
+// remove the default route, or delete and add specific routes. The
+// returned result is updated to match.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// RouteOverride lists the changes to make to the routes of the interface.
+type RouteOverride struct {
+	// FlushRoutes deletes all routes of the interface, except those the
+	// kernel added for its addresses
+	FlushRoutes bool `json:"flushroutes,omitempty"`
+	// FlushGateway deletes the default routes of the interface
+	FlushGateway bool           `json:"flushgateway,omitempty"`
+	DelRoutes    []*types.Route `json:"delroutes,omitempty"`
+	AddRoutes    []*types.Route `json:"addroutes,omitempty"`
+}
+
+// PluginConf represents the route-override plugin configuration.
+type PluginConf struct {
+	types.NetConf
+	RouteOverride
+
+	RuntimeConfig struct {
+		RouteOverride *RouteOverride `json:"routeOverride,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from
+// stdin, and merges the runtime config into the static one.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	if rc := conf.RuntimeConfig.RouteOverride; rc != nil {
+		conf.FlushRoutes = conf.FlushRoutes || rc.FlushRoutes
+		conf.FlushGateway = conf.FlushGateway || rc.FlushGateway
+		conf.DelRoutes = append(conf.DelRoutes, rc.DelRoutes...)
+		conf.AddRoutes = append(conf.AddRoutes, rc.AddRoutes...)
+	}
+
+	return &conf, nil
+}
+
+// routeDst returns the destination of the route. Default routes are
+// reported with a nil destination, so their family is taken from the
+// gateway.
+func routeDst(route *netlink.Route) *net.IPNet {
+	if route.Dst != nil {
+		return route.Dst
+	}
+	if route.Gw != nil && route.Gw.To4() == nil {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+}
+
+func isDefault(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+func sameDst(dst *net.IPNet, route *types.Route) bool {
+	return dst.String() == route.Dst.String()
+}
+
+// deleteRoute reports whether route is removed by the override.
+func (ro *RouteOverride) deleteRoute(dst *net.IPNet) bool {
+	if ro.FlushRoutes {
+		return true
+	}
+	if ro.FlushGateway && isDefault(dst) {
+		return true
+	}
+	for _, del := range ro.DelRoutes {
+		if sameDst(dst, del) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRoutes changes the routes of the interface in the current namespace.
+func applyRoutes(ro *RouteOverride, iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find %q: %v", iface, err)
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", iface, err)
+	}
+	for _, route := range routes {
+		// Keep the routes the kernel manages for the addresses
+		if route.Protocol == syscall.RTPROT_KERNEL {
+			continue
+		}
+		if !ro.deleteRoute(routeDst(&route)) {
+			continue
+		}
+		if err := netlink.RouteDel(&route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route %v: %v", route, err)
+		}
+	}
+
+	for _, route := range ro.AddRoutes {
+		r := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &route.Dst,
+			Gw:        route.GW,
+		}
+		if err := netlink.RouteAdd(r); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route %v: %v", r, err)
+		}
+	}
+
+	return nil
+}
+
+// updateResult makes the routes of the result match the override.
+func updateResult(ro *RouteOverride, result *current.Result) {
+	routes := []*types.Route{}
+	for _, route := range result.Routes {
+		if !ro.deleteRoute(&route.Dst) {
+			routes = append(routes, route)
+		}
+	}
+	result.Routes = append(routes, ro.AddRoutes...)
+
+	if ro.FlushRoutes || ro.FlushGateway {
+		for _, ipc := range result.IPs {
+			ipc.Gateway = nil
+		}
+	}
+}
+
+// checkRoutes verifies that the routes of the result exist, and that the
+// deleted ones do not.
+func checkRoutes(ro *RouteOverride, iface string, result *current.Result) error {
+	if err := ip.ValidateExpectedRoute(result.Routes); err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", iface), "failed to find %q: %v", iface, err)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", iface, err)
+	}
+	for _, route := range routes {
+		if route.Protocol == syscall.RTPROT_KERNEL {
+			continue
+		}
+		dst := routeDst(&route)
+		if !ro.deleteRoute(dst) {
+			continue
+		}
+		added := false
+		for _, add := range ro.AddRoutes {
+			if sameDst(dst, add) {
+				added = true
+				break
+			}
+		}
+		if !added {
+			return utils.NewCheckError(fmt.Sprintf("route %q", dst.String()), "route %s via %v should have been deleted", dst, route.Gw)
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return applyRoutes(&conf.RouteOverride, args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
+	updateResult(&conf.RouteOverride, conf.PrevResult)
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+// cmdDel has nothing to undo: the routes go away with the interface.
+func cmdDel(args *skel.CmdArgs) error {
+	_, err := parseConfig(args.StdinData)
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return checkRoutes(&conf.RouteOverride, args.IfName, conf.PrevResult)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI route-override plugin")
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prevResult = `{
+	"interfaces": [
+		{"name": "net1", "sandbox": "netns"}
+	],
+	"ips": [
+		{
+			"version": "4",
+			"address": "10.1.2.3/24",
+			"gateway": "10.1.2.1",
+			"interface": 0
+		}
+	],
+	"routes": [
+		{"dst": "0.0.0.0/0", "gw": "10.1.2.1"},
+		{"dst": "10.20.0.0/16", "gw": "10.1.2.1"},
+		{"dst": "10.30.0.0/16", "gw": "10.1.2.1"}
+	]
+}`
+
+func makeConf(override string) []byte {
+	return []byte(fmt.Sprintf(`{
+	"name": "storage",
+	"type": "route-override",
+	"cniVersion": "0.4.0",
+	%s,
+	"prevResult": %s
+}`, override, prevResult))
+}
+
+func dsts(routes []*types.Route) []string {
+	s := []string{}
+	for _, route := range routes {
+		s = append(s, route.Dst.String())
+	}
+	return s
+}
+
+var _ = Describe("route-override configuration", func() {
+	It("merges the runtime config into the static one", func() {
+		conf, err := parseConfig(makeConf(`
+	"delroutes": [{"dst": "10.20.0.0/16"}],
+	"runtimeConfig": {
+		"routeOverride": {
+			"flushgateway": true,
+			"delroutes": [{"dst": "10.30.0.0/16"}],
+			"addroutes": [{"dst": "192.168.0.0/24", "gw": "10.1.2.254"}]
+		}
+	}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.FlushRoutes).To(BeFalse())
+		Expect(conf.FlushGateway).To(BeTrue())
+		Expect(dsts(conf.DelRoutes)).To(Equal([]string{"10.20.0.0/16", "10.30.0.0/16"}))
+		Expect(dsts(conf.AddRoutes)).To(Equal([]string{"192.168.0.0/24"}))
+	})
+
+	It("updates the result with the deleted and added routes", func() {
+		conf, err := parseConfig(makeConf(`
+	"flushgateway": true,
+	"delroutes": [{"dst": "10.20.0.0/16"}],
+	"addroutes": [{"dst": "192.168.0.0/24", "gw": "10.1.2.254"}]`))
+		Expect(err).NotTo(HaveOccurred())
+
+		updateResult(&conf.RouteOverride, conf.PrevResult)
+		Expect(dsts(conf.PrevResult.Routes)).To(Equal([]string{"10.30.0.0/16", "192.168.0.0/24"}))
+		Expect(conf.PrevResult.IPs[0].Gateway).To(BeNil())
+	})
+
+	It("drops all routes of the result with flushroutes", func() {
+		conf, err := parseConfig(makeConf(`"flushroutes": true`))
+		Expect(err).NotTo(HaveOccurred())
+
+		updateResult(&conf.RouteOverride, conf.PrevResult)
+		Expect(conf.PrevResult.Routes).To(BeEmpty())
+	})
+
+	It("tells default routes of different families apart", func() {
+		ro := &RouteOverride{DelRoutes: []*types.Route{{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}}}
+		Expect(ro.deleteRoute(routeDst(&netlink.Route{Gw: net.ParseIP("10.1.2.1")}))).To(BeTrue())
+		Expect(ro.deleteRoute(routeDst(&netlink.Route{Gw: net.ParseIP("2001:db8::1")}))).To(BeFalse())
+	})
+})
+
+var _ = Describe("route-override plugin", func() {
+	var targetNs ns.NetNS
+	const IFNAME string = "net1"
+
+	BeforeEach(func() {
+		var err error
+		targetNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			addr, err := netlink.ParseAddr("10.1.2.3/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+
+			for _, dst := range []string{"0.0.0.0/0", "10.20.0.0/16", "10.30.0.0/16"} {
+				_, ipn, _ := net.ParseCIDR(dst)
+				Expect(netlink.RouteAdd(&netlink.Route{
+					LinkIndex: link.Attrs().Index,
+					Dst:       ipn,
+					Gw:        net.ParseIP("10.1.2.1"),
+				})).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(targetNs.Close()).To(Succeed())
+	})
+
+	It("edits the routes with ADD and checks them with CHECK", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData: makeConf(`
+	"flushgateway": true,
+	"delroutes": [{"dst": "10.20.0.0/16"}],
+	"addroutes": [{"dst": "192.168.0.0/24", "gw": "10.1.2.254"}]`),
+		}
+
+		r, _, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, args.StdinData, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := current.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dsts(result.Routes)).To(Equal([]string{"10.30.0.0/16", "192.168.0.0/24"}))
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			found := []string{}
+			for _, route := range routes {
+				found = append(found, routeDst(&route).String())
+			}
+			Expect(found).To(ConsistOf("10.1.2.0/24", "10.30.0.0/16", "192.168.0.0/24"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// CHECK is passed the final result as prevResult
+		resultJSON, err := json.Marshal(result)
+		Expect(err).NotTo(HaveOccurred())
+		checkArgs := *args
+		checkArgs.StdinData = []byte(strings.Replace(string(args.StdinData), prevResult, string(resultJSON), 1))
+
+		err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdCheck(&checkArgs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,464 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that sets up source based routing for an
+// interface, so that traffic from its addresses leaves through it rather
+// than through the default route of another interface.
+//
+// It moves the routes of the interface into a table of their own, adds a
+// default route through the gateway of each address if the interface had
+// none, and adds a rule "from <addr> lookup <table>" for each address.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// firstTableID is the first routing table the plugin considers; lower
+// IDs are left for the administrator.
+const firstTableID = 100
+
+// addedRouteProtocol marks the default routes the plugin adds itself, so
+// that DEL deletes them rather than moving them to the main table.
+const addedRouteProtocol = syscall.RTPROT_STATIC
+
+// PluginConf represents the sbr plugin configuration.
+type PluginConf struct {
+	types.NetConf
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	return &conf, nil
+}
+
+// getIPCfgs returns the IP configurations of the named container interface.
+func getIPCfgs(iface string, prevResult *current.Result) ([]*current.IPConfig, error) {
+	var ipCfgs []*current.IPConfig
+
+	for _, ipCfg := range prevResult.IPs {
+		if ipCfg.Interface == nil {
+			continue
+		}
+		intIdx := *ipCfg.Interface
+		if intIdx < 0 || intIdx >= len(prevResult.Interfaces) {
+			continue
+		}
+		if prevResult.Interfaces[intIdx].Name == iface && prevResult.Interfaces[intIdx].Sandbox != "" {
+			ipCfgs = append(ipCfgs, ipCfg)
+		}
+	}
+
+	if len(ipCfgs) == 0 {
+		return nil, fmt.Errorf("no IPs found for interface %q in prevResult", iface)
+	}
+	return ipCfgs, nil
+}
+
+func hostMask(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func isDefaultRoute(route *netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// findFreeTable returns the first table ID, from firstTableID on, that is
+// neither referenced by a rule nor holds any route.
+func findFreeTable() (int, error) {
+	used := map[int]bool{}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, rule := range rules {
+		used[rule.Table] = true
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: syscall.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		used[route.Table] = true
+	}
+
+	for table := firstTableID; table < syscall.RT_TABLE_COMPAT; table++ {
+		if !used[table] {
+			return table, nil
+		}
+	}
+	return 0, fmt.Errorf("no free routing table")
+}
+
+// findTable returns the table that the rules of a previous ADD point the
+// addresses at, so that a repeated ADD updates it rather than a new one.
+func findTable(ipCfgs []*current.IPConfig, rules []netlink.Rule) (int, bool) {
+	for _, rule := range rules {
+		if rule.Src == nil {
+			continue
+		}
+		for _, ipCfg := range ipCfgs {
+			if rule.Src.String() == hostMask(ipCfg.Address.IP).String() {
+				return rule.Table, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// doRoutes moves the routes of the interface into a table of their own and
+// adds a rule per address pointing at it. Whatever a previous ADD already
+// set up is kept, and a failure undoes the changes of this one.
+func doRoutes(ipCfgs []*current.IPConfig, iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find %q: %v", iface, err)
+	}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	table, ok := findTable(ipCfgs, rules)
+	if !ok {
+		if table, err = findFreeTable(); err != nil {
+			return err
+		}
+	}
+
+	var undo rollback.Stack
+	defer undo.RollbackAndLog()
+
+	hasDefault := map[int]bool{}
+	tableRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+		&netlink.Route{Table: table, LinkIndex: link.Attrs().Index},
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return fmt.Errorf("failed to list routes in table %d: %v", table, err)
+	}
+	for _, route := range tableRoutes {
+		if isDefaultRoute(&route) && route.Gw != nil {
+			hasDefault[ipFamily(route.Gw)] = true
+		}
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", iface, err)
+	}
+
+	for _, route := range routes {
+		// Link-local traffic has no source address of ours
+		if route.Dst != nil && route.Dst.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		route := route
+		newRoute := route
+		newRoute.Table = table
+		switch err := netlink.RouteAdd(&newRoute); err {
+		case nil:
+			undo.Push(fmt.Sprintf("delete route %v from table %d", route, table), func() error {
+				return netlink.RouteDel(&newRoute)
+			})
+		case syscall.EEXIST:
+		default:
+			return fmt.Errorf("failed to add route %v to table %d: %v", route, table, err)
+		}
+		if err := netlink.RouteDel(&route); err != nil {
+			return fmt.Errorf("failed to delete route %v from the main table: %v", route, err)
+		}
+		undo.Push(fmt.Sprintf("restore route %v to the main table", route), func() error {
+			return netlink.RouteAdd(&route)
+		})
+		if isDefaultRoute(&route) && route.Gw != nil {
+			hasDefault[ipFamily(route.Gw)] = true
+		}
+	}
+
+	for _, ipCfg := range ipCfgs {
+		family := ipFamily(ipCfg.Address.IP)
+		if ipCfg.Gateway != nil && !hasDefault[family] {
+			route := &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Gw:        ipCfg.Gateway,
+				Table:     table,
+				Protocol:  addedRouteProtocol,
+			}
+			if err := netlink.RouteAdd(route); err != nil {
+				return fmt.Errorf("failed to add default route via %s to table %d: %v", ipCfg.Gateway, table, err)
+			}
+			undo.Push(fmt.Sprintf("delete default route via %s from table %d", ipCfg.Gateway, table), func() error {
+				return netlink.RouteDel(route)
+			})
+			hasDefault[family] = true
+		}
+
+		src := hostMask(ipCfg.Address.IP)
+		if hasRule(rules, src, table) {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Table = table
+		rule.Src = src
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add rule from %s: %v", rule.Src, err)
+		}
+		undo.Push(fmt.Sprintf("delete rule from %s", rule.Src), func() error {
+			return netlink.RuleDel(rule)
+		})
+	}
+
+	undo.Commit()
+	return nil
+}
+
+// hasRule reports whether rules point traffic from src at table.
+func hasRule(rules []netlink.Rule, src *net.IPNet, table int) bool {
+	for _, rule := range rules {
+		if rule.Table == table && rule.Src != nil && rule.Src.String() == src.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// tidyRules deletes the rules for the addresses of the interface and moves
+// the routes in their tables back to the main table.
+func tidyRules(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		// The interface is gone, and its routes with it
+		return nil
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", iface, err)
+	}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+
+	tables := map[int]bool{}
+	for _, rule := range rules {
+		if rule.Src == nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if rule.Src.String() != hostMask(addr.IP).String() {
+				continue
+			}
+			if err := netlink.RuleDel(&rule); err != nil {
+				return fmt.Errorf("failed to delete rule from %s: %v", rule.Src, err)
+			}
+			tables[rule.Table] = true
+			break
+		}
+	}
+
+	for table := range tables {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+			&netlink.Route{Table: table, LinkIndex: link.Attrs().Index},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+		if err != nil {
+			return fmt.Errorf("failed to list routes in table %d: %v", table, err)
+		}
+		for _, route := range routes {
+			if err := netlink.RouteDel(&route); err != nil {
+				return fmt.Errorf("failed to delete route %v from table %d: %v", route, table, err)
+			}
+			if route.Protocol == addedRouteProtocol {
+				continue
+			}
+			route.Table = syscall.RT_TABLE_MAIN
+			if err := netlink.RouteAdd(&route); err != nil && err != syscall.EEXIST {
+				return fmt.Errorf("failed to restore route %v to the main table: %v", route, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRules verifies that every address has a rule pointing at a table
+// that holds routes through the interface.
+func checkRules(ipCfgs []*current.IPConfig, iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", iface), "failed to find %q: %v", iface, err)
+	}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+
+	for _, ipCfg := range ipCfgs {
+		src := hostMask(ipCfg.Address.IP)
+		resource := fmt.Sprintf("rule \"from %s\"", src)
+
+		table := -1
+		for _, rule := range rules {
+			if rule.Src != nil && rule.Src.String() == src.String() {
+				table = rule.Table
+				break
+			}
+		}
+		if table == -1 {
+			return utils.NewCheckError(resource, "no rule for traffic from %s", src)
+		}
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+			&netlink.Route{Table: table, LinkIndex: link.Attrs().Index},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+		if err != nil {
+			return fmt.Errorf("failed to list routes in table %d: %v", table, err)
+		}
+		if len(routes) == 0 {
+			return utils.NewCheckError(resource, "table %d has no routes through %q", table, iface)
+		}
+	}
+
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	ipCfgs, err := getIPCfgs(args.IfName, conf.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return doRoutes(ipCfgs, args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	if _, err := parseConfig(args.StdinData); err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// Per spec, DEL must not fail if the namespace is already gone
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return tidyRules(args.IfName)
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	ipCfgs, err := getIPCfgs(args.IfName, conf.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return checkRules(ipCfgs, args.IfName)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI source based routing plugin")
+}
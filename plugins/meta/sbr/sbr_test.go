@@ -0,0 +1,255 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const sbrConf = `{
+	"name": "storage",
+	"type": "sbr",
+	"cniVersion": "0.4.0",
+	"prevResult": {
+		"interfaces": [
+			{"name": "net1", "sandbox": "netns"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "192.168.1.209/24",
+				"gateway": "192.168.1.1",
+				"interface": 0
+			}
+		]
+	}
+}`
+
+var _ = Describe("sbr configuration", func() {
+	It("finds the IPs of the interface", func() {
+		conf, err := parseConfig([]byte(sbrConf))
+		Expect(err).NotTo(HaveOccurred())
+
+		ipCfgs, err := getIPCfgs("net1", conf.PrevResult)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipCfgs).To(HaveLen(1))
+		Expect(ipCfgs[0].Address.String()).To(Equal("192.168.1.209/24"))
+
+		_, err = getIPCfgs("eth0", conf.PrevResult)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("sbr plugin", func() {
+	var targetNs ns.NetNS
+	const IFNAME string = "net1"
+
+	BeforeEach(func() {
+		var err error
+		targetNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			addr, err := netlink.ParseAddr("192.168.1.209/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+
+			_, dst, _ := net.ParseCIDR("10.10.0.0/16")
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("192.168.1.254"),
+			})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(targetNs.Close()).To(Succeed())
+	})
+
+	// routesOf returns the destinations of the routes through IFNAME in
+	// the given table.
+	routesOf := func(table int) []string {
+		link, err := netlink.LinkByName(IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: table, LinkIndex: link.Attrs().Index},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+		Expect(err).NotTo(HaveOccurred())
+		dsts := []string{}
+		for _, route := range routes {
+			if route.Dst == nil {
+				dsts = append(dsts, "default")
+			} else {
+				dsts = append(dsts, route.Dst.String())
+			}
+		}
+		return dsts
+	}
+
+	It("moves the routes to their own table with ADD, checks them with CHECK and restores them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(sbrConf),
+		}
+
+		_, _, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, args.StdinData, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(routesOf(syscall.RT_TABLE_MAIN)).To(BeEmpty())
+			Expect(routesOf(firstTableID)).To(ConsistOf("192.168.1.0/24", "10.10.0.0/16", "default"))
+
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, rule := range rules {
+				if rule.Src != nil && rule.Src.String() == "192.168.1.209/32" {
+					Expect(rule.Table).To(Equal(firstTableID))
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// The added default route is gone, the others are back
+			Expect(routesOf(firstTableID)).To(BeEmpty())
+			Expect(routesOf(syscall.RT_TABLE_MAIN)).To(ConsistOf("192.168.1.0/24", "10.10.0.0/16"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Details).To(Equal(`rule "from 192.168.1.209/32"`))
+	})
+
+	It("reuses the table and rules of a previous ADD", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(sbrConf),
+		}
+
+		for i := 0; i < 2; i++ {
+			_, _, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(routesOf(firstTableID)).To(ConsistOf("192.168.1.0/24", "10.10.0.0/16", "default"))
+			Expect(routesOf(firstTableID + 1)).To(BeEmpty())
+
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			count := 0
+			for _, rule := range rules {
+				if rule.Src != nil && rule.Src.String() == "192.168.1.209/32" {
+					Expect(rule.Table).To(Equal(firstTableID))
+					count++
+				}
+			}
+			Expect(count).To(Equal(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("undoes a failed ADD", func() {
+		// The gateway is not on-link, so the default route cannot be added
+		// once the routes have been moved
+		conf := strings.Replace(sbrConf, `"gateway": "192.168.1.1"`, `"gateway": "10.99.0.1"`, 1)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		_, _, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, args.StdinData, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(routesOf(firstTableID)).To(BeEmpty())
+			Expect(routesOf(syscall.RT_TABLE_MAIN)).To(ConsistOf("192.168.1.0/24", "10.10.0.0/16"))
+
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			for _, rule := range rules {
+				Expect(rule.Src).To(BeNil())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
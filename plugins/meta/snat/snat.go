@@ -0,0 +1,229 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that source NATs the traffic of the
+// container to a fixed host address, so that external firewalls can tell
+// workloads apart by their egress address.
+//
+// It is intended to be used as a chained CNI plugin, and determines the
+// container IPs from the previous result. Each container gets its own
+// chain in the nat table, jumped to from POSTROUTING for each container IP,
+// so that DEL can remove it in one go.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// SNATEntry is the address to translate to, and optionally the
+// destinations to translate the traffic to.
+type SNATEntry struct {
+	SNATIP       net.IP        `json:"snatIP"`
+	Destinations []types.IPNet `json:"destinations,omitempty"` // All destinations if empty
+}
+
+// SNATNetConf represents the snat plugin configuration.
+type SNATNetConf struct {
+	types.NetConf
+
+	RuntimeConfig struct {
+		SNAT *SNATEntry `json:"snat,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	*SNATEntry
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+}
+
+func parseConf(data []byte, ifName string) (*SNATNetConf, []net.IP, error) {
+	conf := SNATNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// The runtime config overrides the static config
+	if conf.RuntimeConfig.SNAT != nil {
+		conf.SNATEntry = conf.RuntimeConfig.SNAT
+	}
+	if conf.SNATEntry != nil {
+		if conf.SNATIP == nil {
+			return nil, nil, fmt.Errorf("snatIP must be specified")
+		}
+		for _, dst := range conf.Destinations {
+			if (dst.IP.To4() != nil) != (conf.SNATIP.To4() != nil) {
+				return nil, nil, fmt.Errorf("destination %s is not in the same family as %s", (*net.IPNet)(&dst), conf.SNATIP)
+			}
+		}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	// The previous result may leave its version to the configuration
+	if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+		conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+	}
+	resultBytes, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	res, err := version.NewResult(conf.CNIVersion, resultBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	conf.RawPrevResult = nil
+	conf.PrevResult, err = current.NewResultFromResult(res)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	var containerIPs []net.IP
+	for _, ip := range utils.ContainerIPs(conf.PrevResult, ifName) {
+		// Only the family of the SNAT address can be translated
+		if conf.SNATEntry != nil && (ip.To4() != nil) != (conf.SNATIP.To4() != nil) {
+			continue
+		}
+		containerIPs = append(containerIPs, ip)
+	}
+
+	return &conf, containerIPs, nil
+}
+
+// genSNATChain creates the per-container chain. The plain FormatChainName
+// is used by ip masquerading for the same container, and portmap still
+// deletes its legacy "SN-" chain on DEL, so the chain uses "SNAT-".
+func genSNATChain(netName, containerID string, entry *SNATEntry, ips []net.IP) utils.Chain {
+	c := utils.Chain{
+		Table:       "nat",
+		Name:        utils.FormatChainNameWithPrefix(netName, containerID, "SNAT-"),
+		EntryChains: []string{"POSTROUTING"},
+	}
+	if entry == nil {
+		return c
+	}
+
+	comment := utils.FormatComment(netName, containerID)
+	for _, ip := range ips {
+		c.EntryRules = append(c.EntryRules,
+			[]string{"-s", utils.HostCIDR(ip), "-m", "comment", "--comment", comment})
+	}
+
+	if len(entry.Destinations) == 0 {
+		c.Rules = append(c.Rules, []string{"-j", "SNAT", "--to-source", entry.SNATIP.String()})
+	}
+	for _, dst := range entry.Destinations {
+		c.Rules = append(c.Rules,
+			[]string{"-d", (*net.IPNet)(&dst).String(), "-j", "SNAT", "--to-source", entry.SNATIP.String()})
+	}
+	return c
+}
+
+func protocolOf(ip net.IP) iptables.Protocol {
+	if ip.To4() != nil {
+		return iptables.ProtocolIPv4
+	}
+	return iptables.ProtocolIPv6
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.SNATEntry != nil {
+		if len(containerIPs) == 0 {
+			return fmt.Errorf("no container IP in the family of %s", conf.SNATIP)
+		}
+
+		ipt, err := iptables.NewWithProtocol(protocolOf(conf.SNATIP))
+		if err != nil {
+			return fmt.Errorf("failed to open iptables: %v", err)
+		}
+
+		snatChain := genSNATChain(conf.Name, args.ContainerID, conf.SNATEntry, containerIPs)
+		if err := snatChain.Setup(ipt); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", snatChain.Name, err)
+		}
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// The container chain is found by name, so we don't need the IPs;
+	// deletion is idempotent
+	snatChain := genSNATChain(conf.Name, args.ContainerID, nil, nil)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			// Swallow the error - this protocol is not usable, so we
+			// cannot have added anything
+			continue
+		}
+		if err := snatChain.Teardown(ipt); err != nil {
+			return fmt.Errorf("failed to teardown chain %s: %v", snatChain.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, containerIPs, err := parseConf(args.StdinData, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.SNATEntry == nil {
+		return nil
+	}
+
+	ipt, err := iptables.NewWithProtocol(protocolOf(conf.SNATIP))
+	if err != nil {
+		return fmt.Errorf("failed to open iptables: %v", err)
+	}
+
+	snatChain := genSNATChain(conf.Name, args.ContainerID, conf.SNATEntry, containerIPs)
+	return snatChain.Check(ipt)
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI snat plugin")
+}
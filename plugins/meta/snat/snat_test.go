@@ -0,0 +1,212 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prevResult = `{
+		"interfaces": [
+			{"name": "cni0"},
+			{"name": "eth0", "sandbox": "/var/run/netns/test"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 1
+			},
+			{
+				"version": "6",
+				"address": "2001:db8::2/64",
+				"interface": 1
+			},
+			{
+				"version": "4",
+				"address": "10.0.0.1/24",
+				"interface": 0
+			}
+		]
+	}`
+
+var snatConf = fmt.Sprintf(`{
+	"name": "test",
+	"type": "snat",
+	"cniVersion": "0.4.0",
+	"snatIP": "192.0.2.10",
+	"destinations": ["198.51.100.0/24"],
+	"prevResult": %s
+}`, prevResult)
+
+var _ = Describe("snat configuration", func() {
+	It("finds the container IPs in the family of the SNAT address", func() {
+		conf, ips, err := parseConf([]byte(snatConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.SNATIP).To(Equal(net.ParseIP("192.0.2.10")))
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+	})
+
+	It("uses the runtime config if there is no static one", func() {
+		conf, ips, err := parseConf([]byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "snat",
+	"cniVersion": "0.4.0",
+	"runtimeConfig": {
+		"snat": {"snatIP": "2001:db8:1::10"}
+	},
+	"prevResult": %s
+}`, prevResult)), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.SNATIP).To(Equal(net.ParseIP("2001:db8:1::10")))
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("2001:db8::2")}))
+	})
+
+	It("prefers the runtime config to the static config", func() {
+		conf, _, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "snat",
+	"snatIP": "192.0.2.10",
+	"destinations": ["198.51.100.0/24"],
+	"runtimeConfig": {
+		"snat": {"snatIP": "192.0.2.20"}
+	}
+}`), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.SNATIP).To(Equal(net.ParseIP("192.0.2.20")))
+		Expect(conf.Destinations).To(BeEmpty())
+	})
+
+	It("rejects a destination of another family", func() {
+		_, _, err := parseConf([]byte(`{
+	"name": "test",
+	"type": "snat",
+	"snatIP": "192.0.2.10",
+	"destinations": ["2001:db8:2::/64"]
+}`), "eth0")
+		Expect(err).To(MatchError("destination 2001:db8:2::/64 is not in the same family as 192.0.2.10"))
+	})
+
+	It("generates a correct container chain", func() {
+		conf, ips, err := parseConf([]byte(snatConf), "eth0")
+		Expect(err).NotTo(HaveOccurred())
+
+		ch := genSNATChain("test", "dummy", conf.SNATEntry, ips)
+		comment := utils.FormatComment("test", "dummy")
+		Expect(ch).To(Equal(utils.Chain{
+			Table:       "nat",
+			Name:        utils.FormatChainNameWithPrefix("test", "dummy", "SNAT-"),
+			EntryChains: []string{"POSTROUTING"},
+			EntryRules: [][]string{
+				{"-s", "10.0.0.2/32", "-m", "comment", "--comment", comment},
+			},
+			Rules: [][]string{
+				{"-d", "198.51.100.0/24", "-j", "SNAT", "--to-source", "192.0.2.10"},
+			},
+		}))
+		Expect(ch.Name).NotTo(Equal(utils.FormatChainName("test", "dummy")))
+		// portmap deletes its legacy SNAT chain of the container on DEL
+		Expect(ch.Name).NotTo(Equal(utils.FormatChainNameWithPrefix("test", "dummy", "SN-")))
+	})
+})
+
+var _ = Describe("snat plugin", func() {
+	var originalNS ns.NetNS
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("installs the rules with ADD, checks them with CHECK and removes them with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      IFNAME,
+			StdinData:   []byte(snatConf),
+		}
+		snatChain := genSNATChain("test", "dummy", nil, nil).Name
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithResult(args.Netns, IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			rules, err := ipt.List("nat", "POSTROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1]).To(ContainSubstring("10.0.0.2/32"))
+			Expect(rules[1]).To(HaveSuffix("-j " + snatChain))
+
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Drop the SNAT rule
+			err = ipt.ClearChain("nat", snatChain)
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdCheckWithResult(args.Netns, IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf("chain %q", snatChain)))
+
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "nat", snatChain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
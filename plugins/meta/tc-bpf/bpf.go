@@ -0,0 +1,176 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// The bpf commands, program types and flags used by the plugin, from
+// linux/bpf.h.
+const (
+	bpfMapCreate = 0
+	bpfProgLoad  = 5
+	bpfObjPin    = 6
+	bpfObjGet    = 7
+
+	bpfProgTypeSchedCls = 3
+
+	bpfPseudoMapFD = 1
+)
+
+// verifierLogSize is the size of the buffer for the log of the verifier,
+// which is only requested when a program is rejected.
+const verifierLogSize = 1 << 16
+
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+// The buffers of the attributes are held as pointers rather than as
+// addresses, so that the garbage collector sees them in use and they move
+// to the heap, where they stay in place during the system call.
+type progLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       bpfPointer
+	license     bpfPointer
+	logLevel    uint32
+	logSize     uint32
+	logBuf      bpfPointer
+	kernVersion uint32
+	_           uint32
+}
+
+type objAttr struct {
+	pathname bpfPointer
+	fd       uint32
+	_        uint32
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func createMap(def *mapDef) (int, error) {
+	attr := mapCreateAttr{
+		mapType:    def.Type,
+		keySize:    def.KeySize,
+		valueSize:  def.ValueSize,
+		maxEntries: def.MaxEntries,
+		flags:      def.Flags,
+	}
+	return bpfCall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// loadProgram loads a classifier. If the verifier rejects it, the error
+// includes its log.
+func loadProgram(insns []byte, license string) (int, error) {
+	lic := append([]byte(license), 0)
+	attr := progLoadAttr{
+		progType: bpfProgTypeSchedCls,
+		insnCnt:  uint32(len(insns) / insnSize),
+		insns:    bpfPointer{ptr: unsafe.Pointer(&insns[0])},
+		license:  bpfPointer{ptr: unsafe.Pointer(&lic[0])},
+	}
+	fd, err := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+
+	log := make([]byte, verifierLogSize)
+	attr.logLevel = 1
+	attr.logSize = uint32(len(log))
+	attr.logBuf = bpfPointer{ptr: unsafe.Pointer(&log[0])}
+	fd, logErr := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if logErr == nil {
+		// Loading succeeded the second time around
+		return fd, nil
+	}
+	if n := cString(log); n != "" {
+		return -1, fmt.Errorf("%v: %s", err, n)
+	}
+	return -1, err
+}
+
+func pinObject(fd int, path string) error {
+	p := append([]byte(path), 0)
+	attr := objAttr{
+		pathname: bpfPointer{ptr: unsafe.Pointer(&p[0])},
+		fd:       uint32(fd),
+	}
+	_, err := bpfCall(bpfObjPin, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func getPinnedObject(path string) (int, error) {
+	p := append([]byte(path), 0)
+	attr := objAttr{
+		pathname: bpfPointer{ptr: unsafe.Pointer(&p[0])},
+	}
+	return bpfCall(bpfObjGet, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// openMap returns the map pinned in the directory, or else creates and
+// pins it, so that repeated ADDs share the maps of the container.
+func openMap(pinDir string, m *mapSpec) (int, error) {
+	path := filepath.Join(pinDir, m.Name)
+	fd, err := getPinnedObject(path)
+	if err == nil {
+		return fd, nil
+	}
+	if err != syscall.ENOENT {
+		return -1, fmt.Errorf("failed to open pinned map %s: %v", path, err)
+	}
+
+	fd, err = createMap(&m.Def)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create map %s: %v", m.Name, err)
+	}
+	if err := pinObject(fd, path); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to pin map %s at %s: %v", m.Name, path, err)
+	}
+	return fd, nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// ensurePinDir creates the pin directory of the container.
+func ensurePinDir(pinDir string) error {
+	if err := os.MkdirAll(pinDir, 0700); err != nil {
+		return fmt.Errorf("failed to create pin directory: %v", err)
+	}
+	return nil
+}
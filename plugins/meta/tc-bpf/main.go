@@ -0,0 +1,414 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that attaches the BPF programs of a
+// workload to the tc hooks of its interface. The programs are loaded from
+// an object file, and are attached as direct-action classifiers to the
+// clsact qdisc of the host end of the veth, or of the container interface.
+//
+// The maps of the object are pinned in a directory per container, so that
+// tools can read them, and are removed on DEL.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+const defaultPinPath = "/sys/fs/bpf/cni"
+
+// filterPrefix starts the names of the tc filters of the plugin.
+const filterPrefix = "cni:"
+
+// The hooks of the interface the programs are attached to.
+const (
+	HookIngress = "ingress"
+	HookEgress  = "egress"
+)
+
+// Program is a program of the object and the hook to attach it to.
+type Program struct {
+	Name string `json:"name"` // The section or function name
+	Hook string `json:"hook"` // ingress or egress
+}
+
+// BPFEntry describes the object and the programs to attach.
+type BPFEntry struct {
+	Object   string    `json:"object"`
+	Programs []Program `json:"programs"`
+	Side     string    `json:"side,omitempty"` // host or container; host if unset
+}
+
+// PluginConf represents the tc-bpf plugin configuration.
+type PluginConf struct {
+	types.NetConf
+
+	// PinPath is a directory on a bpf filesystem
+	PinPath string `json:"pinPath,omitempty"`
+
+	RuntimeConfig struct {
+		TCBPF *BPFEntry `json:"tcBPF,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+
+	// The programs to attach to every container of the network; a
+	// tcBPF capability of the runtime picks others for this container
+	*BPFEntry
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from stdin.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	if conf.RuntimeConfig.TCBPF != nil {
+		conf.BPFEntry = conf.RuntimeConfig.TCBPF
+	}
+	if conf.BPFEntry != nil {
+		if err := validateEntry(conf.BPFEntry); err != nil {
+			return nil, err
+		}
+	}
+	if conf.PinPath == "" {
+		conf.PinPath = defaultPinPath
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	return &conf, nil
+}
+
+func validateEntry(entry *BPFEntry) error {
+	if entry.Object == "" {
+		return fmt.Errorf("object must be specified")
+	}
+	if len(entry.Programs) == 0 {
+		return fmt.Errorf("at least one program must be specified")
+	}
+	for i, p := range entry.Programs {
+		if p.Name == "" {
+			return fmt.Errorf("program %d: name must be specified", i)
+		}
+		if p.Hook != HookIngress && p.Hook != HookEgress {
+			return fmt.Errorf("program %s: hook must be %q or %q", p.Name, HookIngress, HookEgress)
+		}
+	}
+
+	switch entry.Side {
+	case "":
+		entry.Side = ip.VethSideHost
+	case ip.VethSideHost, ip.VethSideContainer:
+	default:
+		return fmt.Errorf("side must be %q or %q", ip.VethSideHost, ip.VethSideContainer)
+	}
+	return nil
+}
+
+// getPinDir returns the directory the maps of the container are pinned in.
+func getPinDir(pinPath, networkName, containerID string) string {
+	return filepath.Join(pinPath, networkName, containerID)
+}
+
+func filterName(program string) string {
+	return filterPrefix + program
+}
+
+func hookParent(hook string) uint32 {
+	if hook == HookIngress {
+		return netlink.HANDLE_MIN_INGRESS
+	}
+	return netlink.HANDLE_MIN_EGRESS
+}
+
+// ensureClsact adds a clsact qdisc to the device, unless it already has one.
+func ensureClsact(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdiscs: %s", err)
+	}
+	for _, qdisc := range qdiscs {
+		switch qdisc.Type() {
+		case "clsact":
+			return nil
+		case "ingress":
+			return fmt.Errorf("device %q has an ingress qdisc, BPF programs need a clsact qdisc", link.Attrs().Name)
+		}
+	}
+
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(clsact); err != nil {
+		return fmt.Errorf("create clsact qdisc: %s", err)
+	}
+	return nil
+}
+
+// loadPrograms loads the programs of the entry, with the maps of the
+// object pinned in the directory. It returns the file descriptors of the
+// programs, in the order of the entry.
+func loadPrograms(entry *BPFEntry, pinDir string) ([]int, error) {
+	obj, err := loadObject(entry.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensurePinDir(pinDir); err != nil {
+		return nil, err
+	}
+	mapFDs := map[string]int{}
+	defer func() {
+		// The programs hold on to the maps they use
+		for _, fd := range mapFDs {
+			syscall.Close(fd)
+		}
+	}()
+	for i := range obj.Maps {
+		fd, err := openMap(pinDir, &obj.Maps[i])
+		if err != nil {
+			return nil, err
+		}
+		mapFDs[obj.Maps[i].Name] = fd
+	}
+
+	var progFDs []int
+	for _, p := range entry.Programs {
+		prog, ok := obj.Programs[p.Name]
+		if !ok {
+			closeAll(progFDs)
+			return nil, fmt.Errorf("no program %s in %s", p.Name, entry.Object)
+		}
+		insns, err := obj.relocate(prog, mapFDs)
+		if err != nil {
+			closeAll(progFDs)
+			return nil, fmt.Errorf("failed to relocate program %s: %v", p.Name, err)
+		}
+		fd, err := loadProgram(insns, obj.License)
+		if err != nil {
+			closeAll(progFDs)
+			return nil, fmt.Errorf("failed to load program %s: %v", p.Name, err)
+		}
+		progFDs = append(progFDs, fd)
+	}
+	return progFDs, nil
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// attachPrograms attaches the programs to the device. The filters hold on
+// to the programs, so the file descriptors are closed.
+func attachPrograms(link netlink.Link, programs []Program, fds []int) error {
+	defer closeAll(fds)
+
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	for i, p := range programs {
+		filter := &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    hookParent(p.Hook),
+				Protocol:  syscall.ETH_P_ALL,
+			},
+			Fd:           fds[i],
+			Name:         filterName(p.Name),
+			DirectAction: true,
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to attach program %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// listFilters returns the filters of the plugin on the hooks of the device.
+func listFilters(link netlink.Link) (map[string][]*netlink.BpfFilter, error) {
+	filters := map[string][]*netlink.BpfFilter{}
+	for _, hook := range []string{HookIngress, HookEgress} {
+		all, err := netlink.FilterList(link, hookParent(hook))
+		if err != nil {
+			return nil, fmt.Errorf("list filters: %s", err)
+		}
+		for _, f := range all {
+			if bpf, ok := f.(*netlink.BpfFilter); ok && strings.HasPrefix(bpf.Name, filterPrefix) {
+				filters[hook] = append(filters[hook], bpf)
+			}
+		}
+	}
+	return filters, nil
+}
+
+// detachPrograms removes the filters of the plugin from the device. The
+// clsact qdisc is left alone, as other plugins may use it.
+func detachPrograms(link netlink.Link) error {
+	filters, err := listFilters(link)
+	if err != nil {
+		return err
+	}
+	for _, hookFilters := range filters {
+		for _, f := range hookFilters {
+			if err := netlink.FilterDel(f); err != nil {
+				return fmt.Errorf("del filter: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.BPFEntry == nil {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	fds, err := loadPrograms(conf.BPFEntry, getPinDir(conf.PinPath, conf.Name, args.ContainerID))
+	if err != nil {
+		return err
+	}
+	err = ip.WithVethSide(conf.Side, args.Netns, args.IfName, func(link netlink.Link) error {
+		// Replace the programs of a previous ADD
+		if err := detachPrograms(link); err != nil {
+			return err
+		}
+		return attachPrograms(link, conf.Programs, fds)
+	})
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Detach the programs in case the interface stays around, as it does
+	// when the plugin is taken off the chain of a running container
+	if conf.BPFEntry != nil && args.Netns != "" {
+		err := ip.WithVethSide(conf.Side, args.Netns, args.IfName, detachPrograms)
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok && err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+	}
+
+	if err := os.RemoveAll(getPinDir(conf.PinPath, conf.Name, args.ContainerID)); err != nil {
+		return fmt.Errorf("failed to remove pinned maps: %v", err)
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if conf.BPFEntry == nil {
+		return nil
+	}
+
+	pinDir := getPinDir(conf.PinPath, conf.Name, args.ContainerID)
+	if _, err := os.Stat(pinDir); err != nil {
+		return utils.NewCheckError(fmt.Sprintf("directory %q", pinDir), "pinned maps are missing: %v", err)
+	}
+
+	return ip.WithVethSide(conf.Side, args.Netns, args.IfName, func(link netlink.Link) error {
+		resource := fmt.Sprintf("interface %q", link.Attrs().Name)
+		filters, err := listFilters(link)
+		if err != nil {
+			return err
+		}
+		for _, p := range conf.Programs {
+			found := false
+			for _, f := range filters[p.Hook] {
+				if f.Name == filterName(p.Name) && f.DirectAction {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return utils.NewCheckError(resource, "program %s is not attached to the %s hook", p.Name, p.Hook)
+			}
+		}
+		return nil
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI tc-bpf plugin")
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// emBPF is the ELF machine of BPF objects.
+const emBPF = 247
+
+// insnSize is the size of a BPF instruction. Loads of 64-bit immediates,
+// which are used for map references, take two.
+const (
+	insnSize    = 8
+	opLdImm64   = 0x18
+	mapDefSize  = 20
+	mapsSection = "maps"
+)
+
+// mapDef is the definition of a map in the maps section, as struct
+// bpf_map_def of the iproute2 and kernel samples loaders.
+type mapDef struct {
+	Type       uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	Flags      uint32
+}
+
+type mapSpec struct {
+	Name string
+	Def  mapDef
+}
+
+// mapRef is an instruction that loads the address of a map.
+type mapRef struct {
+	Offset uint64
+	Map    string
+}
+
+type progSpec struct {
+	Section string
+	Insns   []byte
+	MapRefs []mapRef
+}
+
+// bpfObject is the content of a BPF object file, as compiled by clang
+// with -target bpf.
+type bpfObject struct {
+	ByteOrder binary.ByteOrder
+	License   string
+	Maps      []mapSpec
+	// Programs by section name and by function name
+	Programs map[string]*progSpec
+}
+
+func loadObject(path string) (*bpfObject, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BPF object: %v", err)
+	}
+	defer f.Close()
+
+	if f.Machine != elf.Machine(emBPF) {
+		return nil, fmt.Errorf("%s is not a BPF object", path)
+	}
+
+	obj := &bpfObject{
+		ByteOrder: f.ByteOrder,
+		Programs:  map[string]*progSpec{},
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the symbols of %s: %v", path, err)
+	}
+
+	mapsIndex := -1
+	for i, s := range f.Sections {
+		switch {
+		case s.Name == "license":
+			data, err := s.Data()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the license of %s: %v", path, err)
+			}
+			obj.License = cString(data)
+		case s.Name == mapsSection:
+			mapsIndex = i
+			if obj.Maps, err = readMaps(s, symbols, i, f.ByteOrder); err != nil {
+				return nil, fmt.Errorf("failed to read the maps of %s: %v", path, err)
+			}
+		case s.Type == elf.SHT_PROGBITS && s.Flags&elf.SHF_EXECINSTR != 0 && s.Size > 0:
+			insns, err := s.Data()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read section %s of %s: %v", s.Name, path, err)
+			}
+			prog := &progSpec{Section: s.Name, Insns: insns}
+			obj.Programs[s.Name] = prog
+			for _, sym := range symbols {
+				if int(sym.Section) == i && elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value == 0 {
+					obj.Programs[sym.Name] = prog
+				}
+			}
+		}
+	}
+
+	// The relocations can only be read once the maps and programs are known
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_REL || int(s.Info) >= len(f.Sections) {
+			continue
+		}
+		prog, ok := obj.Programs[f.Sections[s.Info].Name]
+		if !ok {
+			continue
+		}
+		if prog.MapRefs, err = readMapRefs(s, symbols, mapsIndex, f.ByteOrder); err != nil {
+			return nil, fmt.Errorf("failed to read the relocations of %s in %s: %v", prog.Section, path, err)
+		}
+	}
+
+	return obj, nil
+}
+
+// readMaps returns the maps defined in the maps section, which has an
+// index in the section table. Each map is a data object symbol.
+func readMaps(s *elf.Section, symbols []elf.Symbol, index int, bo binary.ByteOrder) ([]mapSpec, error) {
+	data, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var maps []mapSpec
+	for _, sym := range symbols {
+		// Only the map definitions; the section may also have a
+		// section symbol, or other symbols that are no maps
+		if int(sym.Section) != index || elf.ST_TYPE(sym.Info) != elf.STT_OBJECT {
+			continue
+		}
+		if sym.Value+mapDefSize > uint64(len(data)) {
+			return nil, fmt.Errorf("map %s is truncated", sym.Name)
+		}
+		d := data[sym.Value:]
+		maps = append(maps, mapSpec{
+			Name: sym.Name,
+			Def: mapDef{
+				Type:       bo.Uint32(d[0:]),
+				KeySize:    bo.Uint32(d[4:]),
+				ValueSize:  bo.Uint32(d[8:]),
+				MaxEntries: bo.Uint32(d[12:]),
+				Flags:      bo.Uint32(d[16:]),
+			},
+		})
+	}
+	return maps, nil
+}
+
+// readMapRefs returns the instructions of a program that refer to a map.
+// Other relocations, e.g. to global variables, are not supported.
+func readMapRefs(s *elf.Section, symbols []elf.Symbol, mapsIndex int, bo binary.ByteOrder) ([]mapRef, error) {
+	data, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []mapRef
+	for off := 0; off+16 <= len(data); off += 16 {
+		rel := elf.Rel64{
+			Off:  bo.Uint64(data[off:]),
+			Info: bo.Uint64(data[off+8:]),
+		}
+		// The symbol table read by the elf package lacks the null symbol
+		symIndex := int(elf.R_SYM64(rel.Info)) - 1
+		if symIndex < 0 || symIndex >= len(symbols) {
+			return nil, fmt.Errorf("invalid symbol in relocation at %d", rel.Off)
+		}
+		sym := symbols[symIndex]
+		if mapsIndex < 0 || int(sym.Section) != mapsIndex {
+			return nil, fmt.Errorf("unsupported relocation to %s at %d", sym.Name, rel.Off)
+		}
+		refs = append(refs, mapRef{Offset: rel.Off, Map: sym.Name})
+	}
+	return refs, nil
+}
+
+// relocate returns the instructions of the program, with the map
+// references replaced by the file descriptors of the maps.
+func (obj *bpfObject) relocate(prog *progSpec, mapFDs map[string]int) ([]byte, error) {
+	insns := append([]byte{}, prog.Insns...)
+	for _, ref := range prog.MapRefs {
+		fd, ok := mapFDs[ref.Map]
+		if !ok {
+			return nil, fmt.Errorf("unknown map %s", ref.Map)
+		}
+		if err := setMapFD(insns, ref.Offset, fd, obj.ByteOrder); err != nil {
+			return nil, err
+		}
+	}
+	return insns, nil
+}
+
+// setMapFD turns the 64-bit immediate load at the offset into a load of
+// the map with the file descriptor.
+func setMapFD(insns []byte, offset uint64, fd int, bo binary.ByteOrder) error {
+	if offset%insnSize != 0 || offset+2*insnSize > uint64(len(insns)) {
+		return fmt.Errorf("invalid map reference at %d", offset)
+	}
+	insn := insns[offset : offset+insnSize]
+	if insn[0] != opLdImm64 {
+		return fmt.Errorf("map reference at %d is not a 64-bit immediate load", offset)
+	}
+
+	// The source register is the upper half of the register byte in
+	// little endian objects, and the lower half in big endian ones
+	if bo == binary.LittleEndian {
+		insn[1] = insn[1]&0x0f | bpfPseudoMapFD<<4
+	} else {
+		insn[1] = insn[1]&0xf0 | bpfPseudoMapFD
+	}
+	bo.PutUint32(insn[4:], uint32(fd))
+	return nil
+}
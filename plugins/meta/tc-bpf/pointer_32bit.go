@@ -0,0 +1,28 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build 386 || arm
+// +build 386 arm
+
+package main
+
+import "unsafe"
+
+// bpfPointer is a pointer field of a bpf attribute, which the kernel reads
+// as 64 bits wide. The padding follows the pointer, as the 32-bit
+// architectures are little endian.
+type bpfPointer struct {
+	ptr unsafe.Pointer
+	_   uint32
+}
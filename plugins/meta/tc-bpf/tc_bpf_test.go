@@ -0,0 +1,373 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeObject writes a BPF object with a program that refers to a map, as
+// clang would compile it:
+//
+//	struct bpf_map_def SEC("maps") counters = {...};
+//	SEC("classifier") int handle_ingress(struct __sk_buff *skb) {...}
+func writeObject(path string) {
+	bo := binary.LittleEndian
+	insns := []byte{
+		0x18, 0x01, 0, 0, 0, 0, 0, 0, // r1 = counters ll
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0xb7, 0, 0, 0, 0, 0, 0, 0, // r0 = 0
+		0x95, 0, 0, 0, 0, 0, 0, 0, // exit
+	}
+	maps := make([]byte, mapDefSize)
+	for i, v := range []uint32{1, 4, 8, 16, 0} {
+		bo.PutUint32(maps[i*4:], v)
+	}
+	rel := make([]byte, 16)
+	bo.PutUint64(rel[0:], 0)
+	bo.PutUint64(rel[8:], elf.R_INFO(3, 1)) // R_BPF_64_64
+
+	strtab := []byte("\x00handle_ingress\x00_license\x00counters\x00")
+	symtab := &bytes.Buffer{}
+	for _, sym := range []elf.Sym64{
+		{},
+		{Name: 1, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: 1, Size: uint64(len(insns))},
+		{Name: 16, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: 2, Size: 4},
+		{Name: 25, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: 3, Size: mapDefSize},
+		// The section symbol of the maps section, which is no map
+		{Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), Shndx: 3},
+	} {
+		Expect(binary.Write(symtab, bo, sym)).To(Succeed())
+	}
+
+	shstrtab := &bytes.Buffer{}
+	name := func(s string) uint32 {
+		off := shstrtab.Len()
+		shstrtab.WriteString(s + "\x00")
+		return uint32(off)
+	}
+	name("")
+
+	sections := []struct {
+		hdr  elf.Section64
+		data []byte
+	}{
+		{hdr: elf.Section64{}},
+		{hdr: elf.Section64{Name: name("classifier"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR)}, data: insns},
+		{hdr: elf.Section64{Name: name("license"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE)}, data: []byte("GPL\x00")},
+		{hdr: elf.Section64{Name: name("maps"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE)}, data: maps},
+		{hdr: elf.Section64{Name: name(".relclassifier"), Type: uint32(elf.SHT_REL), Link: 5, Info: 1, Entsize: 16}, data: rel},
+		{hdr: elf.Section64{Name: name(".symtab"), Type: uint32(elf.SHT_SYMTAB), Link: 6, Info: 1, Entsize: 24}, data: symtab.Bytes()},
+		{hdr: elf.Section64{Name: name(".strtab"), Type: uint32(elf.SHT_STRTAB)}, data: strtab},
+		{hdr: elf.Section64{Name: name(".shstrtab"), Type: uint32(elf.SHT_STRTAB)}},
+	}
+	sections[len(sections)-1].data = shstrtab.Bytes()
+
+	body := &bytes.Buffer{}
+	const headerSize = 64
+	for i := range sections {
+		for body.Len()%8 != 0 {
+			body.WriteByte(0)
+		}
+		if i > 0 {
+			sections[i].hdr.Off = uint64(headerSize + body.Len())
+			sections[i].hdr.Size = uint64(len(sections[i].data))
+			sections[i].hdr.Addralign = 8
+		}
+		body.Write(sections[i].data)
+	}
+	for body.Len()%8 != 0 {
+		body.WriteByte(0)
+	}
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   emBPF,
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(headerSize + body.Len()),
+		Ehsize:    headerSize,
+		Shentsize: 64,
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  uint16(len(sections) - 1),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	out := &bytes.Buffer{}
+	Expect(binary.Write(out, bo, hdr)).To(Succeed())
+	out.Write(body.Bytes())
+	for _, s := range sections {
+		Expect(binary.Write(out, bo, s.hdr)).To(Succeed())
+	}
+	Expect(ioutil.WriteFile(path, out.Bytes(), 0644)).To(Succeed())
+}
+
+var _ = Describe("tc-bpf configuration", func() {
+	It("uses the runtime config over the static one", func() {
+		conf, err := parseConfig([]byte(`{
+	"name": "test",
+	"type": "tc-bpf",
+	"cniVersion": "0.4.0",
+	"object": "/opt/bpf/static.o",
+	"programs": [{"name": "classifier", "hook": "ingress"}],
+	"runtimeConfig": {
+		"tcBPF": {
+			"object": "/opt/bpf/workload.o",
+			"programs": [{"name": "handle_egress", "hook": "egress"}],
+			"side": "container"
+		}
+	}
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Object).To(Equal("/opt/bpf/workload.o"))
+		Expect(conf.Programs).To(Equal([]Program{{Name: "handle_egress", Hook: HookEgress}}))
+		Expect(conf.Side).To(Equal(ip.VethSideContainer))
+		Expect(conf.PinPath).To(Equal("/sys/fs/bpf/cni"))
+	})
+
+	It("attaches to the host side by default", func() {
+		conf, err := parseConfig([]byte(`{
+	"name": "test",
+	"type": "tc-bpf",
+	"object": "/opt/bpf/static.o",
+	"programs": [{"name": "classifier", "hook": "ingress"}]
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Side).To(Equal(ip.VethSideHost))
+	})
+
+	It("rejects an unknown hook", func() {
+		_, err := parseConfig([]byte(`{
+	"name": "test",
+	"type": "tc-bpf",
+	"object": "/opt/bpf/static.o",
+	"programs": [{"name": "classifier", "hook": "forward"}]
+}`))
+		Expect(err).To(MatchError(`program classifier: hook must be "ingress" or "egress"`))
+	})
+
+	It("pins the maps in a directory per container", func() {
+		Expect(getPinDir("/sys/fs/bpf/cni", "test", "dummy")).To(Equal("/sys/fs/bpf/cni/test/dummy"))
+	})
+})
+
+var _ = Describe("tc-bpf objects", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tc-bpf")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reads the programs, maps and map references of an object", func() {
+		path := filepath.Join(dir, "prog.o")
+		writeObject(path)
+
+		obj, err := loadObject(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.License).To(Equal("GPL"))
+		Expect(obj.Maps).To(Equal([]mapSpec{{
+			Name: "counters",
+			Def:  mapDef{Type: 1, KeySize: 4, ValueSize: 8, MaxEntries: 16},
+		}}))
+
+		Expect(obj.Programs).To(HaveKey("classifier"))
+		Expect(obj.Programs["handle_ingress"] == obj.Programs["classifier"]).To(BeTrue())
+		prog := obj.Programs["classifier"]
+		Expect(prog.Insns).To(HaveLen(32))
+		Expect(prog.MapRefs).To(Equal([]mapRef{{Offset: 0, Map: "counters"}}))
+	})
+
+	It("replaces the map references with the map file descriptors", func() {
+		path := filepath.Join(dir, "prog.o")
+		writeObject(path)
+		obj, err := loadObject(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		insns, err := obj.relocate(obj.Programs["classifier"], map[string]int{"counters": 42})
+		Expect(err).NotTo(HaveOccurred())
+		// The destination register is kept and the source register is
+		// the map fd marker
+		Expect(insns[1]).To(Equal(byte(0x11)))
+		Expect(binary.LittleEndian.Uint32(insns[4:])).To(Equal(uint32(42)))
+		// The object itself is untouched
+		Expect(obj.Programs["classifier"].Insns[1]).To(Equal(byte(0x01)))
+
+		_, err = obj.relocate(obj.Programs["classifier"], map[string]int{})
+		Expect(err).To(MatchError("unknown map counters"))
+	})
+
+	It("lays out the attributes as the kernel expects", func() {
+		Expect(unsafe.Offsetof(progLoadAttr{}.insns)).To(BeEquivalentTo(8))
+		Expect(unsafe.Offsetof(progLoadAttr{}.logBuf)).To(BeEquivalentTo(32))
+		Expect(unsafe.Sizeof(progLoadAttr{})).To(BeEquivalentTo(48))
+		Expect(unsafe.Sizeof(objAttr{})).To(BeEquivalentTo(16))
+	})
+
+	It("rejects map references to other instructions", func() {
+		insns := make([]byte, 32)
+		insns[16] = 0xb7
+		Expect(setMapFD(insns, 16, 3, binary.LittleEndian)).To(MatchError("map reference at 16 is not a 64-bit immediate load"))
+		Expect(setMapFD(insns, 4, 3, binary.LittleEndian)).To(MatchError("invalid map reference at 4"))
+	})
+
+	It("rejects an object of another machine", func() {
+		_, err := loadObject(os.Args[0])
+		Expect(err).To(MatchError(fmt.Sprintf("%s is not a BPF object", os.Args[0])))
+	})
+})
+
+var _ = Describe("tc-bpf plugin", func() {
+	var originalNS, targetNS ns.NetNS
+	var dir string
+	const IFNAME string = "eth0"
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		dir, err = ioutil.TempDir("", "tc-bpf")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IFNAME}})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("attaches the programs with ADD, checks them with CHECK and detaches them with DEL", func() {
+		object := filepath.Join(dir, "prog.o")
+		writeObject(object)
+		conf := fmt.Sprintf(`{
+	"name": "test",
+	"type": "tc-bpf",
+	"cniVersion": "0.4.0",
+	"pinPath": "/sys/fs/bpf/cni-test",
+	"object": %q,
+	"programs": [
+		{"name": "handle_ingress", "hook": "ingress"},
+		{"name": "classifier", "hook": "egress"}
+	],
+	"side": "container",
+	"prevResult": {
+		"interfaces": [{"name": "eth0", "sandbox": %q}],
+		"ips": []
+	}
+}`, object, targetNS.Path())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		pinDir := getPinDir("/sys/fs/bpf/cni-test", "test", "dummy")
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, args.StdinData, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(pinDir, "counters")).To(BeAnExistingFile())
+
+			err = testutils.CmdCheckWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			filters, err := listFilters(link)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters[HookIngress]).To(HaveLen(1))
+			Expect(filters[HookIngress][0].Name).To(Equal("cni:handle_ingress"))
+			Expect(filters[HookEgress]).To(HaveLen(1))
+
+			// Detach the egress program behind the plugin's back
+			Expect(netlink.FilterDel(filters[HookEgress][0])).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdCheckWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Details).To(Equal(`interface "eth0"`))
+
+			err = testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pinDir).NotTo(BeADirectory())
+
+			// DEL is idempotent
+			err = testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -26,9 +26,10 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
 )
 
 // TuningConf represents the network tuning configuration.
@@ -47,6 +48,10 @@ func parseConf(data []byte) (*TuningConf, error) {
 
 	// Parse previous result.
 	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
 		resultBytes, err := json.Marshal(conf.RawPrevResult)
 		if err != nil {
 			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
@@ -106,6 +111,37 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	tuningConf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if tuningConf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		for key, conf := range tuningConf.SysCtl {
+			fileName := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+			fileName = filepath.Clean(fileName)
+
+			if !strings.HasPrefix(fileName, "/proc/sys/net/") {
+				return fmt.Errorf("invalid net sysctl key: %q", key)
+			}
+			contents, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return err
+			}
+			curVal := strings.TrimSpace(string(contents))
+			if curVal != conf {
+				return utils.NewCheckError(fmt.Sprintf("sysctl %q", key), "sysctl %s is %q, expected %q", key, curVal, conf)
+			}
+		}
+		return nil
+	})
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "CNI tuning plugin")
 }
@@ -0,0 +1,347 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a post-setup plugin that places the container interface into a
+// VRF inside the container namespace, so that interfaces in different VRFs
+// may use overlapping address spaces.
+//
+// The VRF device is created on the first ADD and reused by later ones; its
+// routes live in the table given in the configuration. DEL removes the VRF
+// once no interface is enslaved to it any more.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/040"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/rollback"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// PluginConf represents the vrf plugin configuration.
+type PluginConf struct {
+	types.NetConf
+
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+
+	// VRFName is the name of the VRF device in the container namespace.
+	VRFName string `json:"vrfname"`
+	// Table is the routing table of the VRF.
+	Table uint32 `json:"table"`
+}
+
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := conf.RawPrevResult["cniVersion"]; !ok {
+			conf.RawPrevResult["cniVersion"] = conf.CNIVersion
+		}
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	if conf.VRFName == "" {
+		return nil, fmt.Errorf("vrfname must be specified")
+	}
+	if conf.Table == 0 {
+		return nil, fmt.Errorf("table must be specified")
+	}
+	if conf.Table == syscall.RT_TABLE_MAIN || conf.Table == syscall.RT_TABLE_LOCAL {
+		return nil, fmt.Errorf("table %d is reserved", conf.Table)
+	}
+
+	return &conf, nil
+}
+
+// checkInterface verifies that the container interface is in prevResult.
+func checkInterface(iface string, prevResult *current.Result) error {
+	for _, intf := range prevResult.Interfaces {
+		if intf.Name == iface && intf.Sandbox != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("interface %q not found in prevResult", iface)
+}
+
+// findVRF returns the named VRF device, or nil if there is none.
+func findVRF(name string) (*netlink.Vrf, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists and is not a VRF", name)
+	}
+	return vrf, nil
+}
+
+// setupVRF returns the VRF device of the configuration, creating it if it
+// does not exist yet. created reports whether it was.
+func setupVRF(conf *PluginConf) (vrf *netlink.Vrf, created bool, err error) {
+	vrf, err = findVRF(conf.VRFName)
+	if err != nil {
+		return nil, false, err
+	}
+	if vrf != nil {
+		if vrf.Table != conf.Table {
+			return nil, false, fmt.Errorf("VRF %q already exists with table %d, not %d", conf.VRFName, vrf.Table, conf.Table)
+		}
+		return vrf, false, nil
+	}
+
+	vrf = &netlink.Vrf{
+		LinkAttrs: netlink.LinkAttrs{Name: conf.VRFName},
+		Table:     conf.Table,
+	}
+	if err := netlink.LinkAdd(vrf); err != nil {
+		return nil, false, fmt.Errorf("failed to create VRF %q: %v", conf.VRFName, err)
+	}
+	if err := netlink.LinkSetUp(vrf); err != nil {
+		netlink.LinkDel(vrf)
+		return nil, false, fmt.Errorf("failed to set %q up: %v", conf.VRFName, err)
+	}
+
+	// Re-fetch the link to get its index
+	vrf, err = findVRF(conf.VRFName)
+	if err != nil {
+		return nil, false, err
+	}
+	return vrf, true, nil
+}
+
+// addInterface enslaves the interface to the VRF and moves its routes from
+// the main table into the VRF table.
+func addInterface(vrf *netlink.Vrf, iface string, undo *rollback.Stack) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find %q: %v", iface, err)
+	}
+	if link.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("%q already has a master", iface)
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", iface, err)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", iface, err)
+	}
+
+	if err := netlink.LinkSetMasterByIndex(link, vrf.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to enslave %q to %q: %v", iface, vrf.Attrs().Name, err)
+	}
+	undo.Push("release interface", func() error {
+		return netlink.LinkSetNoMaster(link)
+	})
+
+	// Enslaving cycles the link, which drops its IPv6 addresses
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		a := addr
+		if err := netlink.AddrAdd(link, &a); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to restore address %v on %q: %v", addr.IPNet, iface, err)
+		}
+	}
+
+	for _, route := range routes {
+		// Link-local routes are recreated by the kernel
+		if route.Dst != nil && route.Dst.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		route.Table = int(vrf.Table)
+		if err := netlink.RouteAdd(&route); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route %v to table %d: %v", route, vrf.Table, err)
+		}
+	}
+
+	return nil
+}
+
+// removeInterface releases the interface from the VRF and deletes the VRF
+// if no other interface is enslaved to it.
+func removeInterface(conf *PluginConf, iface string) error {
+	vrf, err := findVRF(conf.VRFName)
+	if err != nil {
+		return err
+	}
+	if vrf == nil {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err == nil && link.Attrs().MasterIndex == vrf.Attrs().Index {
+		if err := netlink.LinkSetNoMaster(link); err != nil {
+			return fmt.Errorf("failed to release %q from %q: %v", iface, conf.VRFName, err)
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex == vrf.Attrs().Index {
+			return nil
+		}
+	}
+
+	if err := netlink.LinkDel(vrf); err != nil {
+		return fmt.Errorf("failed to delete VRF %q: %v", conf.VRFName, err)
+	}
+	return nil
+}
+
+// checkVRF verifies that the VRF exists with the configured table and that
+// the interface is enslaved to it.
+func checkVRF(conf *PluginConf, iface string) error {
+	vrf, err := findVRF(conf.VRFName)
+	if err != nil {
+		return err
+	}
+	resource := fmt.Sprintf("vrf %q", conf.VRFName)
+	if vrf == nil {
+		return utils.NewCheckError(resource, "VRF %q not found", conf.VRFName)
+	}
+	if vrf.Table != conf.Table {
+		return utils.NewCheckError(resource, "VRF %q has table %d, not %d", conf.VRFName, vrf.Table, conf.Table)
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", iface), "failed to find %q: %v", iface, err)
+	}
+	if link.Attrs().MasterIndex != vrf.Attrs().Index {
+		return utils.NewCheckError(fmt.Sprintf("interface %q", iface), "%q is not enslaved to VRF %q", iface, conf.VRFName)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+	if err := checkInterface(args.IfName, conf.PrevResult); err != nil {
+		return err
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		var undo rollback.Stack
+		defer undo.RollbackAndLog()
+
+		vrf, created, err := setupVRF(conf)
+		if err != nil {
+			return err
+		}
+		if created {
+			undo.Push("delete VRF", func() error {
+				return netlink.LinkDel(vrf)
+			})
+		}
+
+		if err := addInterface(vrf, args.IfName, &undo); err != nil {
+			return err
+		}
+
+		undo.Commit()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Pass through the previous result
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// Per spec, DEL must not fail if the namespace is already gone
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return removeInterface(conf, args.IfName)
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+	if err := checkInterface(args.IfName, conf.PrevResult); err != nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return checkVRF(conf, args.IfName)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI vrf plugin")
+}
@@ -0,0 +1,235 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const vrfConf = `{
+	"name": "tenant",
+	"type": "vrf",
+	"cniVersion": "0.4.0",
+	"vrfname": "blue",
+	"table": 1001,
+	"prevResult": {
+		"interfaces": [
+			{"name": "net1", "sandbox": "netns"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"interface": 0
+			}
+		]
+	}
+}`
+
+var _ = Describe("vrf configuration", func() {
+	It("parses a valid configuration", func() {
+		conf, err := parseConfig([]byte(vrfConf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.VRFName).To(Equal("blue"))
+		Expect(conf.Table).To(Equal(uint32(1001)))
+		Expect(checkInterface("net1", conf.PrevResult)).To(Succeed())
+		Expect(checkInterface("eth0", conf.PrevResult)).NotTo(Succeed())
+	})
+
+	It("rejects a missing vrfname or table", func() {
+		_, err := parseConfig([]byte(`{"name": "tenant", "type": "vrf", "table": 1001}`))
+		Expect(err).To(MatchError("vrfname must be specified"))
+
+		_, err = parseConfig([]byte(`{"name": "tenant", "type": "vrf", "vrfname": "blue"}`))
+		Expect(err).To(MatchError("table must be specified"))
+
+		_, err = parseConfig([]byte(`{"name": "tenant", "type": "vrf", "vrfname": "blue", "table": 254}`))
+		Expect(err).To(MatchError("table 254 is reserved"))
+	})
+})
+
+var _ = Describe("vrf plugin", func() {
+	var targetNs ns.NetNS
+	const IFNAME string = "net1"
+
+	BeforeEach(func() {
+		var err error
+		targetNs, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			addr, err := netlink.ParseAddr("10.0.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+
+			_, dst, _ := net.ParseCIDR("10.10.0.0/16")
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("10.0.0.1"),
+			})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(targetNs.Close()).To(Succeed())
+	})
+
+	// routesOf returns the destinations of the routes through IFNAME in
+	// the given table.
+	routesOf := func(table int) []string {
+		link, err := netlink.LinkByName(IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: table, LinkIndex: link.Attrs().Index},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+		Expect(err).NotTo(HaveOccurred())
+		dsts := []string{}
+		for _, route := range routes {
+			if route.Dst != nil {
+				dsts = append(dsts, route.Dst.String())
+			}
+		}
+		return dsts
+	}
+
+	It("enslaves the interface with ADD, checks it with CHECK and removes the VRF with DEL", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(vrfConf),
+		}
+
+		_, _, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, args.StdinData, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			vrf, err := netlink.LinkByName("blue")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vrf).To(BeAssignableToTypeOf(&netlink.Vrf{}))
+			Expect(vrf.(*netlink.Vrf).Table).To(Equal(uint32(1001)))
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(Equal(vrf.Attrs().Index))
+
+			Expect(routesOf(1001)).To(ContainElement("10.10.0.0/16"))
+			Expect(routesOf(syscall.RT_TABLE_MAIN)).NotTo(ContainElement("10.10.0.0/16"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName("blue")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(Equal(0))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdCheckWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Details).To(Equal(`vrf "blue"`))
+	})
+
+	It("keeps the VRF on DEL while another interface is enslaved", func() {
+		err := targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			vrf := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "blue"}, Table: 1001}
+			Expect(netlink.LinkAdd(vrf)).To(Succeed())
+			link, err := netlink.LinkByName("blue")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{Name: "net2", MasterIndex: link.Attrs().Index},
+			})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(vrfConf),
+		}
+
+		_, _, err = testutils.CmdAddWithResult(targetNs.Path(), IFNAME, args.StdinData, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithResult(targetNs.Path(), IFNAME, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName("blue")
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -23,7 +23,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/version"
 )
 
@@ -61,6 +61,10 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 
 	// Parse previous result. Remove this if your plugin is not chained.
 	if conf.RawPrevResult != nil {
+		// The previous result may leave its version to the configuration
+		if _, ok := (*conf.RawPrevResult)["cniVersion"]; !ok {
+			(*conf.RawPrevResult)["cniVersion"] = conf.CNIVersion
+		}
 		resultBytes, err := json.Marshal(conf.RawPrevResult)
 		if err != nil {
 			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
@@ -140,6 +144,22 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+// cmdCheck is called for CHECK requests
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	// Verify that what cmdAdd set up is still in place here
+
+	return nil
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.PluginSupports("", "0.1.0", "0.2.0", version.Current()))
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("", "0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", version.Current()), "CNI sample plugin")
 }